@@ -1,17 +1,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
+	"strings"
+	"time"
 
 	"backend/internal/api"
+	"backend/internal/cdc"
 	"backend/internal/config"
 	"backend/internal/db"
 	"backend/internal/middleware"
+	"backend/internal/oidc"
 	"backend/internal/services"
 	"backend/internal/storage"
+	"backend/internal/tokens"
 
 	"github.com/gorilla/mux"
 	"gorm.io/driver/postgres"
@@ -29,67 +34,173 @@ func main() {
 	}
 
 	// AutoMigrate models (alternative: run raw migrations)
-	if err := dbConn.AutoMigrate(&db.User{}, &db.File{}, &db.UserFile{}, &db.Folder{}, &db.Share{}); err != nil {
+	if err := dbConn.AutoMigrate(&db.User{}, &db.File{}, &db.UserFile{}, &db.Folder{}, &db.Share{}, &db.Session{}, &db.APIKey{}, &db.UserIdentity{}, &db.RecoveryCode{}, &db.AuditLog{}, &db.UserDeletion{}, &db.UploadSession{}, &db.UploadChunk{}, &db.Chunk{}, &db.FileChunk{}); err != nil {
 		log.Fatalf("failed to migrate DB: %v", err)
 	}
 	db.DB = dbConn // make global ref available
 
-	// === Setup MinIO Storage ===
-	minioClient, err := storage.NewMinioClient(
-		cfg.MinioEndpoint,
-		cfg.MinioAccessKey,
-		cfg.MinioSecretKey,
-		"files",
-		cfg.MinioUseSSL,
-	)
+	// === Setup Object Storage (minio | local | memory) ===
+	store, err := storage.NewBackend(cfg)
 	if err != nil {
-		log.Fatalf("failed to init MinIO: %v", err)
+		log.Fatalf("failed to init %s storage: %v", cfg.StorageBackend, err)
+	}
+
+	// === Setup Token Signing Keys (JWT_KEYS_DIR, or HS256 with JWT_SECRET) ===
+	keys, err := tokens.Load(tokens.Options{
+		Dir:        cfg.JWTKeysDir,
+		ActiveKID:  cfg.JWTActiveKID,
+		Alg:        cfg.JWTKeyAlg,
+		Grace:      cfg.JWTKeyGrace,
+		HMACSecret: cfg.JWTSecret,
+	})
+	if err != nil {
+		log.Fatalf("failed to load signing keys: %v", err)
 	}
 
 	// === Setup Services ===
-	fileService := services.NewFileService(dbConn, minioClient)
+	fileService := services.NewFileService(dbConn, store)
+	switch cfg.DedupMode {
+	case "chunk":
+		opts := cdc.WithAverage(cfg.ChunkAvgSize)
+		if err := opts.Validate(); err != nil {
+			log.Fatalf("invalid CHUNK_AVG_SIZE: %v", err)
+		}
+		fileService.SetChunking(&opts)
+	case "file":
+	default:
+		log.Fatalf("unknown DEDUP_MODE %q, expected file or chunk", cfg.DedupMode)
+	}
 	adminService := services.NewAdminService(dbConn)
 	shareService := services.NewShareService(dbConn)
 	searchService := services.NewSearchService(dbConn)
 	statsService := services.NewStatsService(dbConn)
+	folderService := services.NewFolderService(dbConn, fileService)
+	apiKeyService := services.NewAPIKeyService(dbConn)
+	auditService := services.NewAuditService(dbConn)
+	authService := services.NewAuthService(dbConn, keys, cfg.AccessTokenTTL, cfg.RefreshTokenTTL)
+	if cfg.MFAEncryptionKey == "" {
+		log.Println("MFA_ENCRYPTION_KEY is not set, TOTP secrets are stored unencrypted")
+	}
+	mfaService, err := services.NewMFAService(dbConn, authService, cfg.MFAIssuer, cfg.MFAEncryptionKey)
+	if err != nil {
+		log.Fatalf("failed to init mfa: %v", err)
+	}
+
+	// Background garbage collection of unreferenced objects
+	gc := services.NewGarbageCollector(fileService, cfg.GCGracePeriod)
+	gc.Start(context.Background(), cfg.GCInterval)
+
+	// Background user deletion, resumes jobs a restart interrupted
+	deletionService := services.NewUserDeletionService(dbConn, fileService)
+	deletionService.Start(context.Background(), time.Minute)
+
+	// Resumable uploads, expired ones are dropped along with their chunks
+	uploadService := services.NewUploadService(dbConn, fileService, cfg.UploadSessionTTL)
+	uploadService.Start(context.Background(), cfg.GCInterval)
 
 	// === Setup Router ===
 	r := mux.NewRouter()
+	// every request gets an ID, handlers record audit entries through the audit service
+	r.Use(middleware.RequestID, middleware.Audit(auditService))
 
 	// Middlewares
 	authMw := middleware.AuthMiddleware(middleware.AuthOptions{
-		JWTSecret: os.Getenv("JWT_SECRET"), // set in docker-compose
-		DB:        dbConn,
+		Keys: keys,
+		DB:   dbConn,
 	})
 	quotaMw := middleware.QuotaMiddleware(dbConn)
+	impersonateMw := middleware.Impersonation(dbConn, auditService)
 
 	//Rate limiter instance
 	rl := middleware.NewRateLimiter(2, 2) // new ratelimiter instance
 	rateLimitMw := middleware.RateLimitMiddleware(rl)
 
+	// auth first so the rate limiter and quota see the authenticated user
 	mwChain := func(h http.Handler) http.Handler {
-		return rateLimitMw(quotaMw(authMw(h)))
+		return authMw(rateLimitMw(quotaMw(h)))
+	}
+	// scoped: data routes. API keys need the scope, admins may act as another user.
+	scoped := func(scope string, h http.Handler) http.Handler {
+		return authMw(impersonateMw(rateLimitMw(quotaMw(middleware.RequireScope(scope)(h)))))
+	}
+	// sessionOnly: account and admin routes, API keys are refused
+	sessionOnly := func(h http.Handler) http.Handler {
+		return mwChain(middleware.SessionOnly(h))
 	}
 
 	// === API Routes ===
+	// Auth: no token yet, rate limited per client IP to slow down password guessing
+	authRL := middleware.NewRateLimiter(0.2, 5)
+	authRateLimitMw := middleware.RateLimitMiddleware(authRL)
+	r.Handle("/auth/register", authRateLimitMw(api.NewRegisterHandler(authService))).Methods("POST")
+	r.Handle("/auth/login", authRateLimitMw(api.NewLoginHandler(authService))).Methods("POST")
+	r.Handle("/auth/refresh", authRateLimitMw(api.NewRefreshHandler(authService))).Methods("POST")
+	if cfg.OIDCIssuer != "" {
+		provider := oidc.NewProvider(oidc.Config{
+			Issuer:       cfg.OIDCIssuer,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+			Scopes:       strings.Fields(cfg.OIDCScopes),
+		})
+		oidcService := services.NewOIDCService(dbConn, provider, authService, keys)
+		r.Handle("/auth/oidc/login", authRateLimitMw(api.NewOIDCLoginHandler(oidcService))).Methods("GET")
+		r.Handle("/auth/oidc/callback", authRateLimitMw(api.NewOIDCCallbackHandler(oidcService))).Methods("GET")
+	}
+	r.Handle("/auth/mfa/login", authRateLimitMw(api.NewMFALoginHandler(mfaService))).Methods("POST")
+	r.PathPrefix("/auth/mfa/").Handler(sessionOnly(http.StripPrefix("/auth/mfa", api.NewMFAHandler(mfaService))))
+	r.Handle("/auth/logout", sessionOnly(api.NewLogoutHandler(authService, false))).Methods("POST")
+	r.Handle("/auth/logout-all", sessionOnly(api.NewLogoutHandler(authService, true))).Methods("POST")
+
+	// API keys
+	r.Handle("/apikeys", sessionOnly(api.NewAPIKeyHandler(apiKeyService))).Methods("POST", "GET", "DELETE")
+
 	// Upload
-	r.Handle("/upload", mwChain(api.NewUploadHandler(fileService))).Methods("POST")
+	r.Handle("/upload", scoped(tokens.ScopeUpload, api.NewUploadHandler(fileService))).Methods("POST")
+	// Dedup check: link content the user already stored by sha256 + size without sending it again
+	r.Handle("/upload/check", scoped(tokens.ScopeUpload, api.NewUploadCheckHandler(fileService))).Methods("POST")
+	// Resumable upload: create, then PATCH chunks at Upload-Offset (HEAD to resume), then finalize
+	r.Handle("/uploads", scoped(tokens.ScopeUpload, api.NewCreateUploadHandler(uploadService))).Methods("POST")
+	r.Handle("/uploads/{id}", scoped(tokens.ScopeUpload, api.NewUploadChunkHandler(uploadService))).Methods("HEAD", "PATCH", "DELETE")
+	r.Handle("/uploads/{id}/finalize", scoped(tokens.ScopeUpload, api.NewFinalizeUploadHandler(uploadService))).Methods("POST")
 
 	// Files
-	r.Handle("/files", mwChain(http.HandlerFunc(api.ListUserFiles))).Methods("GET")
-	r.Handle("/files", mwChain(http.HandlerFunc(api.DeleteFileHandler))).Methods("DELETE")
+	r.Handle("/files", scoped(tokens.ScopeRead, http.HandlerFunc(api.ListUserFiles))).Methods("GET")
+	r.Handle("/files", scoped(tokens.ScopeWrite, api.NewDeleteFileHandler(fileService))).Methods("DELETE")
+	r.Handle("/files/{id}", scoped(tokens.ScopeWrite, api.NewUpdateFileHandler(fileService))).Methods("PATCH")
+	r.Handle("/files/{id}/move", scoped(tokens.ScopeWrite, api.NewMoveFileHandler(fileService))).Methods("POST")
+	r.Handle("/files/{id}/content", scoped(tokens.ScopeRead, api.NewDownloadHandler(fileService))).Methods("GET", "HEAD")
+
+	// Folders
+	folderHandler := api.NewFolderHandler(folderService)
+	r.Handle("/folders", scoped(tokens.ScopeRead, folderHandler)).Methods("GET")
+	r.Handle("/folders", scoped(tokens.ScopeWrite, folderHandler)).Methods("POST", "DELETE")
+	r.Handle("/folders/contents", scoped(tokens.ScopeRead, api.NewFolderContentsHandler(folderService))).Methods("GET")
+	r.Handle("/folders/tree", scoped(tokens.ScopeRead, api.NewFolderTreeHandler(folderService))).Methods("GET")
+	r.Handle("/folders/resolve", scoped(tokens.ScopeRead, api.NewResolvePathHandler(folderService))).Methods("GET")
+	r.Handle("/folders/{id}/move", scoped(tokens.ScopeWrite, api.NewMoveFolderHandler(folderService))).Methods("POST")
 
 	// Shares
-	r.Handle("/shares", mwChain(api.NewShareHandler(shareService))).Methods("POST", "GET", "DELETE")
+	shareHandler := api.NewShareHandler(shareService)
+	r.Handle("/shares", scoped(tokens.ScopeRead, shareHandler)).Methods("GET")
+	r.Handle("/shares", scoped(tokens.ScopeWrite, shareHandler)).Methods("POST", "DELETE")
+	r.Handle("/shares/incoming", scoped(tokens.ScopeRead, api.NewIncomingSharesHandler(shareService))).Methods("GET")
+
+	// Public share links: no auth, rate limited per client IP
+	shareRL := middleware.NewRateLimiter(1, 5)
+	r.Handle("/s/{token}", middleware.RateLimitMiddleware(shareRL)(api.NewGetShareHandler(shareService, fileService))).Methods("GET", "HEAD")
 
 	// Search
-	r.Handle("/search", mwChain(api.NewSearchHandler(searchService))).Methods("GET")
+	r.Handle("/search", scoped(tokens.ScopeRead, api.NewSearchHandler(searchService))).Methods("GET")
 
 	// Stats
-	r.Handle("/stats", mwChain(api.NewStatsHandler(statsService))).Methods("GET")
+	r.Handle("/stats", scoped(tokens.ScopeRead, api.NewStatsHandler(statsService))).Methods("GET")
+
+	// Admin: staff must have logged in with their second factor, each route checks a permission
+	r.PathPrefix("/admin/").Handler(sessionOnly(middleware.RequireMFA(dbConn)(http.StripPrefix("/admin", api.NewAdminHandler(adminService, deletionService, auditService, gc, keys)))))
 
-	// Admin
-	r.PathPrefix("/admin/").Handler(mwChain(api.NewAdminHandler(adminService)))
+	// Public keys for verifying our tokens elsewhere
+	r.Handle("/.well-known/jwks.json", api.NewJWKSHandler(keys)).Methods("GET")
 
 	// Health check
 	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
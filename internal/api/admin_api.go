@@ -2,41 +2,284 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 
 	"backend/internal/middleware"
+	"backend/internal/rbac"
 	"backend/internal/services"
+	"backend/internal/tokens"
+
+	"github.com/google/uuid"
 )
 
-func NewAdminHandler(svc *services.AdminService) http.Handler {
+func NewAdminHandler(svc *services.AdminService, deletions *services.UserDeletionService, audits *services.AuditService, gc *services.GarbageCollector, keys *tokens.KeySet) http.Handler {
 	mux := http.NewServeMux()
 
-	// GET /admin/users → list users
-	mux.Handle("/users", middleware.AdminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		users, err := svc.ListUsers()
+	// GET /admin/users?q=&role=&suspended=true|false&page=&per_page=&sort=&order=asc|desc → one page of users
+	mux.Handle("GET /users", middleware.RequirePermission(rbac.PermUsersRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		filter := services.UserFilter{
+			Query: q.Get("q"),
+			Role:  q.Get("role"),
+			Sort:  q.Get("sort"),
+			Desc:  q.Get("order") == "desc",
+		}
+		var err error
+		if filter.Page, filter.PerPage, err = pageParams(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if v := q.Get("suspended"); v != "" {
+			suspended, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "invalid suspended filter", http.StatusBadRequest)
+				return
+			}
+			filter.Suspended = &suspended
+		}
+		page, err := svc.ListUsers(filter)
+		if err != nil {
+			writeAdminError(w, err, "failed to fetch users")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	})))
+
+	// POST /admin/users {"username", "email", "password", "role", "quota"} → create an account
+	mux.Handle("POST /users", middleware.RequirePermission(rbac.PermUsersWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req CreateUserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		// handing out roles is a permission of its own
+		if req.Role != "" && req.Role != rbac.RoleUser && !rbac.Has(middleware.GetUser(r.Context()), rbac.PermUsersRoles) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		user, err := svc.CreateUser(services.CreateUserInput{
+			RegisterInput: services.RegisterInput{Username: req.Username, Email: req.Email, Password: req.Password},
+			Role:          req.Role,
+			Quota:         req.Quota,
+		})
+		if err != nil {
+			writeAdminError(w, err, "failed to create user")
+			return
+		}
+		audit(r, middleware.ActionUserCreate, "user", user.ID.String(), map[string]interface{}{"username": user.Username, "role": user.Role, "quota": user.Quota})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(user)
+	})))
+
+	// GET /admin/users/{id} → the user with their file, folder and share counts
+	mux.Handle("GET /users/{id}", middleware.RequirePermission(rbac.PermUsersRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		usage, err := svc.GetUserUsage(userID)
 		if err != nil {
-			http.Error(w, "failed to fetch users", http.StatusInternalServerError)
+			writeAdminError(w, err, "failed to fetch user")
 			return
 		}
-		json.NewEncoder(w).Encode(users)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usage)
 	})))
 
-	// DELETE /admin/users?id=UUID → delete user
-	mux.Handle("/users/delete", middleware.AdminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userID := r.URL.Query().Get("id")
-		if userID == "" {
-			http.Error(w, "missing user id", http.StatusBadRequest)
+	// GET /admin/users/{id}/files?page=&per_page= → files the user owns, newest first
+	mux.Handle("GET /users/{id}/files", middleware.RequirePermission(rbac.PermUsersRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		page, perPage, err := pageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if err := svc.DeleteUser(userID); err != nil {
-			http.Error(w, "failed to delete user", http.StatusInternalServerError)
+		files, err := svc.ListUserFiles(userID, page, perPage)
+		if err != nil {
+			writeAdminError(w, err, "failed to fetch files")
 			return
 		}
-		w.Write([]byte("user deleted"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(files)
+	})))
+
+	// PUT /admin/users/{id}/quota {"quota": bytes} → change the storage quota
+	mux.Handle("PUT /users/{id}/quota", middleware.RequirePermission(rbac.PermUsersQuota)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		var req SetQuotaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Quota == nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		user, err := svc.SetQuota(userID, *req.Quota)
+		if err != nil {
+			writeAdminError(w, err, "failed to set quota")
+			return
+		}
+		audit(r, middleware.ActionUserQuota, "user", userID.String(), map[string]interface{}{"quota": user.Quota})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+	})))
+
+	// PUT /admin/users/{id}/admin {"is_admin": true|false} → promote to admin / demote to a regular user
+	mux.Handle("PUT /users/{id}/admin", middleware.RequirePermission(rbac.PermUsersRoles)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		var req SetAdminRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.IsAdmin == nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		role := rbac.RoleUser
+		if *req.IsAdmin {
+			role = rbac.RoleAdmin
+		}
+		user, err := svc.SetRole(userID, role)
+		if err != nil {
+			writeAdminError(w, err, "failed to set role")
+			return
+		}
+		audit(r, middleware.ActionUserRole, "user", userID.String(), map[string]interface{}{"role": user.Role})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+	})))
+
+	// POST /admin/users/{id}/suspend, /unsuspend → lock the account out (and end its sessions) or let it back in
+	for action, suspend := range map[string]bool{"suspend": true, "unsuspend": false} {
+		mux.Handle("POST /users/{id}/"+action, middleware.RequirePermission(rbac.PermUsersWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := uuid.Parse(r.PathValue("id"))
+			if err != nil {
+				http.Error(w, "invalid user id", http.StatusBadRequest)
+				return
+			}
+			if userID == middleware.GetUser(r.Context()).ID {
+				http.Error(w, "can't "+action+" yourself", http.StatusConflict)
+				return
+			}
+			user, err := svc.SetSuspended(userID, suspend)
+			if err != nil {
+				writeAdminError(w, err, "failed to "+action+" user")
+				return
+			}
+			auditAction := middleware.ActionUserUnsuspend
+			if suspend {
+				auditAction = middleware.ActionUserSuspend
+			}
+			audit(r, auditAction, "user", userID.String(), nil)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(user)
+		})))
+	}
+
+	// POST /admin/users/{id}/reset-password {"password": optional} → set a new password, a random one when empty.
+	// The user is logged out everywhere; the new password is returned once.
+	mux.Handle("POST /users/{id}/reset-password", middleware.RequirePermission(rbac.PermUsersWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		var req ResetPasswordRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+		password, err := svc.ResetPassword(userID, req.Password)
+		if err != nil {
+			writeAdminError(w, err, "failed to reset password")
+			return
+		}
+		audit(r, middleware.ActionPasswordReset, "user", userID.String(), map[string]interface{}{"generated": req.Password == ""})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"password": password})
+	})))
+
+	// DELETE /admin/users/delete?id=UUID[&transfer_to=UUID] → queue the deletion of a user, 202 with the job.
+	// Their files are released, or handed to transfer_to together with their folders.
+	mux.Handle("DELETE /users/delete", middleware.RequirePermission(rbac.PermUsersDelete)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "missing or invalid user id", http.StatusBadRequest)
+			return
+		}
+		var transferTo *uuid.UUID
+		if v := r.URL.Query().Get("transfer_to"); v != "" {
+			id, err := uuid.Parse(v)
+			if err != nil {
+				http.Error(w, "invalid transfer_to", http.StatusBadRequest)
+				return
+			}
+			transferTo = &id
+		}
+		actor := middleware.GetUser(r.Context())
+		if userID == actor.ID {
+			http.Error(w, "can't delete yourself", http.StatusConflict)
+			return
+		}
+		job, err := deletions.Request(userID, transferTo, &actor.ID)
+		if err != nil {
+			if errors.Is(err, services.ErrInvalidTransfer) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeAdminError(w, err, "failed to delete user")
+			return
+		}
+		audit(r, middleware.ActionUserDelete, "user", userID.String(), map[string]interface{}{"job_id": job.ID, "transfer_to": transferTo})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+	})))
+
+	// GET /admin/deletions → recent user deletion jobs, GET /admin/deletions/{id} → one job's progress
+	mux.Handle("GET /deletions", middleware.RequirePermission(rbac.PermUsersDelete)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jobs, err := deletions.List(100)
+		if err != nil {
+			http.Error(w, "failed to fetch deletions", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobs)
+	})))
+	mux.Handle("GET /deletions/{id}", middleware.RequirePermission(rbac.PermUsersDelete)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jobID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid job id", http.StatusBadRequest)
+			return
+		}
+		job, err := deletions.Get(jobID)
+		if err != nil {
+			if errors.Is(err, services.ErrDeletionNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, "failed to fetch deletion", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
 	})))
 
 	// GET /admin/stats → system storage stats
-	mux.Handle("/stats", middleware.AdminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/stats", middleware.RequirePermission(rbac.PermStatsRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		stats, err := svc.GetSystemStats()
 		if err != nil {
 			http.Error(w, "failed to fetch stats", http.StatusInternalServerError)
@@ -45,5 +288,155 @@ func NewAdminHandler(svc *services.AdminService) http.Handler {
 		json.NewEncoder(w).Encode(stats)
 	})))
 
+	// GET /admin/gc → last garbage collection report, POST /admin/gc → run a pass now
+	mux.Handle("/gc", middleware.RequirePermission(rbac.PermGCRun)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(gc.LastReport())
+		case http.MethodPost:
+			report, err := gc.Run(r.Context())
+			if err != nil {
+				http.Error(w, "garbage collection failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			audit(r, middleware.ActionGCRun, "", "", map[string]interface{}{"objects_deleted": report.ObjectsDeleted, "rows_deleted": report.RowsDeleted})
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(report)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+
+	// POST /admin/keys/rotate → new signing key, the old one keeps verifying for the grace window
+	mux.Handle("/keys/rotate", middleware.RequirePermission(rbac.PermKeysRotate)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		key, err := keys.Rotate()
+		if err != nil {
+			if errors.Is(err, tokens.ErrRotationUnsupported) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			http.Error(w, "key rotation failed", http.StatusInternalServerError)
+			return
+		}
+		audit(r, middleware.ActionKeysRotate, "key", key.ID, map[string]interface{}{"alg": key.Alg})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"kid": key.ID, "alg": key.Alg})
+	})))
+
+	// GET /admin/audit?actor=&action=&target_type=&target_id=&from=&to= → audit entries, newest first.
+	// action may be a prefix ending in "." (admin.); format=csv or format=ndjson exports every match instead of a page.
+	mux.Handle("GET /audit", middleware.RequirePermission(rbac.PermAuditRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter, err := auditFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch format := r.URL.Query().Get("format"); format {
+		case "csv", "ndjson":
+			// exports are themselves worth knowing about
+			audit(r, middleware.ActionAuditExport, "", "", map[string]interface{}{"format": format, "query": r.URL.RawQuery})
+			writeAuditExport(w, audits, filter, format)
+		case "", "json":
+			page, err := audits.List(filter)
+			if err != nil {
+				http.Error(w, "failed to fetch audit log", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(page)
+		default:
+			http.Error(w, "unknown format", http.StatusBadRequest)
+		}
+	})))
+
+	// GET /admin/roles → roles and their permissions
+	mux.Handle("/roles", middleware.RequirePermission(rbac.PermUsersRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rbac.Roles())
+	})))
+
+	// POST /admin/users/role {"user_id": "...", "role": "support"} → assign a role
+	mux.Handle("POST /users/role", middleware.RequirePermission(rbac.PermUsersRoles)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req SetRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		userID, err := uuid.Parse(req.UserID)
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		user, err := svc.SetRole(userID, req.Role)
+		if err != nil {
+			writeAdminError(w, err, "failed to set role")
+			return
+		}
+		audit(r, middleware.ActionUserRole, "user", userID.String(), map[string]interface{}{"role": user.Role})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+	})))
+
 	return mux
 }
+
+type SetRoleRequest struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Role     string `json:"role,omitempty"`  // default user
+	Quota    *int64 `json:"quota,omitempty"` // bytes, default quota when omitted
+}
+
+type SetQuotaRequest struct {
+	Quota *int64 `json:"quota"` // bytes
+}
+
+type SetAdminRequest struct {
+	IsAdmin *bool `json:"is_admin"`
+}
+
+type ResetPasswordRequest struct {
+	Password string `json:"password,omitempty"`
+}
+
+// pageParams reads ?page= and ?per_page=, absent means the service default
+func pageParams(r *http.Request) (int, int, error) {
+	var page, perPage int
+	var err error
+	if v := r.URL.Query().Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return 0, 0, errors.New("invalid page")
+		}
+	}
+	if v := r.URL.Query().Get("per_page"); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage < 1 {
+			return 0, 0, errors.New("invalid per_page")
+		}
+	}
+	return page, perPage, nil
+}
+
+// writeAdminError maps user management errors to a status, anything unexpected is a 500 with msg
+func writeAdminError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, services.ErrInvalidRole), errors.Is(err, services.ErrInvalidQuota), errors.Is(err, services.ErrInvalidRegistration):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, services.ErrUserNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrLastAdmin), errors.Is(err, services.ErrUsernameTaken), errors.Is(err, services.ErrEmailTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, msg, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/services"
+
+	"github.com/google/uuid"
+)
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`               // read | upload | write
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // RFC 3339, omit for no expiry
+}
+
+type CreateAPIKeyResponse struct {
+	Key    string     `json:"key"` // shown once, only its hash is stored
+	APIKey *db.APIKey `json:"api_key"`
+}
+
+// POST /apikeys -> create, GET /apikeys -> list, DELETE /apikeys?id= -> revoke
+func NewAPIKeyHandler(svc *services.APIKeyService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			var req CreateAPIKeyRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+			key, plain, err := svc.CreateAPIKey(user.ID, req.Name, req.Scopes, req.ExpiresAt)
+			if err != nil {
+				if errors.Is(err, services.ErrInvalidAPIKey) {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				http.Error(w, "error creating api key", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(CreateAPIKeyResponse{Key: plain, APIKey: key})
+
+		case http.MethodGet:
+			keys, err := svc.ListAPIKeys(user.ID)
+			if err != nil {
+				http.Error(w, "error listing api keys", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(keys)
+
+		case http.MethodDelete:
+			keyID, err := uuid.Parse(r.URL.Query().Get("id"))
+			if err != nil {
+				http.Error(w, "invalid api key id", http.StatusBadRequest)
+				return
+			}
+			if err := svc.RevokeAPIKey(user.ID, keyID); err != nil {
+				if errors.Is(err, services.ErrAPIKeyNotFound) {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				http.Error(w, "error revoking api key", http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte("api key revoked"))
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
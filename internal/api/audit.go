@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/services"
+
+	"github.com/google/uuid"
+)
+
+// audit records an action on one target for the request, see middleware.RecordAudit
+func audit(r *http.Request, action, targetType, targetID string, details map[string]interface{}) {
+	middleware.RecordAudit(r, db.AuditLog{Action: action, TargetType: targetType, TargetID: targetID}, details)
+}
+
+var auditCSVHeader = []string{"id", "created_at", "actor_id", "action", "target_type", "target_id", "ip", "user_agent", "request_id", "details"}
+
+// auditFilter reads ?actor=&action=&target_type=&target_id=&from=&to=&page=&per_page=, times are RFC 3339
+func auditFilter(r *http.Request) (services.AuditFilter, error) {
+	q := r.URL.Query()
+	f := services.AuditFilter{Action: q.Get("action"), TargetType: q.Get("target_type"), TargetID: q.Get("target_id")}
+	if v := q.Get("actor"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return f, errors.New("invalid actor")
+		}
+		f.ActorID = &id
+	}
+	for name, dst := range map[string]**time.Time{"from": &f.From, "to": &f.To} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, errors.New("invalid " + name)
+			}
+			*dst = &t
+		}
+	}
+	var err error
+	f.Page, f.PerPage, err = pageParams(r)
+	return f, err
+}
+
+// csvCell keeps spreadsheets from running client supplied text as a formula
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// writeAuditExport streams matching entries as CSV or NDJSON (format "csv" or "ndjson").
+// Nothing is written before the query returned its first row, so a failing query is
+// still answered with a 500. Once rows are out the status can't change, a failure
+// is logged and ends the stream.
+func writeAuditExport(w http.ResponseWriter, svc *services.AuditService, f services.AuditFilter, format string) {
+	filename := "audit-" + time.Now().UTC().Format("20060102-150405")
+	var (
+		start func()
+		write func(*db.AuditLog) error
+		flush = func() {}
+	)
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		start = func() {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+			cw.Write(auditCSVHeader)
+		}
+		write = func(e *db.AuditLog) error {
+			actor := ""
+			if e.ActorID != nil {
+				actor = e.ActorID.String()
+			}
+			return cw.Write([]string{
+				e.ID.String(), e.CreatedAt.UTC().Format(time.RFC3339Nano), actor, e.Action,
+				e.TargetType, csvCell(e.TargetID), csvCell(e.IP), csvCell(e.UserAgent), csvCell(e.RequestID), csvCell(e.Details),
+			})
+		}
+		flush = cw.Flush
+	} else {
+		enc := json.NewEncoder(w) // Encode ends every entry with a newline
+		start = func() {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.ndjson"`)
+		}
+		write = func(e *db.AuditLog) error { return enc.Encode(e) }
+	}
+
+	started := false
+	err := svc.Export(f, func(e *db.AuditLog) error {
+		if !started {
+			start()
+			started = true
+		}
+		return write(e)
+	})
+	if err != nil && !started {
+		http.Error(w, "error exporting audit log", http.StatusInternalServerError)
+		return
+	}
+	if !started {
+		start() // no entries, still a valid (empty) export
+	}
+	flush()
+	if err != nil {
+		log.Printf("audit export: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/services"
+)
+
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type LoginRequest struct {
+	Username string `json:"username"` // username or email
+	Password string `json:"password"`
+}
+
+type AuthResponse struct {
+	User *db.User `json:"user,omitempty"` // left out until the second factor is done
+	*services.AuthTokens
+}
+
+// POST /auth/register -> create an account and log it in
+func NewRegisterHandler(auth *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RegisterRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		user, err := auth.Register(services.RegisterInput{Username: req.Username, Email: req.Email, Password: req.Password})
+		switch {
+		case errors.Is(err, services.ErrInvalidRegistration):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, services.ErrUsernameTaken), errors.Is(err, services.ErrEmailTaken):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, "registration failed", http.StatusInternalServerError)
+			return
+		}
+
+		tokens, err := auth.IssueTokens(user)
+		if err != nil {
+			http.Error(w, "registration failed", http.StatusInternalServerError)
+			return
+		}
+		middleware.RecordAudit(r, db.AuditLog{ActorID: &user.ID, Action: middleware.ActionRegister, TargetType: "user", TargetID: user.ID.String()}, nil)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(AuthResponse{User: user, AuthTokens: tokens})
+	}
+}
+
+// POST /auth/login -> access token for username/email + password
+func NewLoginHandler(auth *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req LoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		tokens, user, err := auth.Login(req.Username, req.Password)
+		if err != nil {
+			if errors.Is(err, services.ErrInvalidCredentials) || errors.Is(err, services.ErrAccountSuspended) {
+				middleware.RecordAudit(r, db.AuditLog{Action: middleware.ActionLoginFailed}, map[string]interface{}{"login": req.Username, "reason": err.Error()})
+			}
+			if errors.Is(err, services.ErrInvalidCredentials) {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if errors.Is(err, services.ErrAccountSuspended) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			http.Error(w, "login failed", http.StatusInternalServerError)
+			return
+		}
+		middleware.RecordAudit(r, db.AuditLog{ActorID: &user.ID, Action: middleware.ActionLogin, TargetType: "user", TargetID: user.ID.String()},
+			map[string]interface{}{"mfa_required": tokens.MFARequired})
+		if tokens.MFARequired {
+			user = nil
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthResponse{User: user, AuthTokens: tokens})
+	}
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// POST /auth/refresh -> rotate the refresh token and get a new access token
+func NewRefreshHandler(auth *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		tokens, err := auth.Refresh(req.RefreshToken)
+		if err != nil {
+			if errors.Is(err, services.ErrInvalidRefreshToken) || errors.Is(err, services.ErrRefreshTokenReused) {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, "refresh failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+	}
+}
+
+// POST /auth/logout -> revoke the current session
+// POST /auth/logout-all -> revoke every session of the user
+func NewLogoutHandler(auth *services.AuthService, all bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var err error
+		action := middleware.ActionLogout
+		if all {
+			_, err = auth.LogoutAll(user.ID)
+			action = middleware.ActionLogoutAll
+		} else {
+			err = auth.Logout(user.ID, middleware.GetSessionID(r.Context()))
+		}
+		if err != nil {
+			http.Error(w, "logout failed", http.StatusInternalServerError)
+			return
+		}
+		audit(r, action, "user", user.ID.String(), nil)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// GET /files/{id}/content -> stream file content (supports Range and conditional requests)
+func NewDownloadHandler(fs *services.FileService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		fileID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "invalid file ID", http.StatusBadRequest)
+			return
+		}
+
+		grant, err := fs.AuthorizeDownload(user, fileID)
+		if err != nil {
+			if errors.Is(err, services.ErrNoFileAccess) {
+				http.Error(w, "file not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "error loading file", http.StatusInternalServerError)
+			return
+		}
+
+		// a share's download limit is taken before serving, atomically, so
+		// parallel requests can't get past it. Own files are only counted.
+		if grant.Share != nil && r.Method == http.MethodGet && r.Header.Get("If-None-Match") != `"`+grant.File.Hash+`"` {
+			if err := fs.RecordDownload(grant); err != nil {
+				writeShareError(w, err)
+				return
+			}
+		}
+		if grant.UserFile != nil && grant.UserFile.FileName != "" {
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": grant.UserFile.FileName}))
+		}
+		status := serveFileContent(w, r, fs, &grant.File)
+		if grant.UserFile != nil && r.Method == http.MethodGet && (status == http.StatusOK || status == http.StatusPartialContent) {
+			if err := fs.RecordDownload(grant); err != nil {
+				log.Printf("count download of file %s: %v", fileID, err)
+			}
+		}
+	}
+}
+
+// serveFileContent writes the file with ETag/Last-Modified headers and lets
+// http.ServeContent deal with Range, If-None-Match and If-Modified-Since.
+// Returns the status code that was sent.
+func serveFileContent(w http.ResponseWriter, r *http.Request, fs *services.FileService, file *db.File) int {
+	// content is addressed by its hash so it never changes under the same ETag
+	w.Header().Set("ETag", `"`+file.Hash+`"`)
+	w.Header().Set("Content-Type", file.MimeType)
+	if file.MimeType == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	content := &rangeReadSeeker{
+		size: file.Size,
+		open: func(offset int64) (io.ReadCloser, error) {
+			return fs.OpenRange(r.Context(), file, offset, -1)
+		},
+	}
+	defer content.Close()
+
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	http.ServeContent(sw, r, "", file.CreatedAt, content)
+	return sw.status
+}
+
+// rangeReadSeeker adapts a storage range reader to io.ReadSeeker.
+// Seeking only moves the offset, the object is (re)opened lazily on the next Read.
+type rangeReadSeeker struct {
+	open func(offset int64) (io.ReadCloser, error)
+	size int64
+	pos  int64
+	rc   io.ReadCloser
+}
+
+func (s *rangeReadSeeker) Read(p []byte) (int, error) {
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+	if s.rc == nil {
+		rc, err := s.open(s.pos)
+		if err != nil {
+			return 0, err
+		}
+		s.rc = rc
+	}
+	n, err := s.rc.Read(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *rangeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = s.pos + offset
+	case io.SeekEnd:
+		pos = s.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	if pos != s.pos {
+		s.Close()
+		s.pos = pos
+	}
+	return pos, nil
+}
+
+func (s *rangeReadSeeker) Close() error {
+	if s.rc == nil {
+		return nil
+	}
+	err := s.rc.Close()
+	s.rc = nil
+	return err
+}
+
+// statusWriter remembers the status code written by the wrapped handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
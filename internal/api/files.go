@@ -2,28 +2,27 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	// "balkanid-capstone/backend/internal/db"
+	"backend/internal/middleware"
 	"backend/internal/services"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 )
 
 // List user files
-// GET `/files`
+// GET `/files` (?include_shared=true adds files other users shared with the caller)
 func ListUserFiles(w http.ResponseWriter, r *http.Request) {
-	userIDstr := r.Header.Get("X-user-Id")
-	if userIDstr == "" {
-		http.Error(w, "Missing user ", http.StatusUnauthorized)
+	user := middleware.GetUser(r.Context())
+	if user == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
-	userID, err := uuid.Parse(userIDstr)
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
-	}
-	files, err := services.ListUserFiles(userID)
+	includeShared := r.URL.Query().Get("include_shared") == "true"
+	files, err := services.ListUserFiles(user.ID, includeShared)
 	if err != nil {
 		http.Error(w, "Error fetching files", http.StatusInternalServerError)
 		return
@@ -34,35 +33,120 @@ func ListUserFiles(w http.ResponseWriter, r *http.Request) {
 }
 
 // DELETE /files/:id -> delete a file reference
-func DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
-	userIDstr := r.Header.Get("X-user-Id")
-	if userIDstr == "" {
-		http.Error(w, "Missing user: ", http.StatusUnauthorized)
-		return
-	}
-	userID, err := uuid.Parse(userIDstr)
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
-	}
+func NewDeleteFileHandler(fs *services.FileService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
 
-	// using query params for now later will be using mux/path params
-	fileIDstr := r.URL.Query().Get("id")
-	if fileIDstr == "" {
-		http.Error(w, "Missing file ID", http.StatusBadRequest)
-		return
-	}
-	fileID, err := uuid.Parse(fileIDstr)
-	if err != nil {
-		http.Error(w, "Invalid file ID", http.StatusBadRequest)
-		return
+		// using query params for now later will be using mux/path params
+		fileIDstr := r.URL.Query().Get("id")
+		if fileIDstr == "" {
+			http.Error(w, "Missing file ID", http.StatusBadRequest)
+			return
+		}
+		fileID, err := uuid.Parse(fileIDstr)
+		if err != nil {
+			http.Error(w, "Invalid file ID", http.StatusBadRequest)
+			return
+		}
+		err = fs.DeleteUserFile(r.Context(), user.ID, fileID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		audit(r, middleware.ActionFileDelete, "file", fileID.String(), nil)
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("File deleted successufully"))
 	}
-	err = services.DeleteUserFile(userID, fileID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusForbidden)
-		return
+}
+
+type UpdateFileRequest struct {
+	FileName    *string `json:"file_name,omitempty"`
+	Description *string `json:"description,omitempty"`
+}
+
+// PATCH /files/{id} -> rename a file / change its description
+func NewUpdateFileHandler(fs *services.FileService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		fileID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "invalid file ID", http.StatusBadRequest)
+			return
+		}
+
+		var req UpdateFileRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		uf, err := fs.UpdateUserFile(user.ID, fileID, req.FileName, req.Description)
+		switch {
+		case errors.Is(err, services.ErrNoFileAccess):
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		case errors.Is(err, services.ErrInvalidFileName):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, "error updating file", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(uf)
 	}
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("File deleted successufully"))
+type MoveFileRequest struct {
+	FolderID *uuid.UUID `json:"folder_id"` // null = root
+}
+
+// POST /files/{id}/move -> put a file into another folder
+func NewMoveFileHandler(fs *services.FileService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		fileID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "invalid file ID", http.StatusBadRequest)
+			return
+		}
+
+		var req MoveFileRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		uf, err := fs.MoveUserFile(user.ID, fileID, req.FolderID)
+		switch {
+		case errors.Is(err, services.ErrNoFileAccess):
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		case errors.Is(err, services.ErrFolderNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, "error moving file", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(uf)
+	}
 }
@@ -2,12 +2,14 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"backend/internal/middleware"
 	"backend/internal/services"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 )
 
 func NewFolderHandler(svc *services.FolderService) http.HandlerFunc {
@@ -30,25 +32,24 @@ func NewFolderHandler(svc *services.FolderService) http.HandlerFunc {
 			}
 			f, err := svc.CreateFolder(user.ID, req.Name, req.ParentID)
 			if err != nil {
-				http.Error(w, "failed to create folder", http.StatusInternalServerError)
+				writeFolderError(w, err, "failed to create folder")
 				return
 			}
+			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(f)
 
 		case http.MethodGet: // List
-			parentStr := r.URL.Query().Get("parent_id")
-			var parentID *uuid.UUID
-			if parentStr != "" {
-				pid, err := uuid.Parse(parentStr)
-				if err == nil {
-					parentID = &pid
-				}
+			parentID, err := optionalUUID(r.URL.Query().Get("parent_id"))
+			if err != nil {
+				http.Error(w, "invalid parent id", http.StatusBadRequest)
+				return
 			}
 			folders, err := svc.ListUserFolders(user.ID, parentID)
 			if err != nil {
 				http.Error(w, "failed to list folders", http.StatusInternalServerError)
 				return
 			}
+			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(folders)
 
 		case http.MethodDelete: // Delete
@@ -57,11 +58,16 @@ func NewFolderHandler(svc *services.FolderService) http.HandlerFunc {
 				http.Error(w, "missing folder id", http.StatusBadRequest)
 				return
 			}
-			folderID, _ := uuid.Parse(folderIDStr)
-			if err := svc.DeleteFolder(user.ID, folderID); err != nil {
-				http.Error(w, "failed to delete folder", http.StatusForbidden)
+			folderID, err := uuid.Parse(folderIDStr)
+			if err != nil {
+				http.Error(w, "invalid folder id", http.StatusBadRequest)
+				return
+			}
+			if err := svc.DeleteFolder(r.Context(), user.ID, folderID); err != nil {
+				writeFolderError(w, err, "failed to delete folder")
 				return
 			}
+			audit(r, middleware.ActionFolderDelete, "folder", folderID.String(), nil)
 			w.Write([]byte("folder deleted"))
 
 		default:
@@ -69,3 +75,119 @@ func NewFolderHandler(svc *services.FolderService) http.HandlerFunc {
 		}
 	}
 }
+
+// GET /folders/contents?id= -> subfolders and files of a folder (no id = root)
+func NewFolderContentsHandler(svc *services.FolderService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		folderID, err := optionalUUID(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "invalid folder id", http.StatusBadRequest)
+			return
+		}
+		contents, err := svc.ListContents(user.ID, folderID)
+		if err != nil {
+			writeFolderError(w, err, "failed to list folder")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(contents)
+	}
+}
+
+type MoveFolderRequest struct {
+	ParentID *uuid.UUID `json:"parent_id"` // null = root
+}
+
+// POST /folders/{id}/move -> re-parent a folder
+func NewMoveFolderHandler(svc *services.FolderService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		folderID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "invalid folder id", http.StatusBadRequest)
+			return
+		}
+		var req MoveFolderRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		folder, err := svc.MoveFolder(user.ID, folderID, req.ParentID)
+		if err != nil {
+			writeFolderError(w, err, "failed to move folder")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(folder)
+	}
+}
+
+// GET /folders/tree -> every folder and file of the user, nested, with aggregated sizes
+func NewFolderTreeHandler(svc *services.FolderService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		tree, err := svc.GetTree(user.ID)
+		if err != nil {
+			http.Error(w, "failed to load folder tree", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tree)
+	}
+}
+
+// GET /folders/resolve?path=/docs/2026/report.pdf -> folder or file ID
+func NewResolvePathHandler(svc *services.FolderService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		entry, err := svc.ResolvePath(user.ID, r.URL.Query().Get("path"))
+		if err != nil {
+			writeFolderError(w, err, "failed to resolve path")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entry)
+	}
+}
+
+// optionalUUID parses s, an empty string gives nil
+func optionalUUID(s string) (*uuid.UUID, error) {
+	if s == "" {
+		return nil, nil
+	}
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+func writeFolderError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, services.ErrFolderNotFound), errors.Is(err, services.ErrPathNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrFolderCycle):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, services.ErrInvalidFolderName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
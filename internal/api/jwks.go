@@ -0,0 +1,18 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"backend/internal/tokens"
+)
+
+// GET /.well-known/jwks.json -> public signing keys, so other services can verify our tokens
+func NewJWKSHandler(keys *tokens.KeySet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// short cache: verifiers must see a new key soon after rotation
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(keys.JWKS())
+	}
+}
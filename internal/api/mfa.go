@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/services"
+)
+
+type MFACodeRequest struct {
+	Code string `json:"code"` // TOTP code, or a recovery code where accepted
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// POST /auth/mfa/enroll -> new TOTP secret and otpauth URI
+// POST /auth/mfa/activate -> confirm with a code, returns recovery codes
+// POST /auth/mfa/disable -> remove the second factor
+// POST /auth/mfa/recovery-codes -> replace the recovery codes
+func NewMFAHandler(svc *services.MFAService) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/enroll", mfaUser(func(w http.ResponseWriter, r *http.Request, req MFACodeRequest) {
+		enrollment, err := svc.Enroll(middleware.GetUser(r.Context()))
+		if err != nil {
+			writeMFAError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(enrollment)
+	}))
+
+	mux.HandleFunc("/activate", mfaUser(func(w http.ResponseWriter, r *http.Request, req MFACodeRequest) {
+		codes, err := svc.Activate(middleware.GetUser(r.Context()), middleware.GetSessionID(r.Context()), req.Code)
+		if err != nil {
+			writeMFAError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+	}))
+
+	mux.HandleFunc("/disable", mfaUser(func(w http.ResponseWriter, r *http.Request, req MFACodeRequest) {
+		if err := svc.Disable(middleware.GetUser(r.Context()), req.Code); err != nil {
+			writeMFAError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("/recovery-codes", mfaUser(func(w http.ResponseWriter, r *http.Request, req MFACodeRequest) {
+		codes, err := svc.RegenerateRecoveryCodes(middleware.GetUser(r.Context()), req.Code)
+		if err != nil {
+			writeMFAError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+	}))
+
+	return mux
+}
+
+// mfaUser checks method and user and decodes the (optional) code body
+func mfaUser(h func(w http.ResponseWriter, r *http.Request, req MFACodeRequest)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if middleware.GetUser(r.Context()) == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req MFACodeRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+		h(w, r, req)
+	}
+}
+
+// POST /auth/mfa/login -> second step of login, trades the mfa_token and a code for tokens
+func NewMFALoginHandler(svc *services.MFAService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req MFALoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		tokens, user, err := svc.CompleteLogin(req.MFAToken, req.Code)
+		if err != nil {
+			if errors.Is(err, services.ErrMFAInvalidCode) || errors.Is(err, services.ErrAccountSuspended) {
+				middleware.RecordAudit(r, db.AuditLog{Action: middleware.ActionLoginFailed}, map[string]interface{}{"reason": err.Error()})
+			}
+			writeMFAError(w, err)
+			return
+		}
+		middleware.RecordAudit(r, db.AuditLog{ActorID: &user.ID, Action: middleware.ActionLoginMFA, TargetType: "user", TargetID: user.ID.String()}, nil)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthResponse{User: user, AuthTokens: tokens})
+	}
+}
+
+func writeMFAError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrMFAInvalidCode), errors.Is(err, services.ErrMFAChallenge):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, services.ErrMFAAdminRequired), errors.Is(err, services.ErrAccountSuspended):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, services.ErrMFAAlreadyEnabled), errors.Is(err, services.ErrMFANotEnrolled), errors.Is(err, services.ErrMFANotEnabled):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "two-factor request failed", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/oidc"
+	"backend/internal/services"
+)
+
+// oidcStateCookie holds the signed login state between redirect and callback
+const oidcStateCookie = "oidc_state"
+
+// GET /auth/oidc/login -> redirect to the identity provider
+func NewOIDCLoginHandler(svc *services.OIDCService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		redirectURL, state, err := svc.BeginLogin(r.Context())
+		if err != nil {
+			http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    state,
+			Path:     "/auth/oidc",
+			MaxAge:   int((10 * time.Minute).Seconds()),
+			HttpOnly: true,
+			Secure:   isHTTPS(r),
+			SameSite: http.SameSiteLaxMode, // sent on the provider's top level redirect back to us
+		})
+		http.Redirect(w, r, redirectURL, http.StatusFound)
+	}
+}
+
+// GET /auth/oidc/callback?code=&state= -> log in and return this server's tokens
+func NewOIDCCallbackHandler(svc *services.OIDCService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if errCode := q.Get("error"); errCode != "" {
+			http.Error(w, "login failed at identity provider: "+errCode, http.StatusUnauthorized)
+			return
+		}
+		cookie, err := r.Cookie(oidcStateCookie)
+		if err != nil {
+			http.Error(w, services.ErrOIDCState.Error(), http.StatusBadRequest)
+			return
+		}
+		// single use
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/oidc", MaxAge: -1, HttpOnly: true, Secure: isHTTPS(r)})
+
+		tokens, user, err := svc.CompleteLogin(r.Context(), q.Get("code"), q.Get("state"), cookie.Value)
+		switch {
+		case errors.Is(err, services.ErrAccountSuspended):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, services.ErrOIDCState):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, services.ErrOIDCEmailRequired), errors.Is(err, oidc.ErrExchange), errors.Is(err, oidc.ErrInvalidToken):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case errors.Is(err, oidc.ErrDiscovery):
+			http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+			return
+		case err != nil:
+			http.Error(w, "login failed", http.StatusInternalServerError)
+			return
+		}
+		middleware.RecordAudit(r, db.AuditLog{ActorID: &user.ID, Action: middleware.ActionLoginOIDC, TargetType: "user", TargetID: user.ID.String()},
+			map[string]interface{}{"mfa_required": tokens.MFARequired})
+		if tokens.MFARequired {
+			user = nil
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthResponse{User: user, AuthTokens: tokens})
+	}
+}
+
+// isHTTPS also trusts the proxy header, TLS usually ends in front of us
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
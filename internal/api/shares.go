@@ -2,77 +2,213 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"mime"
 	"net/http"
+	"time"
 
 	"backend/internal/middleware"
 	"backend/internal/services"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 )
 
 type CreateShareRequest struct {
-	FileID     string  `json:"file_id"`
-	IsPublic   bool    `json:"is_public"`
-	SharedWith *string `json:"shared_with,omitempty"`
+	FileID       string     `json:"file_id"`
+	IsPublic     bool       `json:"is_public"`
+	SharedWith   *string    `json:"shared_with,omitempty"`   // username or email of the recipient
+	Role         string     `json:"role,omitempty"`          // viewer (default) | downloader | editor
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`    // RFC 3339
+	Password     string     `json:"password,omitempty"`      // optional, required to open the share
+	MaxDownloads *int       `json:"max_downloads,omitempty"` // optional download limit
 }
 
-// post/shares
+// SharePasswordHeader carries the password of a protected share
+const SharePasswordHeader = "X-Share-Password"
+
+// POST /shares -> create
+// GET /shares -> my shares, GET /shares?id= -> one of them
+// DELETE /shares?id= -> revoke
 func NewShareHandler(svc *services.ShareService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := middleware.GetUser(r.Context())
 
 		if user == nil {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
 		}
 
-		var req CreateShareRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "invalid request", http.StatusBadRequest)
-			return
+		switch r.Method {
+		case http.MethodPost:
+			var req CreateShareRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+
+			fileID, err := uuid.Parse(req.FileID)
+			if err != nil {
+				http.Error(w, "invalid file ID", http.StatusBadRequest)
+				return
+			}
+
+			opts := services.ShareOptions{Role: req.Role, ExpiresAt: req.ExpiresAt, Password: req.Password, MaxDownloads: req.MaxDownloads}
+			share, err := svc.CreateShare(user.ID, fileID, req.IsPublic, req.SharedWith, opts)
+			if err != nil {
+				if errors.Is(err, services.ErrInvalidShareOptions) {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if errors.Is(err, services.ErrShareTargetNotFound) {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			audit(r, middleware.ActionShareCreate, "share", share.ID.String(), map[string]interface{}{
+				"file_id": fileID, "public": req.IsPublic, "shared_with": share.SharedWithID, "role": share.Role,
+			})
+
+			// answer with the same shape GET /shares lists
+			out, err := svc.GetOwnShare(user.ID, share.ID)
+			if err != nil {
+				writeShareError(w, err)
+				return
+			}
+			w.Header().Set("Content-type", "application/json")
+			json.NewEncoder(w).Encode(out)
+
+		case http.MethodGet:
+			if idStr := r.URL.Query().Get("id"); idStr != "" {
+				shareID, err := uuid.Parse(idStr)
+				if err != nil {
+					http.Error(w, "invalid share id", http.StatusBadRequest)
+					return
+				}
+				share, err := svc.GetOwnShare(user.ID, shareID)
+				if err != nil {
+					writeShareError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(share)
+				return
+			}
+
+			shares, err := svc.ListShares(user.ID)
+			if err != nil {
+				http.Error(w, "error listing shares", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(shares)
+
+		case http.MethodDelete:
+			shareID, err := uuid.Parse(r.URL.Query().Get("id"))
+			if err != nil {
+				http.Error(w, "invalid share id", http.StatusBadRequest)
+				return
+			}
+			if err := svc.RevokeShare(user.ID, shareID); err != nil {
+				writeShareError(w, err)
+				return
+			}
+			audit(r, middleware.ActionShareRevoke, "share", shareID.String(), nil)
+			w.Write([]byte("share revoked"))
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
+	}
+}
 
-		fileID, err := uuid.Parse(req.FileID)
-		if err != nil {
-			http.Error(w, "invalid file ID", http.StatusBadRequest)
+// GET /shares/incoming -> files other users shared with me
+func NewIncomingSharesHandler(svc *services.ShareService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
-
-		share, err := svc.CreateShare(user.ID, fileID, req.IsPublic, req.SharedWith)
+		shares, err := svc.ListIncoming(user.ID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusForbidden)
+			http.Error(w, "error listing shares", http.StatusInternalServerError)
 			return
 		}
-
-		w.Header().Set("Content-type", "application/json")
-		json.NewEncoder(w).Encode(share)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shares)
 	}
 }
 
-// Get shares/{id}
-func NewGetShareHandler(svc *services.ShareService) http.HandlerFunc {
+// GET /s/{token} -> public share link, streams the shared file without authentication.
+// Password protected shares expect the password in the X-Share-Password header.
+func NewGetShareHandler(svc *services.ShareService, fs *services.FileService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		shareIDstr := r.URL.Query().Get("id")
-		if shareIDstr == "" {
-			http.Error(w, "missing share id", http.StatusBadRequest)
+		token := mux.Vars(r)["token"]
+		if token == "" {
+			http.Error(w, "missing share token", http.StatusBadRequest)
 			return
 		}
-		shareID, err := uuid.Parse(shareIDstr)
+		share, err := svc.GetShareByToken(token)
 		if err != nil {
-			http.Error(w, "invalid shrer id ", http.StatusBadRequest)
+			writeShareError(w, err)
 			return
 		}
-		share, err := svc.GetShare(shareID)
-		if err != nil {
-			http.Error(w, "share not found", http.StatusNotFound)
+		// only public shares work as anonymous links
+		if !share.IsPublic {
+			writeShareError(w, services.ErrShareNotFound)
+			return
+		}
+		if err := svc.CheckShare(share, r.Header.Get(SharePasswordHeader)); err != nil {
+			writeShareError(w, err)
 			return
 		}
 
-		// Increment download counter for files
-		if share.IsPublic {
-			_ = svc.IncrementDownloads(share.ID)
+		// every GET that serves content uses up a download, ranged ones included,
+		// otherwise "Range: bytes=1-" would get around the limit. Only cache
+		// revalidations are free.
+		etag := `"` + share.File.Hash + `"`
+		if r.Method == http.MethodGet && r.Header.Get("If-None-Match") != etag {
+			if err := svc.ConsumeDownload(share.ID); err != nil {
+				writeShareError(w, err)
+				return
+			}
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(share)
+		if name := svc.SharedFileName(share); name != "" {
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		}
+		status := serveFileContent(w, r, fs, &share.File)
+		if r.Method == http.MethodGet && (status == http.StatusOK || status == http.StatusPartialContent) {
+			audit(r, middleware.ActionShareAccess, "share", share.ID.String(), map[string]interface{}{"file_id": share.FileID})
+		}
+	}
+}
+
+// writeShareError answers with a JSON body holding a stable error code per share state
+func writeShareError(w http.ResponseWriter, err error) {
+	status, code := http.StatusInternalServerError, "internal_error"
+	switch {
+	case errors.Is(err, services.ErrShareNotFound):
+		status, code = http.StatusNotFound, "share_not_found"
+	case errors.Is(err, services.ErrShareRevoked):
+		status, code = http.StatusGone, "share_revoked"
+	case errors.Is(err, services.ErrShareExpired):
+		status, code = http.StatusGone, "share_expired"
+	case errors.Is(err, services.ErrShareExhausted):
+		status, code = http.StatusGone, "share_exhausted"
+	case errors.Is(err, services.ErrSharePasswordRequired):
+		status, code = http.StatusUnauthorized, "share_password_required"
+	case errors.Is(err, services.ErrShareBadPassword):
+		status, code = http.StatusForbidden, "share_password_invalid"
+	}
+	msg := err.Error()
+	if status == http.StatusInternalServerError {
+		msg = "error loading share"
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"code": code, "error": msg})
 }
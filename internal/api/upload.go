@@ -1,15 +1,11 @@
 package api
 
 import (
-	// "context"
-	"crypto/sha256"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"net/http"
-	"os"
-
-	// "os/user"
+	"strings"
 
 	"backend/internal/middleware"
 	"backend/internal/services"
@@ -24,7 +20,12 @@ type UploadResult struct {
 	Error    string `json:"error,omitempty"`
 }
 
-// New Upload Handler return an handler function bound to the file service
+// New Upload Handler return an handler function bound to the file service.
+// Parts are streamed to storage as they arrive, so nothing is buffered to disk
+// and memory use doesn't grow with the upload. folder_id (query parameter or a
+// form field sent before the files) applies to every file that follows. A
+// sha256 form field declares the hash of the next file only: if the bytes hash
+// differently that file is rejected and nothing is stored for it.
 func NewUploadHandler(fs *services.FileService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -33,98 +34,139 @@ func NewUploadHandler(fs *services.FileService) http.HandlerFunc {
 		user := middleware.GetUser(ctx)
 		if user == nil {
 			http.Error(w, "user not found in context(not authenticated)", http.StatusUnauthorized)
+			return
 		}
 		userID := user.ID
 
-		//safety cap for transport layer where parsing happens
-		if err := r.ParseMultipartForm(100 << 20); err != nil { // parsing limit 100MB
+		mr, err := r.MultipartReader()
+		if err != nil {
 			http.Error(w, "no files uploaded or parse error", http.StatusBadRequest)
 			return
 		}
 
-		files := r.MultipartForm.File["myFile"]
-		if len(files) == 0 {
-			http.Error(w, "no files uploaded ", http.StatusBadRequest)
+		// optional target folder for every file in this request
+		folderID, err := optionalUUID(r.URL.Query().Get("folder_id"))
+		if err != nil {
+			http.Error(w, "invalid folder id", http.StatusBadRequest)
 			return
 		}
 
-		results := make([]UploadResult, 0, len(files))
+		results := make([]UploadResult, 0, 1)
+		declaredHash := ""
 
-		for _, fh := range files {
-			//Open part
-			part, err := fh.Open()
-			if err != nil {
-				results = append(results, UploadResult{FileName: fh.Filename, Error: "open error: " + err.Error()})
-				continue
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
 			}
-
-			// create temp file
-			tmp, err := os.CreateTemp("", "upload-*.")
 			if err != nil {
-				part.Close()
-				results = append(results, UploadResult{FileName: fh.Filename, Error: "temp file error:" + err.Error()})
-				continue
+				if len(results) == 0 {
+					http.Error(w, "no files uploaded or parse error", http.StatusBadRequest)
+					return
+				}
+				// the body broke off, report what made it
+				results = append(results, UploadResult{Error: "multipart read error: " + err.Error()})
+				break
 			}
-			tmpPath := tmp.Name()
-
-			// Reading of the first 512 bytes to detect mime type and write them to temp + hash
-			header := make([]byte, 512)
-			n, _ := part.Read(header)
-			mimeType := http.DetectContentType(header[:n])
 
-			//Writer header bytes to temp and start hashing
-			hasher := sha256.New()
-			if n > 0 {
-				if _, err := tmp.Write(header[:n]); err != nil {
+			switch {
+			case part.FormName() == "folder_id" && part.FileName() == "":
+				value, _ := io.ReadAll(io.LimitReader(part, 64))
+				if folderID, err = optionalUUID(strings.TrimSpace(string(value))); err != nil {
 					part.Close()
-					tmp.Close()
-					os.Remove(tmpPath)
-					results = append(results, UploadResult{FileName: fh.Filename, Error: "writing in temp error:" + err.Error()})
-					continue
+					http.Error(w, "invalid folder id", http.StatusBadRequest)
+					return
 				}
 
-				if _, err := hasher.Write(header[:n]); err != nil {
-					part.Close()
-					tmp.Close()
-					os.Remove(tmpPath)
-					results = append(results, UploadResult{FileName: fh.Filename, Error: "hashing error:" + err.Error()})
-					continue
+			case part.FormName() == "sha256" && part.FileName() == "":
+				value, _ := io.ReadAll(io.LimitReader(part, 128))
+				declaredHash = strings.TrimSpace(string(value))
+
+			case part.FormName() == "myFile" && part.FileName() != "":
+				// every mime type is allowed
+				stored, err := fs.ProcessStream(ctx, userID, part.FileName(), folderID, part, declaredHash)
+				declaredHash = ""
+				if err != nil {
+					results = append(results, UploadResult{FileName: part.FileName(), Error: "file service error:" + err.Error()})
+				} else {
+					audit(r, middleware.ActionFileUpload, "file", stored.FileID, map[string]interface{}{"name": part.FileName(), "size": stored.Size, "sha256": stored.Hash})
+					results = append(results, UploadResult{FileID: stored.FileID, FileName: part.FileName(), Size: stored.Size, Hash: stored.Hash})
 				}
 			}
+			part.Close()
+		}
 
-			// Copy remainder of the file to temp while hashing
-			written, err := io.Copy(io.MultiWriter(tmp, hasher), part)
-			if err != nil {
-				part.Close()
-				tmp.Close()
-				os.Remove(tmpPath)
-				results = append(results, UploadResult{FileName: fh.Filename, Error: "Remaining file copy error:" + err.Error()})
-				continue
-			}
+		if len(results) == 0 {
+			http.Error(w, "no files uploaded ", http.StatusBadRequest)
+			return
+		}
 
-			totalSize := int64(n) + written
-			sha := fmt.Sprintf("%x", hasher.Sum(nil))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	}
+}
 
-			// Close reader writter before passing to service
-			part.Close()
-			tmp.Close()
+type UploadCheckRequest struct {
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+	FileName string `json:"file_name"`
+	FolderID string `json:"folder_id,omitempty"`
+}
 
-			// every mime type is allowed
+type UploadCheckResponse struct {
+	UploadResult
+	// UploadRequired is set when the user holds no such content yet: send it to
+	// POST /upload with the same sha256 as a form field before the file
+	UploadRequired bool `json:"upload_required"`
+}
 
-			//Call file service to process the upload
-			fileID, err := fs.ProcessUpload(ctx, userID, fh.Filename, tmpPath, totalSize, mimeType, sha)
+// POST /upload/check {"sha256", "size", "file_name", "folder_id"}
+// -> when the user already holds that content, a new entry for it is linked
+// without sending the bytes; otherwise upload_required. Content other users
+// stored is never linked from a hash alone.
+func NewUploadCheckHandler(fs *services.FileService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
 
-			// remove temp file regardless of success or failure
-			os.Remove(tmpPath)
+		var req UploadCheckRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.FileName == "" || req.Size < 0 {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		folderID, err := optionalUUID(req.FolderID)
+		if err != nil {
+			http.Error(w, "invalid folder id", http.StatusBadRequest)
+			return
+		}
 
-			if err != nil {
-				results = append(results, UploadResult{FileName: fh.Filename, Size: totalSize, Hash: sha, Error: "file service error:" + err.Error()})
-				continue
-			}
-			results = append(results, UploadResult{FileID: fileID, FileName: fh.Filename, Size: totalSize, Hash: sha})
+		resp := UploadCheckResponse{UploadResult: UploadResult{FileName: req.FileName, Size: req.Size, Hash: req.SHA256}}
+		uf, err := fs.LinkByHash(user.ID, req.FileName, folderID, req.SHA256, req.Size)
+		switch {
+		case err == nil:
+			resp.FileID = uf.FileID.String()
+			resp.FileName = uf.FileName
+			audit(r, middleware.ActionFileUpload, "file", resp.FileID, map[string]interface{}{"name": uf.FileName, "size": req.Size, "sha256": req.SHA256, "dedup_check": true})
+		case errors.Is(err, services.ErrContentNotStored):
+			resp.UploadRequired = true
+		case errors.Is(err, services.ErrInvalidHash):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, services.ErrFolderNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, services.ErrQuotaExceeded):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		default:
+			http.Error(w, "check failed", http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(results)
+		json.NewEncoder(w).Encode(resp)
 	}
 }
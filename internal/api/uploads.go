@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backend/internal/middleware"
+	"backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Headers of the resumable upload protocol, named like tus
+const (
+	UploadOffsetHeader  = "Upload-Offset"
+	UploadLengthHeader  = "Upload-Length"
+	UploadExpiresHeader = "Upload-Expires"
+	// ChunkContentType is the only content type PATCH accepts
+	ChunkContentType = "application/offset+octet-stream"
+)
+
+type CreateUploadRequest struct {
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`                // total length in bytes
+	FolderID string `json:"folder_id,omitempty"` // optional target folder
+}
+
+// POST /uploads {"file_name", "size", "folder_id"} -> 201, Location: /uploads/{id}
+func NewCreateUploadHandler(svc *services.UploadService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req CreateUploadRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.FileName == "" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		folderID, err := optionalUUID(req.FolderID)
+		if err != nil {
+			http.Error(w, "invalid folder id", http.StatusBadRequest)
+			return
+		}
+
+		up, err := svc.CreateUpload(user, req.FileName, folderID, req.Size)
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		setUploadHeaders(w, up.Offset, up.Size, up.ExpiresAt)
+		w.Header().Set("Location", "/uploads/"+up.ID.String())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(up)
+	}
+}
+
+// HEAD /uploads/{id} -> current offset in Upload-Offset
+// PATCH /uploads/{id} with Upload-Offset and the next bytes -> 204 with the new offset
+// DELETE /uploads/{id} -> abort
+func NewUploadChunkHandler(svc *services.UploadService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		uploadID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "invalid upload ID", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodHead:
+			up, err := svc.GetUpload(user.ID, uploadID)
+			if err != nil {
+				writeUploadError(w, err)
+				return
+			}
+			setUploadHeaders(w, up.Offset, up.Size, up.ExpiresAt)
+			w.WriteHeader(http.StatusOK)
+
+		case http.MethodPatch:
+			if r.Header.Get("Content-Type") != ChunkContentType {
+				http.Error(w, "content type must be "+ChunkContentType, http.StatusUnsupportedMediaType)
+				return
+			}
+			offset, err := strconv.ParseInt(r.Header.Get(UploadOffsetHeader), 10, 64)
+			if err != nil || offset < 0 {
+				http.Error(w, "missing or invalid "+UploadOffsetHeader+" header", http.StatusBadRequest)
+				return
+			}
+			next, err := svc.WriteChunk(r.Context(), user.ID, uploadID, offset, r.Body)
+			if err != nil {
+				if errors.Is(err, services.ErrUploadOffset) {
+					// tell the client where to resume
+					w.Header().Set(UploadOffsetHeader, strconv.FormatInt(next, 10))
+				}
+				writeUploadError(w, err)
+				return
+			}
+			w.Header().Set(UploadOffsetHeader, strconv.FormatInt(next, 10))
+			w.WriteHeader(http.StatusNoContent)
+
+		case http.MethodDelete:
+			if err := svc.Abort(r.Context(), user.ID, uploadID); err != nil {
+				writeUploadError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// POST /uploads/{id}/finalize -> the stored file, once every byte was received
+func NewFinalizeUploadHandler(svc *services.UploadService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUser(r.Context())
+		if user == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		uploadID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "invalid upload ID", http.StatusBadRequest)
+			return
+		}
+
+		res, err := svc.Finalize(r.Context(), user.ID, uploadID)
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		audit(r, middleware.ActionFileUpload, "file", res.FileID, map[string]interface{}{"name": res.FileName, "size": res.Size, "sha256": res.Hash, "resumable": true})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(UploadResult{FileID: res.FileID, FileName: res.FileName, Size: res.Size, Hash: res.Hash})
+	}
+}
+
+func setUploadHeaders(w http.ResponseWriter, offset, size int64, expires time.Time) {
+	w.Header().Set(UploadOffsetHeader, strconv.FormatInt(offset, 10))
+	w.Header().Set(UploadLengthHeader, strconv.FormatInt(size, 10))
+	w.Header().Set(UploadExpiresHeader, expires.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// writeUploadError maps upload service errors to status codes
+func writeUploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrUploadNotFound), errors.Is(err, services.ErrFolderNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrUploadExpired):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, services.ErrUploadOffset), errors.Is(err, services.ErrUploadIncomplete):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, services.ErrUploadTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, services.ErrQuotaExceeded):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, services.ErrInvalidUpload):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "upload failed", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,133 @@
+// Package cdc splits content into content-defined chunks with FastCDC (Xia et
+// al., 2016): cut points depend on the bytes around them rather than on their
+// position, so an insertion only changes the chunks it touches and the rest of
+// the file still dedups against earlier versions.
+package cdc
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// Options bound the chunk sizes in bytes. Chunks are MinSize..MaxSize long and
+// AvgSize on average, except the last one which may be shorter.
+type Options struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+// DefaultOptions suit files from a few MB up: 1 MiB chunks on average
+var DefaultOptions = Options{MinSize: 256 << 10, AvgSize: 1 << 20, MaxSize: 4 << 20}
+
+// WithAverage derives min and max from the average like DefaultOptions does
+func WithAverage(avg int) Options {
+	return Options{MinSize: avg / 4, AvgSize: avg, MaxSize: avg * 4}
+}
+
+// Validate checks 64 <= MinSize < AvgSize < MaxSize
+func (o Options) Validate() error {
+	if o.MinSize < 64 || o.AvgSize <= o.MinSize || o.MaxSize <= o.AvgSize {
+		return errors.New("cdc: chunk sizes must satisfy 64 <= min < avg < max")
+	}
+	return nil
+}
+
+// gear maps each byte to a random 64 bit value. It is generated from a fixed
+// seed: changing it would move every cut point and defeat dedup against
+// content chunked before.
+var gear [256]uint64
+
+func init() {
+	seed := uint64(0x6a09e667f3bcc908)
+	for i := range gear {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// masks for normalized chunking: a cut is harder to find before the average
+// size (one bit more than log2 avg) and easier after it (one bit less), which
+// keeps chunk sizes close to the average. The gear hash shifts left, so its
+// high bits depend on the most bytes and the masks use those.
+func (o Options) masks() (small, large uint64) {
+	b := bits.Len(uint(o.AvgSize)) - 1
+	small = (uint64(1)<<(b+1) - 1) << (64 - (b + 1))
+	large = (uint64(1)<<(b-1) - 1) << (64 - (b - 1))
+	return small, large
+}
+
+// cut returns the length of the chunk starting at data[0]
+func (o Options) cut(data []byte) int {
+	n := len(data)
+	if n <= o.MinSize {
+		return n
+	}
+	if n > o.MaxSize {
+		n = o.MaxSize
+	}
+	normal := o.AvgSize
+	if n < normal {
+		normal = n
+	}
+	small, large := o.masks()
+
+	var fp uint64
+	i := o.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&small == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&large == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Chunker reads a stream and hands it out chunk by chunk, holding at most
+// MaxSize bytes at a time.
+type Chunker struct {
+	r          io.Reader
+	opts       Options
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+// NewChunker: opts must be valid, see Options.Validate
+func NewChunker(r io.Reader, opts Options) *Chunker {
+	return &Chunker{r: r, opts: opts, buf: make([]byte, opts.MaxSize)}
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The slice is only
+// valid until the following call.
+func (c *Chunker) Next() ([]byte, error) {
+	if !c.eof && c.end-c.start < c.opts.MaxSize {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.opts.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
@@ -0,0 +1,5 @@
+-- Per-user name and metadata, two users deduplicated onto the same file keep their own
+ALTER TABLE user_files
+ADD COLUMN file_name TEXT NOT NULL DEFAULT '',
+ADD COLUMN description TEXT,
+ADD COLUMN updated_at TIMESTAMPTZ DEFAULT NOW();
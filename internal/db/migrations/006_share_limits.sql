@@ -0,0 +1,6 @@
+-- Optional expiry, password and download limit on shares, plus explicit revoke
+ALTER TABLE shares
+ADD COLUMN expires_at TIMESTAMPTZ,
+ADD COLUMN password_hash TEXT NOT NULL DEFAULT '',
+ADD COLUMN max_downloads INT CHECK (max_downloads > 0),
+ADD COLUMN revoked_at TIMESTAMPTZ;
@@ -0,0 +1,5 @@
+-- Share links use a random token instead of the row UUID
+ALTER TABLE shares ADD COLUMN token TEXT;
+UPDATE shares SET token = encode(gen_random_bytes(24), 'hex') WHERE token IS NULL;
+ALTER TABLE shares ALTER COLUMN token SET NOT NULL;
+CREATE UNIQUE INDEX idx_shares_token ON shares (token);
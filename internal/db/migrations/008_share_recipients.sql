@@ -0,0 +1,14 @@
+-- Shares target a real user with a role instead of a free-form string
+ALTER TABLE shares
+ADD COLUMN shared_with_id UUID REFERENCES users(id) ON DELETE CASCADE,
+ADD COLUMN role TEXT NOT NULL DEFAULT 'viewer';
+
+UPDATE shares s SET shared_with_id = u.id
+FROM users u
+WHERE s.shared_with IS NOT NULL AND (u.username = s.shared_with OR u.email = s.shared_with);
+
+-- public links are for downloading
+UPDATE shares SET role = 'downloader' WHERE is_public = true;
+
+ALTER TABLE shares DROP COLUMN shared_with;
+CREATE INDEX idx_shares_shared_with_id ON shares (shared_with_id);
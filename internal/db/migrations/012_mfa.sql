@@ -0,0 +1,17 @@
+-- TOTP second factor and recovery codes
+ALTER TABLE users
+ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '',
+ADD COLUMN totp_enabled BOOLEAN DEFAULT false,
+ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE sessions ADD COLUMN mfa_verified BOOLEAN DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    used_at TIMESTAMP
+);
+
+CREATE INDEX idx_recovery_codes_user_id ON recovery_codes (user_id);
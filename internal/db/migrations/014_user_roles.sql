@@ -0,0 +1,3 @@
+-- Roles replace the single admin flag for authorization, is_admin stays in sync with role = 'admin'
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+UPDATE users SET role = 'admin' WHERE is_admin = true;
@@ -0,0 +1,3 @@
+-- Suspended accounts can't log in, their tokens and API keys are rejected
+ALTER TABLE users ADD COLUMN suspended_at TIMESTAMP;
+CREATE INDEX idx_users_suspended_at ON users (suspended_at);
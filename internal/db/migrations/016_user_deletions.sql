@@ -0,0 +1,19 @@
+-- Background user deletion jobs, no foreign key so the job outlives the user
+CREATE TABLE IF NOT EXISTS user_deletions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    username TEXT NOT NULL DEFAULT '',
+    requested_by UUID,
+    transfer_to UUID,
+    transfer_folder_id UUID,
+    status TEXT NOT NULL DEFAULT 'pending',
+    files_total BIGINT DEFAULT 0,
+    files_done BIGINT DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMP
+);
+
+CREATE INDEX idx_user_deletions_user_id ON user_deletions (user_id);
+CREATE INDEX idx_user_deletions_status ON user_deletions (status);
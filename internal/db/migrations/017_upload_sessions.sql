@@ -0,0 +1,25 @@
+-- Resumable uploads in progress, chunks live in storage under uploads/<id>/
+CREATE TABLE IF NOT EXISTS upload_sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    file_name TEXT NOT NULL,
+    folder_id UUID,
+    size BIGINT NOT NULL,
+    upload_offset BIGINT NOT NULL DEFAULT 0,
+    hash_state BYTEA,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_upload_sessions_user_id ON upload_sessions (user_id);
+CREATE INDEX idx_upload_sessions_expires_at ON upload_sessions (expires_at);
+
+-- the committed chunks of each upload, in order
+CREATE TABLE IF NOT EXISTS upload_chunks (
+    upload_id UUID NOT NULL REFERENCES upload_sessions(id) ON DELETE CASCADE,
+    chunk_offset BIGINT NOT NULL,
+    object_key TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    PRIMARY KEY (upload_id, chunk_offset)
+);
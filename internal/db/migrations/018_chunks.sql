@@ -0,0 +1,25 @@
+-- Chunk-level dedup: content split with FastCDC, chunks live in storage under chunks/<hash>
+ALTER TABLE files ADD COLUMN IF NOT EXISTS chunked BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS chunks (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    hash TEXT NOT NULL UNIQUE,
+    size BIGINT NOT NULL,
+    ref_count INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_chunks_ref_count ON chunks (ref_count);
+
+-- manifest of a chunked file, seq orders the chunks
+CREATE TABLE IF NOT EXISTS file_chunks (
+    file_id UUID NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    seq INT NOT NULL,
+    chunk_id UUID NOT NULL REFERENCES chunks(id),
+    file_offset BIGINT NOT NULL,
+    size BIGINT NOT NULL,
+    PRIMARY KEY (file_id, seq)
+);
+
+CREATE INDEX idx_file_chunks_chunk_id ON file_chunks (chunk_id);
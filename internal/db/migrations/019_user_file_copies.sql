@@ -0,0 +1,4 @@
+-- A user may hold the same content more than once, under different names or folders
+ALTER TABLE user_files DROP CONSTRAINT IF EXISTS user_files_user_id_file_id_key;
+
+CREATE INDEX IF NOT EXISTS idx_user_files_user_id_file_id ON user_files (user_id, file_id);
@@ -9,14 +9,21 @@ import (
 
 // User of the system
 type User struct {
-	ID           uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
-	Username     string    `gorm:"uniqueIndex;not null"`
-	PasswordHash string    `gorm:"not null"`
-	Email        string    `gorm:"uniqueIndex"`
-	UsedStorage  int64     `gorm:"default:0"`        // bytes used
-	Quota        int64     `gorm:"default:10485760"` // default 10 MB (configurable)
-	IsAdmin      bool      `gorm:"default:false"`
-	CreatedAt    time.Time `gorm:"autoCreateTime"`
+	ID           uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	Username     string     `gorm:"uniqueIndex;not null"`
+	PasswordHash string     `gorm:"not null" json:"-"`
+	Email        string     `gorm:"uniqueIndex"`
+	UsedStorage  int64      `gorm:"default:0"`        // bytes used
+	Quota        int64      `gorm:"default:10485760"` // default 10 MB (configurable)
+	IsAdmin      bool       `gorm:"default:false"`
+	Role         string     `gorm:"type:text;not null;default:'user'"` // see rbac.Role*, IsAdmin implies admin
+	SuspendedAt  *time.Time `gorm:"index"`                             // suspended users can't log in or use tokens
+	CreatedAt    time.Time  `gorm:"autoCreateTime"`
+
+	// TOTP second factor. The secret is set at enrollment and only counts once verified.
+	TOTPSecret   string `gorm:"not null;default:''" json:"-"` // encrypted, see services.MFAService
+	TOTPEnabled  bool   `gorm:"default:false"`
+	TOTPLastStep int64  `gorm:"not null;default:0" json:"-"` // last accepted time step, codes can't be replayed
 
 	UserFiles []UserFile
 	Folders   []Folder
@@ -26,10 +33,11 @@ type User struct {
 type File struct {
 	ID         uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
 	Hash       string    `gorm:"uniqueIndex;not null"` // sha256 hex
-	ObjectName string    `gorm:"not null"`             // object key in MinIO
+	ObjectName string    `gorm:"not null"`             // object key in MinIO, for chunked files only the lock name
 	Size       int64     `gorm:"not null"`
 	MimeType   string
-	RefCount   int       `gorm:"default:1"` // number of users referencing used for deduplication catch
+	RefCount   int       `gorm:"default:1"`              // number of users referencing used for deduplication catch
+	Chunked    bool      `gorm:"not null;default:false"` // content is stored as the FileChunk manifest
 	CreatedAt  time.Time `gorm:"autoCreateTime"`
 
 	UserFiles []UserFile
@@ -37,13 +45,17 @@ type File struct {
 
 // UserFile links a user to a file, with sharing metadata
 type UserFile struct {
-	ID         uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
-	UserID     uuid.UUID `gorm:"type:uuid;not null;index"`
-	FileID     uuid.UUID `gorm:"type:uuid;not null;index"`
-	IsOwner    bool      `gorm:"default:false"`
-	Visibility string    `gorm:"type:text;default:'private'"` // private | public | shared
-	Downloads  int64     `gorm:"default:0"`
-	CreatedAt  time.Time `gorm:"autoCreateTime"`
+	ID          uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID      uuid.UUID  `gorm:"type:uuid;not null;index"`
+	FileID      uuid.UUID  `gorm:"type:uuid;not null;index"`
+	FolderID    *uuid.UUID `gorm:"type:uuid;index"`               // nil = root
+	FileName    string     `gorm:"type:text;not null;default:''"` // this user's display name for the content
+	Description string     `gorm:"type:text"`
+	IsOwner     bool       `gorm:"default:false"`
+	Visibility  string     `gorm:"type:text;default:'private'"` // private | public | shared
+	Downloads   int64      `gorm:"default:0"`
+	CreatedAt   time.Time  `gorm:"autoCreateTime"` // when this user uploaded it
+	UpdatedAt   time.Time  `gorm:"autoUpdateTime"`
 
 	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
 	File File `gorm:"foreignKey:FileID;constraint:OnDelete:CASCADE"`
@@ -63,16 +75,165 @@ type Folder struct {
 }
 
 type Share struct {
-	ID         uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
-	FileID     uuid.UUID `gorm:"type:uuid;not null"`
-	UserID     uuid.UUID `gorm:"type:uuid;not null"`
-	IsPublic   bool      `gorm:"default:false"`
-	SharedWith *string   //optional
-	Downloads  int       `gorm:"default:0"`
-	CreatedAt  time.Time `gorm:"autoCreateTime"`
+	ID       uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	FileID   uuid.UUID `gorm:"type:uuid;not null"`
+	UserID   uuid.UUID `gorm:"type:uuid;not null"`
+	Token    string    `gorm:"uniqueIndex;not null"` // unguessable link token, /s/{token}
+	IsPublic bool      `gorm:"default:false"`
+
+	// Recipient of a user-to-user share (nil for public link shares) and what they may do
+	SharedWithID *uuid.UUID `gorm:"type:uuid;index"`
+	Role         string     `gorm:"type:text;not null;default:'viewer'"` // viewer | downloader | editor
+	Downloads    int        `gorm:"default:0"`
+	CreatedAt    time.Time  `gorm:"autoCreateTime"`
+
+	ExpiresAt    *time.Time // nil = never expires
+	PasswordHash string     `gorm:"not null;default:''" json:"-"` // bcrypt, empty = no password
+	MaxDownloads *int       // nil = unlimited, enforced against Downloads
+	RevokedAt    *time.Time
+
+	File           File  `gorm:"foreignKey:FileID"`
+	User           User  `gorm:"foreignKEy:UserID"`
+	SharedWithUser *User `gorm:"foreignKey:SharedWithID;constraint:OnDelete:CASCADE" json:",omitempty"`
+}
+
+// Session is one login. Access tokens carry its ID as jti, the refresh token
+// is rotated on every use and only its hash is stored.
+type Session struct {
+	ID                uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID            uuid.UUID `gorm:"type:uuid;not null;index"`
+	RefreshTokenHash  string    `gorm:"uniqueIndex;not null" json:"-"` // sha256 hex of the current refresh token
+	PreviousTokenHash string    `gorm:"index" json:"-"`                // the token it replaced, presenting it again means it leaked
+	CreatedAt         time.Time `gorm:"autoCreateTime"`
+	LastUsedAt        time.Time
+	ExpiresAt         time.Time `gorm:"not null"`
+	RevokedAt         *time.Time
+	MFAVerified       bool `gorm:"default:false"` // logged in with a second factor
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
 
-	File File `gorm:"foreignKey:FileID"`
-	User User `gorm:"foreignKEy:UserID"`
+// RecoveryCode is a single use fallback for the TOTP second factor, stored hashed
+type RecoveryCode struct {
+	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index"`
+	CodeHash  string    `gorm:"type:text;not null"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+	UsedAt    *time.Time
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// APIKey is a long lived credential for scripts, limited to its scopes.
+// Only the hash of the key is stored, Prefix identifies it in listings.
+type APIKey struct {
+	ID         uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID     uuid.UUID  `gorm:"type:uuid;not null;index"`
+	Name       string     `gorm:"type:text;not null"`
+	Prefix     string     `gorm:"type:text;not null"`
+	KeyHash    string     `gorm:"uniqueIndex;not null" json:"-"` // sha256 hex
+	Scopes     string     `gorm:"type:text;not null"`            // comma separated, see tokens.Scope*
+	CreatedAt  time.Time  `gorm:"autoCreateTime"`
+	ExpiresAt  *time.Time // nil = never expires
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// UserIdentity links a user to an account at an external OpenID Connect provider
+type UserIdentity struct {
+	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index"`
+	Issuer    string    `gorm:"type:text;not null;uniqueIndex:idx_user_identities_issuer_subject"`
+	Subject   string    `gorm:"type:text;not null;uniqueIndex:idx_user_identities_issuer_subject"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// UploadSession is a resumable upload in progress. Received chunks are kept
+// as objects under uploads/<id>/ until the upload is finalized or expires.
+type UploadSession struct {
+	ID        uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;index"`
+	FileName  string     `gorm:"type:text;not null"`
+	FolderID  *uuid.UUID `gorm:"type:uuid"`                               // nil = root
+	Size      int64      `gorm:"not null"`                                // declared total length
+	Offset    int64      `gorm:"column:upload_offset;not null;default:0"` // bytes received so far
+	HashState []byte     `json:"-"`                                       // sha256 state after Offset bytes
+	CreatedAt time.Time  `gorm:"autoCreateTime"`
+	UpdatedAt time.Time  `gorm:"autoUpdateTime"`
+	ExpiresAt time.Time  `gorm:"not null;index"`
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// UploadChunk is a chunk committed to a resumable upload. Its object key is
+// unique per attempt, objects without a row are leftovers of attempts that lost.
+type UploadChunk struct {
+	UploadID  uuid.UUID `gorm:"type:uuid;primaryKey"`
+	Offset    int64     `gorm:"column:chunk_offset;primaryKey"`
+	ObjectKey string    `gorm:"type:text;not null"`
+	Size      int64     `gorm:"not null"`
+
+	Upload UploadSession `gorm:"foreignKey:UploadID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// Chunk is a piece of content stored once under "chunks/<hash>" and shared by
+// every chunked file containing it
+type Chunk struct {
+	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	Hash      string    `gorm:"uniqueIndex;not null"` // sha256 hex
+	Size      int64     `gorm:"not null"`
+	RefCount  int       `gorm:"not null;default:0;index"` // manifest entries pointing at it, the GC removes chunks at 0
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime"`
+}
+
+// FileChunk is one entry of a chunked file's manifest, Seq orders them
+type FileChunk struct {
+	FileID  uuid.UUID `gorm:"type:uuid;primaryKey"`
+	Seq     int       `gorm:"primaryKey"`
+	ChunkID uuid.UUID `gorm:"type:uuid;not null;index"`
+	Offset  int64     `gorm:"column:file_offset;not null"` // where the chunk starts in the file
+	Size    int64     `gorm:"not null"`
+
+	File  File  `gorm:"foreignKey:FileID;constraint:OnDelete:CASCADE" json:"-"`
+	Chunk Chunk `gorm:"foreignKey:ChunkID" json:"-"`
+}
+
+// UserDeletion is a background job removing a user. Files are released (or
+// handed to TransferTo) in batches, so a job interrupted by a restart resumes where it stopped.
+type UserDeletion struct {
+	ID               uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID           uuid.UUID  `gorm:"type:uuid;not null;index"` // no foreign key, the job outlives the user
+	Username         string     `gorm:"type:text;not null;default:''"`
+	RequestedBy      *uuid.UUID `gorm:"type:uuid"`
+	TransferTo       *uuid.UUID `gorm:"type:uuid"`                                  // receives the files and folders, nil = release them
+	TransferFolderID *uuid.UUID `gorm:"type:uuid" json:"-"`                         // folder in TransferTo's root holding what was handed over
+	Status           string     `gorm:"type:text;not null;default:'pending';index"` // pending | running | done | failed
+	FilesTotal       int64      `gorm:"default:0"`
+	FilesDone        int64      `gorm:"default:0"`
+	Error            string     `gorm:"type:text;not null;default:''"`
+	CreatedAt        time.Time  `gorm:"autoCreateTime"`
+	UpdatedAt        time.Time  `gorm:"autoUpdateTime"`
+	FinishedAt       *time.Time
+}
+
+// AuditLog is an append-only record of a security or data relevant action.
+// Actor and target are kept as plain IDs so entries outlive deleted users.
+type AuditLog struct {
+	ID         uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime;index"`
+	ActorID    *uuid.UUID `gorm:"type:uuid;index"` // nil for anonymous requests
+	Action     string     `gorm:"type:text;not null;index"`
+	TargetType string     `gorm:"type:text"`
+	TargetID   string     `gorm:"type:text"`
+	IP         string     `gorm:"type:text"`
+	UserAgent  string     `gorm:"type:text"`
+	RequestID  string     `gorm:"type:text"`
+	Details    string     `gorm:"type:text"` // JSON object with action specific fields
 }
 
 // BeforeCreate hooks to auto-generate UUIDs if Postgres function gen_random_uuid() isn’t available
@@ -94,6 +255,54 @@ func (uf *UserFile) BeforeCreate(tx *gorm.DB) (err error) {
 	}
 	return
 }
+func (se *Session) BeforeCreate(tx *gorm.DB) (err error) {
+	if se.ID == uuid.Nil {
+		se.ID = uuid.New()
+	}
+	return
+}
+func (k *APIKey) BeforeCreate(tx *gorm.DB) (err error) {
+	if k.ID == uuid.Nil {
+		k.ID = uuid.New()
+	}
+	return
+}
+func (ui *UserIdentity) BeforeCreate(tx *gorm.DB) (err error) {
+	if ui.ID == uuid.Nil {
+		ui.ID = uuid.New()
+	}
+	return
+}
+func (rc *RecoveryCode) BeforeCreate(tx *gorm.DB) (err error) {
+	if rc.ID == uuid.Nil {
+		rc.ID = uuid.New()
+	}
+	return
+}
+func (a *AuditLog) BeforeCreate(tx *gorm.DB) (err error) {
+	if a.ID == uuid.Nil {
+		a.ID = uuid.New()
+	}
+	return
+}
+func (c *Chunk) BeforeCreate(tx *gorm.DB) (err error) {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return
+}
+func (us *UploadSession) BeforeCreate(tx *gorm.DB) (err error) {
+	if us.ID == uuid.Nil {
+		us.ID = uuid.New()
+	}
+	return
+}
+func (ud *UserDeletion) BeforeCreate(tx *gorm.DB) (err error) {
+	if ud.ID == uuid.Nil {
+		ud.ID = uuid.New()
+	}
+	return
+}
 func (fo *Folder) BeforeCreate(tx *gorm.DB) (err error) {
 	if fo.ID == uuid.Nil {
 		fo.ID = uuid.New()
@@ -2,6 +2,8 @@ package middleware
 
 import (
 	"net/http"
+
+	"backend/internal/rbac"
 )
 
 // Admin only ensures the user is an admin
@@ -15,3 +17,21 @@ func AdminOnly(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequirePermission lets the request through when the user's role grants perm
+func RequirePermission(perm string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := GetUser(r.Context())
+			if user == nil {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if !rbac.Has(user, perm) {
+				http.Error(w, "missing permission "+perm, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
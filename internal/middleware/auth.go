@@ -5,26 +5,34 @@ import (
 	// "io"
 	"net/http"
 	"strings"
+	"time"
 
 	"backend/internal/db"
+	"backend/internal/tokens"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
-// Configure this secret from config.go
+// Keys verifies tokens by kid; when nil a single HS256 key is built from JWTSecret
 type AuthOptions struct {
 	JWTSecret string
+	Keys      *tokens.KeySet
 	DB        *gorm.DB
 }
 
 // AuthMiddleware validates Authorization: Bearer<Token>
-//Expects JWT's sub claim to have user's UUID string
+//Expects JWT's sub claim to have user's UUID string and jti the ID of a live session
+// Token may also be an API key (bk_...), routes limit what it can do with RequireScope
 // On success it loads the user row from DB and attaches it to the request context using WithUser
 // if token invalid -> 401 error
 
 func AuthMiddleware(opts AuthOptions) func(next http.Handler) http.Handler {
-	secret := []byte(opts.JWTSecret)
+	keys := opts.Keys
+	if keys == nil {
+		keys = tokens.NewHMACKeySet(opts.JWTSecret)
+	}
 	dbConn := opts.DB
 
 	return func(next http.Handler) http.Handler {
@@ -41,14 +49,26 @@ func AuthMiddleware(opts AuthOptions) func(next http.Handler) http.Handler {
 				return
 			}
 			tokenStr := parts[1]
-			// Parse token (use standard claims)
-			tok, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-				// only allow hmac signing method
-				if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, jwt.ErrTokenUnverifiable
+
+			// API keys ride in the same header, told apart by their prefix
+			if tokens.IsAPIKey(tokenStr) {
+				user, key, err := authenticateAPIKey(dbConn, tokenStr)
+				if err != nil {
+					http.Error(w, "invalid or revoked api key", http.StatusUnauthorized)
+					return
 				}
-				return secret, nil
-			})
+				if user.SuspendedAt != nil {
+					http.Error(w, "account suspended", http.StatusForbidden)
+					return
+				}
+				ctx := WithAPIKey(WithUser(r.Context(), user), key)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			// Parse token (use standard claims)
+			// the key is picked by kid and must match the token's algorithm
+			tok, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{}, keys.Keyfunc, jwt.WithValidMethods(keys.Methods()))
 			if err != nil || !tok.Valid {
 				http.Error(w, "Invalid token claims", http.StatusUnauthorized)
 				return
@@ -65,10 +85,81 @@ func AuthMiddleware(opts AuthOptions) func(next http.Handler) http.Handler {
 				http.Error(w, "user not found", http.StatusUnauthorized)
 				return
 			}
+			if user.SuspendedAt != nil {
+				http.Error(w, "account suspended", http.StatusForbidden)
+				return
+			}
+
+			// jti is the session the token was issued for, logging out revokes it
+			sessionID, err := uuid.Parse(claims.ID)
+			if err != nil {
+				http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+				return
+			}
+			var live int64
+			err = dbConn.Model(&db.Session{}).
+				Where("id = ? AND user_id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, user.ID, time.Now()).
+				Count(&live).Error
+			if err != nil || live == 0 {
+				http.Error(w, "session revoked or expired", http.StatusUnauthorized)
+				return
+			}
 
 			//attach to the context
-			ctx := WithUser(r.Context(), &user)
+			ctx := WithSessionID(WithUser(r.Context(), &user), sessionID)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// authenticateAPIKey loads a live key and its owner
+func authenticateAPIKey(dbConn *gorm.DB, raw string) (*db.User, *db.APIKey, error) {
+	now := time.Now()
+	var key db.APIKey
+	err := dbConn.Where("key_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", tokens.HashAPIKey(raw), now).
+		First(&key).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	var user db.User
+	if err := dbConn.First(&user, "id = ?", key.UserID).Error; err != nil {
+		return nil, nil, err
+	}
+	// best effort, a failed bookkeeping write shouldn't fail the request
+	dbConn.Model(&key).UpdateColumn("last_used_at", now)
+	return &user, &key, nil
+}
+
+// RequireScope lets API keys through only when they carry scope.
+// Requests authenticated with a session token are not limited.
+func RequireScope(scope string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key := GetAPIKey(r.Context()); key != nil && !hasScope(key, scope) {
+				http.Error(w, "api key lacks scope "+scope, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// SessionOnly rejects API keys, for account and admin routes
+func SessionOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetAPIKey(r.Context()) != nil {
+			http.Error(w, "api keys can't be used here", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hasScope(key *db.APIKey, scope string) bool {
+	for _, s := range strings.Split(key.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -3,11 +3,15 @@ package middleware
 import (
 	"backend/internal/db"
 	"context"
+
+	"github.com/google/uuid"
 )
 
 type contextKey string
 
 const ContextUserKey = contextKey("user")
+const ContextSessionKey = contextKey("session")
+const ContextAPIKeyKey = contextKey("apikey")
 
 // Attach user to context
 func WithUser(ctx context.Context, user *db.User) context.Context {
@@ -23,3 +27,29 @@ func GetUser(ctx context.Context) *db.User {
 	}
 	return nil
 }
+
+// Attach the session the access token belongs to
+func WithSessionID(ctx context.Context, sessionID uuid.UUID) context.Context {
+	return context.WithValue(ctx, ContextSessionKey, sessionID)
+}
+
+// Retrieve the session ID, uuid.Nil when the request wasn't authenticated by a session token
+func GetSessionID(ctx context.Context) uuid.UUID {
+	if v, ok := ctx.Value(ContextSessionKey).(uuid.UUID); ok {
+		return v
+	}
+	return uuid.Nil
+}
+
+// Attach the API key the request was authenticated with
+func WithAPIKey(ctx context.Context, key *db.APIKey) context.Context {
+	return context.WithValue(ctx, ContextAPIKeyKey, key)
+}
+
+// Retrieve the API key, nil when the request used a session token
+func GetAPIKey(ctx context.Context) *db.APIKey {
+	if k, ok := ctx.Value(ContextAPIKeyKey).(*db.APIKey); ok {
+		return k
+	}
+	return nil
+}
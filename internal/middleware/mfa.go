@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"net/http"
+
+	"backend/internal/db"
+	"backend/internal/rbac"
+
+	"gorm.io/gorm"
+)
+
+// RequireMFA lets staff (admins and other roles with admin permissions) through
+// only once they enrolled a second factor and the current session was opened
+// with it. Regular users are not affected.
+func RequireMFA(dbConn *gorm.DB) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := GetUser(r.Context())
+			if !rbac.IsStaff(user) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !user.TOTPEnabled {
+				http.Error(w, "two-factor enrollment required", http.StatusForbidden)
+				return
+			}
+			var verified int64
+			err := dbConn.Model(&db.Session{}).
+				Where("id = ? AND mfa_verified = true", GetSessionID(r.Context())).
+				Count(&verified).Error
+			if err != nil || verified == 0 {
+				http.Error(w, "log in again with your second factor", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
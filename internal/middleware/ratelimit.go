@@ -47,7 +47,7 @@ func RateLimitMiddleware(rl *RateLimiter) func(next http.Handler) http.Handler {
 				key = user.ID.String()
 			} else {
 				// fallback use remote IP
-				ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+				ip := ClientIP(r)
 				if ip == "" {
 					ip = "anon"
 				}
@@ -65,3 +65,9 @@ func RateLimitMiddleware(rl *RateLimiter) func(next http.Handler) http.Handler {
 		})
 	}
 }
+
+// ClientIP is the remote address of the request without the port
+func ClientIP(r *http.Request) string {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return ip
+}
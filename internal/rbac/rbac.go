@@ -0,0 +1,89 @@
+// Package rbac maps user roles to the permissions admin routes require.
+package rbac
+
+import (
+	"sort"
+
+	"backend/internal/db"
+)
+
+// Roles
+const (
+	RoleUser         = "user"
+	RoleAdmin        = "admin"
+	RoleSupport      = "support"       // read-only view of users, stats and the audit log
+	RoleQuotaManager = "quota_manager" // can view users and change their quota
+)
+
+// Permissions checked by RequirePermission
+const (
+	PermUsersRead        = "users.read"
+	PermUsersWrite       = "users.write" // create, suspend, reset passwords
+	PermUsersDelete      = "users.delete"
+	PermUsersQuota       = "users.quota"
+	PermUsersRoles       = "users.roles"
+	PermUsersImpersonate = "users.impersonate"
+	PermStatsRead        = "stats.read"
+	PermAuditRead        = "audit.read"
+	PermGCRun            = "gc.run"
+	PermKeysRotate       = "keys.rotate"
+)
+
+var allPermissions = []string{
+	PermUsersRead, PermUsersWrite, PermUsersDelete, PermUsersQuota, PermUsersRoles,
+	PermUsersImpersonate, PermStatsRead, PermAuditRead, PermGCRun, PermKeysRotate,
+}
+
+var rolePermissions = map[string][]string{
+	RoleUser:         {},
+	RoleAdmin:        allPermissions,
+	RoleSupport:      {PermUsersRead, PermStatsRead, PermAuditRead},
+	RoleQuotaManager: {PermUsersRead, PermUsersQuota, PermStatsRead},
+}
+
+// ValidRole reports whether role exists
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// RoleOf is the user's effective role. IsAdmin always means the admin role,
+// so rows that predate roles keep their rights.
+func RoleOf(u *db.User) string {
+	if u.IsAdmin {
+		return RoleAdmin
+	}
+	if !ValidRole(u.Role) {
+		return RoleUser
+	}
+	return u.Role
+}
+
+// Has reports whether the user's role grants perm
+func Has(u *db.User, perm string) bool {
+	if u == nil {
+		return false
+	}
+	for _, p := range rolePermissions[RoleOf(u)] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStaff: any role with admin permissions, these accounts must use a second factor
+func IsStaff(u *db.User) bool {
+	return u != nil && len(rolePermissions[RoleOf(u)]) > 0
+}
+
+// Roles lists every role with its permissions, for GET /admin/roles
+func Roles() map[string][]string {
+	out := make(map[string][]string, len(rolePermissions))
+	for role, perms := range rolePermissions {
+		sorted := append([]string{}, perms...)
+		sort.Strings(sorted)
+		out[role] = sorted
+	}
+	return out
+}
@@ -1,11 +1,31 @@
 package services
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
 	"backend/internal/db"
+	"backend/internal/rbac"
 
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrInvalidRole  = errors.New("unknown role")
+	ErrLastAdmin    = errors.New("can't remove the last admin")
+	ErrInvalidQuota = errors.New("invalid quota")
+)
+
+// page size of admin listings when the request doesn't ask for one, and the most it may ask for
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
 type AdminService struct {
 	db *gorm.DB
 }
@@ -14,16 +34,277 @@ func NewAdminService(dbConn *gorm.DB) *AdminService {
 	return &AdminService{db: dbConn}
 }
 
-// List all users
-func (s *AdminService) ListUsers() ([]db.User, error) {
-	var users []db.User
-	err := s.db.Find(&users).Error
-	return users, err
+// UserFilter narrows GET /admin/users. Zero values mean no filter.
+type UserFilter struct {
+	Query     string // substring of username or email
+	Role      string
+	Suspended *bool
+	Page      int // 1-based
+	PerPage   int
+	Sort      string // created_at (default) | username | email | used_storage
+	Desc      bool
+}
+
+// UserPage is one page of users and the total matching the filter
+type UserPage struct {
+	Users   []db.User `json:"users"`
+	Total   int64     `json:"total"`
+	Page    int       `json:"page"`
+	PerPage int       `json:"per_page"`
+}
+
+// columns users can be sorted by, anything else would end up in the SQL
+var userSortColumns = map[string]bool{"created_at": true, "username": true, "email": true, "used_storage": true}
+
+// pageBounds clamps a requested page and page size and returns the row offset
+func pageBounds(page, perPage int) (int, int, int) {
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = defaultPageSize
+	}
+	if perPage > maxPageSize {
+		perPage = maxPageSize
+	}
+	return page, perPage, (page - 1) * perPage
+}
+
+// ListUsers returns one page of users matching the filter
+func (s *AdminService) ListUsers(f UserFilter) (*UserPage, error) {
+	q := s.db.Model(&db.User{})
+	if f.Query != "" {
+		like := "%" + escapeLike(f.Query) + "%"
+		q = q.Where("username ILIKE ? OR email ILIKE ?", like, like)
+	}
+	if f.Role != "" {
+		if !rbac.ValidRole(f.Role) {
+			return nil, ErrInvalidRole
+		}
+		// is_admin users count as admins whatever their role column says, see rbac.RoleOf
+		if f.Role == rbac.RoleAdmin {
+			q = q.Where("is_admin = true OR role = ?", f.Role)
+		} else {
+			q = q.Where("is_admin = false AND role = ?", f.Role)
+		}
+	}
+	if f.Suspended != nil {
+		if *f.Suspended {
+			q = q.Where("suspended_at IS NOT NULL")
+		} else {
+			q = q.Where("suspended_at IS NULL")
+		}
+	}
+
+	q = q.Session(&gorm.Session{}) // count and select off the same conditions
+	page := &UserPage{}
+	if err := q.Count(&page.Total).Error; err != nil {
+		return nil, err
+	}
+
+	sort := f.Sort
+	if !userSortColumns[sort] {
+		sort = "created_at"
+	}
+	if f.Desc {
+		sort += " DESC"
+	}
+	var offset int
+	page.Page, page.PerPage, offset = pageBounds(f.Page, f.PerPage)
+	err := q.Order(sort).Order("id").Offset(offset).Limit(page.PerPage).Find(&page.Users).Error
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// CreateUserInput is an account created by an admin, Role and Quota are optional
+type CreateUserInput struct {
+	RegisterInput
+	Role  string
+	Quota *int64
+}
+
+// CreateUser creates an account with a role and quota picked by the admin
+func (s *AdminService) CreateUser(in CreateUserInput) (*db.User, error) {
+	if in.Role == "" {
+		in.Role = rbac.RoleUser
+	}
+	if !rbac.ValidRole(in.Role) {
+		return nil, ErrInvalidRole
+	}
+	if in.Quota != nil && *in.Quota < 0 {
+		return nil, ErrInvalidQuota
+	}
+	return createAccount(s.db, in.RegisterInput, func(u *db.User) {
+		u.Role = in.Role
+		u.IsAdmin = in.Role == rbac.RoleAdmin
+		if in.Quota != nil {
+			u.Quota = *in.Quota
+		}
+	})
+}
+
+// GetUser loads one user by ID
+func (s *AdminService) GetUser(userID uuid.UUID) (*db.User, error) {
+	var user db.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UserUsage is a user together with what they store
+type UserUsage struct {
+	User    *db.User `json:"user"`
+	Files   int64    `json:"files"`
+	Folders int64    `json:"folders"`
+	Shares  int64    `json:"shares"` // active shares the user created
+	Used    int64    `json:"used_storage"`
+	Quota   int64    `json:"quota"`
+}
+
+// GetUserUsage returns the user with their file, folder and share counts
+func (s *AdminService) GetUserUsage(userID uuid.UUID) (*UserUsage, error) {
+	user, err := s.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	usage := &UserUsage{User: user, Used: user.UsedStorage, Quota: user.Quota}
+	if err := s.db.Model(&db.UserFile{}).Where("user_id = ?", userID).Count(&usage.Files).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&db.Folder{}).Where("owner_id = ?", userID).Count(&usage.Folders).Error; err != nil {
+		return nil, err
+	}
+	err = s.db.Model(&db.Share{}).
+		Where("user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", userID, time.Now()).
+		Count(&usage.Shares).Error
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// UserFilePage is one page of a user's files
+type UserFilePage struct {
+	Files   []db.UserFile `json:"files"`
+	Total   int64         `json:"total"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"per_page"`
+}
+
+// ListUserFiles pages through the files a user owns, newest first
+func (s *AdminService) ListUserFiles(userID uuid.UUID, page, perPage int) (*UserFilePage, error) {
+	if _, err := s.GetUser(userID); err != nil {
+		return nil, err
+	}
+	out := &UserFilePage{}
+	q := s.db.Model(&db.UserFile{}).Where("user_id = ?", userID).Session(&gorm.Session{})
+	if err := q.Count(&out.Total).Error; err != nil {
+		return nil, err
+	}
+	var offset int
+	out.Page, out.PerPage, offset = pageBounds(page, perPage)
+	err := q.Preload("File").Order("created_at DESC").Order("id").Offset(offset).Limit(out.PerPage).Find(&out.Files).Error
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SetQuota changes a user's storage quota in bytes. It may go below what the
+// user already stores, uploads are refused until they free space.
+func (s *AdminService) SetQuota(userID uuid.UUID, quota int64) (*db.User, error) {
+	if quota < 0 {
+		return nil, ErrInvalidQuota
+	}
+	res := s.db.Model(&db.User{}).Where("id = ?", userID).Update("quota", quota)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrUserNotFound
+	}
+	return s.GetUser(userID)
+}
+
+// SetSuspended suspends or reinstates a user. Suspending also revokes their
+// sessions; AuthMiddleware refuses their tokens and API keys while suspended.
+func (s *AdminService) SetSuspended(userID uuid.UUID, suspended bool) (*db.User, error) {
+	var suspendedAt *time.Time
+	now := time.Now()
+	if suspended {
+		suspendedAt = &now
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if suspended {
+			if err := lockRoles(tx); err != nil {
+				return err
+			}
+			var user db.User
+			if err := tx.First(&user, "id = ?", userID).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return ErrUserNotFound
+				}
+				return err
+			}
+			if user.IsAdmin {
+				if err := checkOtherAdmin(tx, userID); err != nil {
+					return err
+				}
+			}
+		}
+		q := tx.Model(&db.User{}).Where("id = ?", userID)
+		// suspending twice keeps the original date
+		if suspended {
+			q = q.Where("suspended_at IS NULL")
+		}
+		if err := q.Update("suspended_at", suspendedAt).Error; err != nil {
+			return err
+		}
+		if !suspended {
+			return nil
+		}
+		return tx.Model(&db.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetUser(userID)
 }
 
-// Delete a user and Cascade their file and folder (folder logic not implemented till now)
-func (s *AdminService) DeleteUser(userID string) error {
-	return s.db.Delete(&db.User{}, "id = ?", userID).Error
+// ResetPassword sets a new password and logs the user out everywhere. With an
+// empty password a random one is generated; the password set is returned.
+func (s *AdminService) ResetPassword(userID uuid.UUID, password string) (string, error) {
+	if password == "" {
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		password = base64.RawURLEncoding.EncodeToString(b)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return "", err
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&db.User{}).Where("id = ?", userID).Update("password_hash", hash)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+		return tx.Model(&db.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", time.Now()).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return password, nil
 }
 
 // Get total storage stats accross all users
@@ -41,8 +322,69 @@ func (s *AdminService) GetSystemStats() (map[string]interface{}, error) {
 		return nil, err
 	}
 
+	dedup, err := dedupStats(s.db)
+	if err != nil {
+		return nil, err
+	}
+
 	return map[string]interface{}{
 		"total_used":  totalUsed,
 		"total_quota": totalQuota,
+		"dedup":       dedup,
 	}, nil
 }
+
+// SetRole assigns a role; is_admin follows the admin role
+func (s *AdminService) SetRole(userID uuid.UUID, role string) (*db.User, error) {
+	if !rbac.ValidRole(role) {
+		return nil, ErrInvalidRole
+	}
+	var user db.User
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockRoles(tx); err != nil {
+			return err
+		}
+		if err := tx.First(&user, "id = ?", userID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUserNotFound
+			}
+			return err
+		}
+		if user.IsAdmin && role != rbac.RoleAdmin {
+			if err := checkOtherAdmin(tx, userID); err != nil {
+				return err
+			}
+		}
+		user.Role = role
+		user.IsAdmin = role == rbac.RoleAdmin
+		return tx.Model(&user).Updates(map[string]interface{}{"role": user.Role, "is_admin": user.IsAdmin}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// lockRoles serialises everything that can take admin rights away (role
+// changes, suspensions, deletions), so two of them can't remove the last two
+// admins together
+func lockRoles(tx *gorm.DB) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(hashtext('users:roles'))").Error
+}
+
+// checkOtherAdmin returns ErrLastAdmin unless an admin other than userID can
+// still act: not suspended and not queued for deletion. Call under lockRoles.
+func checkOtherAdmin(tx *gorm.DB, userID uuid.UUID) error {
+	var others int64
+	err := tx.Model(&db.User{}).
+		Where("is_admin = true AND id <> ? AND suspended_at IS NULL", userID).
+		Where("NOT EXISTS (SELECT 1 FROM user_deletions d WHERE d.user_id = users.id AND d.status <> ?)", DeletionDone).
+		Count(&others).Error
+	if err != nil {
+		return err
+	}
+	if others == 0 {
+		return ErrLastAdmin
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"backend/internal/db"
+	"backend/internal/tokens"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidAPIKey  = errors.New("invalid api key request")
+	ErrAPIKeyNotFound = errors.New("api key not found")
+)
+
+type APIKeyService struct {
+	db *gorm.DB
+}
+
+func NewAPIKeyService(dbConn *gorm.DB) *APIKeyService {
+	return &APIKeyService{db: dbConn}
+}
+
+// CreateAPIKey stores a new key for the user and returns it together with the
+// plain key, which is shown this one time only.
+func (s *APIKeyService) CreateAPIKey(userID uuid.UUID, name string, scopes []string, expiresAt *time.Time) (*db.APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return nil, "", fmt.Errorf("%w: name must be 1 to 100 characters", ErrInvalidAPIKey)
+	}
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("%w: at least one scope is required", ErrInvalidAPIKey)
+	}
+	set := map[string]bool{}
+	for _, scope := range scopes {
+		if !tokens.ValidScope(scope) {
+			return nil, "", fmt.Errorf("%w: unknown scope %q", ErrInvalidAPIKey, scope)
+		}
+		set[scope] = true
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, "", fmt.Errorf("%w: expires_at must be in the future", ErrInvalidAPIKey)
+	}
+	sorted := make([]string, 0, len(set))
+	for scope := range set {
+		sorted = append(sorted, scope)
+	}
+	sort.Strings(sorted)
+
+	plain, hash, err := tokens.NewAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+	key := &db.APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    plain[:len(tokens.APIKeyPrefix)+6],
+		KeyHash:   hash,
+		Scopes:    strings.Join(sorted, ","),
+		ExpiresAt: expiresAt,
+	}
+	if err := s.db.Create(key).Error; err != nil {
+		return nil, "", err
+	}
+	return key, plain, nil
+}
+
+// ListAPIKeys returns the user's keys, revoked ones included, newest first
+func (s *APIKeyService) ListAPIKeys(userID uuid.UUID) ([]db.APIKey, error) {
+	var keys []db.APIKey
+	err := s.db.Where("user_id = ?", userID).Order("created_at DESC").Find(&keys).Error
+	return keys, err
+}
+
+// RevokeAPIKey disables one of the user's keys
+func (s *APIKeyService) RevokeAPIKey(userID, keyID uuid.UUID) error {
+	res := s.db.Model(&db.APIKey{}).Where("id = ? AND user_id = ? AND revoked_at IS NULL", keyID, userID).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
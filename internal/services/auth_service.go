@@ -0,0 +1,333 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"backend/internal/db"
+	"backend/internal/rbac"
+	"backend/internal/tokens"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidCredentials  = errors.New("invalid username or password")
+	ErrUsernameTaken       = errors.New("username already taken")
+	ErrEmailTaken          = errors.New("email already registered")
+	ErrInvalidRegistration = errors.New("invalid registration")
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused, session revoked")
+	ErrAccountSuspended    = errors.New("account suspended")
+)
+
+// bcrypt work factor for account passwords
+const passwordHashCost = 12
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+// compared against when the user doesn't exist, so both paths cost one bcrypt check
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), passwordHashCost)
+
+// AuthService creates accounts and issues the access tokens AuthMiddleware accepts
+type AuthService struct {
+	db         *gorm.DB
+	keys       *tokens.KeySet
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// NewAuthService: access tokens are short lived, sessions (and their refresh tokens) last refreshTTL
+func NewAuthService(dbConn *gorm.DB, keys *tokens.KeySet, accessTTL, refreshTTL time.Duration) *AuthService {
+	return &AuthService{db: dbConn, keys: keys, accessTTL: accessTTL, refreshTTL: refreshTTL}
+}
+
+// AuthTokens is what a successful login or refresh returns. When the account
+// has a second factor, login returns only MFAToken, to be completed at /auth/mfa/login.
+type AuthTokens struct {
+	AccessToken  string `json:"access_token,omitempty"`
+	TokenType    string `json:"token_type,omitempty"`
+	ExpiresIn    int    `json:"expires_in,omitempty"` // seconds
+	RefreshToken string `json:"refresh_token,omitempty"`
+
+	MFARequired           bool   `json:"mfa_required,omitempty"`
+	MFAToken              string `json:"mfa_token,omitempty"`
+	MFAEnrollmentRequired bool   `json:"mfa_enrollment_required,omitempty"` // staff must enroll before using admin routes
+}
+
+// lifetime of the token between password check and second factor
+const mfaChallengeTTL = 5 * time.Minute
+
+// audience of MFA challenge tokens, they are not access tokens
+const mfaChallengeAudience = "mfa-challenge"
+
+type RegisterInput struct {
+	Username string
+	Email    string
+	Password string
+}
+
+// hashPassword validates and bcrypt-hashes an account password
+func hashPassword(password string) (string, error) {
+	// bcrypt ignores everything after 72 bytes, refuse instead of silently truncating
+	if len(password) < 8 || len(password) > 72 {
+		return "", fmt.Errorf("%w: password must be 8 to 72 bytes long", ErrInvalidRegistration)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Register creates a regular user account
+func (s *AuthService) Register(in RegisterInput) (*db.User, error) {
+	return createAccount(s.db, in, func(*db.User) {})
+}
+
+// createAccount validates the input and inserts the user; setup can set
+// fields like role or quota before the insert
+func createAccount(dbConn *gorm.DB, in RegisterInput, setup func(*db.User)) (*db.User, error) {
+	username := strings.TrimSpace(in.Username)
+	if !usernamePattern.MatchString(username) {
+		return nil, fmt.Errorf("%w: username must be 3-32 letters, digits, '.', '_' or '-'", ErrInvalidRegistration)
+	}
+	email := strings.ToLower(strings.TrimSpace(in.Email))
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return nil, fmt.Errorf("%w: invalid email address", ErrInvalidRegistration)
+	}
+	hash, err := hashPassword(in.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	// friendly errors for the common case, the unique indexes still catch races below
+	var count int64
+	if err := dbConn.Model(&db.User{}).Where("username = ?", username).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrUsernameTaken
+	}
+	if err := dbConn.Model(&db.User{}).Where("email = ?", email).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrEmailTaken
+	}
+
+	user := &db.User{Username: username, Email: email, PasswordHash: hash}
+	setup(user)
+	if err := dbConn.Create(user).Error; err != nil {
+		if isUniqueConstraintErr(err) {
+			if strings.Contains(strings.ToLower(err.Error()), "email") {
+				return nil, ErrEmailTaken
+			}
+			return nil, ErrUsernameTaken
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// Login checks a username (or email) and password and issues an access token
+func (s *AuthService) Login(login, password string) (*AuthTokens, *db.User, error) {
+	login = strings.TrimSpace(login)
+	var user db.User
+	err := s.db.Where("username = ? OR email = ?", login, strings.ToLower(login)).First(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, err
+	}
+	found := err == nil
+	hash := dummyPasswordHash
+	if found {
+		hash = []byte(user.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !found {
+		return nil, nil, ErrInvalidCredentials
+	}
+
+	tokens, err := s.startLogin(&user)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tokens, &user, nil
+}
+
+// startLogin is called once the user proved who they are to us or to the
+// identity provider: users with a second factor get a challenge, everyone else a session
+func (s *AuthService) startLogin(user *db.User) (*AuthTokens, error) {
+	if user.SuspendedAt != nil {
+		return nil, ErrAccountSuspended
+	}
+	if user.TOTPEnabled {
+		return s.mfaChallenge(user)
+	}
+	tokens, err := s.IssueTokens(user)
+	if err != nil {
+		return nil, err
+	}
+	tokens.MFAEnrollmentRequired = rbac.IsStaff(user)
+	return tokens, nil
+}
+
+// mfaChallenge signs a short lived token naming the user who passed the first factor
+func (s *AuthService) mfaChallenge(user *db.User) (*AuthTokens, error) {
+	now := time.Now()
+	signed, err := s.keys.Sign(jwt.RegisteredClaims{
+		ID:        uuid.NewString(),
+		Subject:   user.ID.String(),
+		Audience:  jwt.ClaimStrings{mfaChallengeAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(mfaChallengeTTL)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &AuthTokens{MFARequired: true, MFAToken: signed}, nil
+}
+
+// IssueTokens starts a new session for user and returns its first token pair
+func (s *AuthService) IssueTokens(user *db.User) (*AuthTokens, error) {
+	return s.newSession(user, false)
+}
+
+func (s *AuthService) newSession(user *db.User, mfaVerified bool) (*AuthTokens, error) {
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	session := &db.Session{
+		UserID:           user.ID,
+		RefreshTokenHash: hashRefreshToken(refresh),
+		LastUsedAt:       now,
+		ExpiresAt:        now.Add(s.refreshTTL),
+		MFAVerified:      mfaVerified,
+	}
+	if err := s.db.Create(session).Error; err != nil {
+		return nil, err
+	}
+	return s.tokensFor(session, refresh)
+}
+
+// Refresh trades a refresh token for a new pair. The presented token stops working;
+// presenting an already rotated token again revokes the whole session.
+func (s *AuthService) Refresh(refreshToken string) (*AuthTokens, error) {
+	hash := hashRefreshToken(refreshToken)
+	now := time.Now()
+
+	tx := s.db.Begin()
+	var session db.Session
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("refresh_token_hash = ?", hash).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		tx.Rollback()
+		return nil, s.checkReuse(hash, now)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if session.RevokedAt != nil || !session.ExpiresAt.After(now) {
+		tx.Rollback()
+		return nil, ErrInvalidRefreshToken
+	}
+
+	next, err := newRefreshToken()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Model(&session).Updates(map[string]interface{}{
+		"refresh_token_hash":  hashRefreshToken(next),
+		"previous_token_hash": hash,
+		"last_used_at":        now,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return s.tokensFor(&session, next)
+}
+
+// checkReuse revokes the session a rotated-out refresh token belonged to.
+// Either the client or someone who stole the token already used it, we can't tell which.
+func (s *AuthService) checkReuse(hash string, now time.Time) error {
+	res := s.db.Model(&db.Session{}).
+		Where("previous_token_hash = ? AND revoked_at IS NULL", hash).
+		Update("revoked_at", now)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		return ErrRefreshTokenReused
+	}
+	return ErrInvalidRefreshToken
+}
+
+// Logout revokes one session, its access tokens stop working immediately
+func (s *AuthService) Logout(userID, sessionID uuid.UUID) error {
+	return s.db.Model(&db.Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// LogoutAll revokes every session of the user
+func (s *AuthService) LogoutAll(userID uuid.UUID) (int64, error) {
+	res := s.db.Model(&db.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now())
+	return res.RowsAffected, res.Error
+}
+
+// tokensFor signs an access token for the session: sub is the user ID as
+// AuthMiddleware expects, jti is the session ID so revoking the session revokes the token.
+func (s *AuthService) tokensFor(session *db.Session, refresh string) (*AuthTokens, error) {
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		ID:        session.ID.String(),
+		Subject:   session.UserID.String(),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(s.accessTTL)),
+	}
+	signed, err := s.keys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthTokens{
+		AccessToken:  signed,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.accessTTL.Seconds()),
+		RefreshToken: refresh,
+	}, nil
+}
+
+// newRefreshToken returns an opaque random token, only its hash is stored
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// refresh tokens are high entropy, a plain sha256 is enough to look them up by
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,336 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+
+	"backend/internal/cdc"
+	"backend/internal/db"
+	"backend/internal/storage"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ChunkPrefix is where chunks of chunked files are stored, keyed by their sha256
+const ChunkPrefix = "chunks/"
+
+// Chunk rows are shared by files through ref counts. Row locks on the chunk
+// row take the place of the advisory object lock used for whole files:
+//   - an upload increments the ref count with an upsert and writes the object
+//     only when the upsert created the row, so the row stays locked until the
+//     object is there and the file committed
+//   - the GC deletes a chunk row at ref count 0 and its object in one
+//     transaction, an upload referencing it meanwhile waits and then creates
+//     the row (and object) anew
+//
+// Transactions lock chunk rows in hash order, never in file order: two files
+// sharing chunks in a different order would otherwise deadlock.
+
+// chunkRef is one entry of a manifest being written
+type chunkRef struct {
+	hash   string
+	offset int64
+	size   int64
+}
+
+// storeChunks splits the content into chunks, references them and writes the
+// manifest of file. Runs in the transaction creating the file row.
+//
+// The content is read twice: once to hash the chunks, so their rows can be
+// locked in hash order, and again to store the chunks that turned out to be new.
+func (s *FileService) storeChunks(ctx context.Context, tx *gorm.DB, file *db.File, src contentSource) error {
+	var manifest []chunkRef
+	counts := map[string]int{}
+	sizes := map[string]int{}
+	err := s.eachChunk(src, func(hash string, data []byte) error {
+		var offset int64
+		if n := len(manifest); n > 0 {
+			offset = manifest[n-1].offset + manifest[n-1].size
+		}
+		manifest = append(manifest, chunkRef{hash: hash, offset: offset, size: int64(len(data))})
+		counts[hash]++
+		sizes[hash] = len(data)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var total int64
+	if n := len(manifest); n > 0 {
+		total = manifest[n-1].offset + manifest[n-1].size
+	}
+	if total != file.Size {
+		return fmt.Errorf("content is %d bytes, expected %d", total, file.Size)
+	}
+
+	hashes := make([]string, 0, len(counts))
+	for hash := range counts {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	ids := make(map[string]uuid.UUID, len(hashes))
+	missing := map[string]bool{}
+	for _, hash := range hashes {
+		var ref struct {
+			ID       uuid.UUID
+			Inserted bool
+		}
+		err := tx.Raw(`INSERT INTO chunks (id, hash, size, ref_count, created_at, updated_at) VALUES (?, ?, ?, ?, NOW(), NOW())
+			ON CONFLICT (hash) DO UPDATE SET ref_count = chunks.ref_count + EXCLUDED.ref_count, updated_at = NOW()
+			RETURNING id, (xmax = 0) AS inserted`, uuid.New(), hash, sizes[hash], counts[hash]).Scan(&ref).Error
+		if err != nil {
+			return fmt.Errorf("reference chunk: %w", err)
+		}
+		ids[hash] = ref.ID
+		if ref.Inserted {
+			missing[hash] = true
+		}
+	}
+
+	// second pass: store the new chunks, their rows stay locked until the file commits
+	if len(missing) > 0 {
+		err := s.eachChunk(src, func(hash string, data []byte) error {
+			if !missing[hash] {
+				return nil
+			}
+			if err := s.storage.Put(ctx, ChunkPrefix+hash, "application/octet-stream", bytes.NewReader(data), int64(len(data))); err != nil {
+				return fmt.Errorf("store chunk: %w", err)
+			}
+			delete(missing, hash)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("content changed while storing %d chunks", len(missing))
+		}
+	}
+
+	entries := make([]db.FileChunk, len(manifest))
+	for seq, c := range manifest {
+		entries[seq] = db.FileChunk{FileID: file.ID, Seq: seq, ChunkID: ids[c.hash], Offset: c.offset, Size: c.size}
+	}
+	if len(entries) > 0 {
+		if err := tx.CreateInBatches(entries, 500).Error; err != nil {
+			return fmt.Errorf("create manifest: %w", err)
+		}
+	}
+	return nil
+}
+
+// eachChunk reads the content and calls fn with every chunk and its sha256
+func (s *FileService) eachChunk(src contentSource, fn func(hash string, data []byte) error) error {
+	r, err := src.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	chunker := cdc.NewChunker(r, *s.chunking)
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read content: %w", err)
+		}
+		sum := sha256.Sum256(data)
+		if err := fn(hex.EncodeToString(sum[:]), data); err != nil {
+			return err
+		}
+	}
+}
+
+// releaseChunks drops the manifest of a file that is being deleted and the
+// references it held. Chunks left at 0 are removed by the GC.
+func releaseChunks(tx *gorm.DB, file *db.File) error {
+	if !file.Chunked {
+		return nil
+	}
+	// lock the rows in hash order first, like storeChunks does
+	err := tx.Exec(`SELECT id FROM chunks WHERE id IN (SELECT chunk_id FROM file_chunks WHERE file_id = ?)
+		ORDER BY hash FOR UPDATE`, file.ID).Error
+	if err != nil {
+		return fmt.Errorf("lock chunks: %w", err)
+	}
+	err = tx.Exec(`UPDATE chunks SET ref_count = chunks.ref_count - fc.n, updated_at = NOW()
+		FROM (SELECT chunk_id, COUNT(*) AS n FROM file_chunks WHERE file_id = ? GROUP BY chunk_id) fc
+		WHERE chunks.id = fc.chunk_id`, file.ID).Error
+	if err != nil {
+		return fmt.Errorf("release chunks: %w", err)
+	}
+	if err := tx.Where("file_id = ?", file.ID).Delete(&db.FileChunk{}).Error; err != nil {
+		return fmt.Errorf("delete manifest: %w", err)
+	}
+	return nil
+}
+
+// openChunks reassembles length bytes of a chunked file starting at offset
+// (length -1 = till the end), opening chunks as the reader gets to them.
+func (s *FileService) openChunks(ctx context.Context, file *db.File, offset, length int64) (io.ReadCloser, error) {
+	var parts []struct {
+		Hash  string
+		Start int64
+	}
+	err := s.db.Table("file_chunks fc").
+		Select("c.hash, fc.file_offset AS start").
+		Joins("JOIN chunks c ON c.id = fc.chunk_id").
+		Where("fc.file_id = ? AND fc.file_offset + fc.size > ?", file.ID, offset).
+		Order("fc.seq").
+		Scan(&parts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	r := &chunkReader{ctx: ctx, store: s.storage, keys: make([]string, len(parts))}
+	for i, p := range parts {
+		r.keys[i] = ChunkPrefix + p.Hash
+	}
+	if len(parts) > 0 {
+		r.skip = offset - parts[0].Start
+	}
+	if length < 0 {
+		return r, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(r, length), r}, nil
+}
+
+// deleteChunk removes a chunk nothing references anymore together with its object.
+// Returns false when the chunk was referenced again in the meantime.
+func (s *FileService) deleteChunk(ctx context.Context, chunk *db.Chunk) (bool, error) {
+	tx := s.db.Begin()
+	defer tx.Rollback()
+	res := tx.Where("id = ? AND ref_count <= 0", chunk.ID).Delete(&db.Chunk{})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, nil
+	}
+	// the deleted row stays locked until commit, an upload needing the chunk waits for us
+	if err := s.storage.Delete(ctx, ChunkPrefix+chunk.Hash); err != nil {
+		return false, err
+	}
+	return true, tx.Commit().Error
+}
+
+// purgeChunkObject removes a chunk object that has no chunk row, left by an
+// upload that failed after storing it. A placeholder row is inserted for the
+// duration so an upload creating the chunk right now waits on its unique key,
+// then the transaction is rolled back.
+func (s *FileService) purgeChunkObject(ctx context.Context, hash string) (bool, error) {
+	tx := s.db.Begin()
+	defer tx.Rollback()
+	res := tx.Exec(`INSERT INTO chunks (id, hash, size, ref_count, created_at, updated_at) VALUES (?, ?, 0, 0, NOW(), NOW())
+		ON CONFLICT (hash) DO NOTHING`, uuid.New(), hash)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, nil // the chunk exists (again)
+	}
+	if err := s.storage.Delete(ctx, ChunkPrefix+hash); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DedupStats shows what deduplication saves across all users
+type DedupStats struct {
+	LogicalBytes      int64 `json:"logical_bytes"`       // every user's files added up
+	FileBytes         int64 `json:"file_bytes"`          // distinct content, after whole-file dedup
+	StoredBytes       int64 `json:"stored_bytes"`        // whole objects plus distinct chunks
+	FileLevelSavings  int64 `json:"file_level_savings"`  // LogicalBytes - FileBytes
+	ChunkLevelSavings int64 `json:"chunk_level_savings"` // FileBytes - StoredBytes
+	ChunkedFiles      int64 `json:"chunked_files"`
+	Chunks            int64 `json:"chunks"`
+}
+
+func dedupStats(dbConn *gorm.DB) (*DedupStats, error) {
+	st := &DedupStats{}
+	err := dbConn.Model(&db.UserFile{}).Joins("JOIN files f ON f.id = user_files.file_id").
+		Select("COALESCE(SUM(f.size), 0)").Scan(&st.LogicalBytes).Error
+	if err != nil {
+		return nil, err
+	}
+	var files struct {
+		Total   int64
+		Whole   int64
+		Chunked int64
+	}
+	err = dbConn.Model(&db.File{}).
+		Select("COALESCE(SUM(size), 0) AS total, COALESCE(SUM(size) FILTER (WHERE NOT chunked), 0) AS whole, COUNT(*) FILTER (WHERE chunked) AS chunked").
+		Scan(&files).Error
+	if err != nil {
+		return nil, err
+	}
+	var chunks struct {
+		Bytes int64
+		Count int64
+	}
+	err = dbConn.Model(&db.Chunk{}).Where("ref_count > 0").
+		Select("COALESCE(SUM(size), 0) AS bytes, COUNT(*) AS count").Scan(&chunks).Error
+	if err != nil {
+		return nil, err
+	}
+
+	st.FileBytes = files.Total
+	st.StoredBytes = files.Whole + chunks.Bytes
+	st.FileLevelSavings = st.LogicalBytes - st.FileBytes
+	st.ChunkLevelSavings = st.FileBytes - st.StoredBytes
+	st.ChunkedFiles = files.Chunked
+	st.Chunks = chunks.Count
+	return st, nil
+}
+
+// chunkReader reads objects one after the other, opening each only when it's
+// needed. The first one is read from skip on.
+type chunkReader struct {
+	ctx   context.Context
+	store storage.Backend
+	keys  []string
+	skip  int64
+	cur   io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if len(c.keys) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := c.store.GetRange(c.ctx, c.keys[0], c.skip, -1)
+			if err != nil {
+				return 0, fmt.Errorf("open chunk %s: %w", c.keys[0], err)
+			}
+			c.cur, c.keys, c.skip = rc, c.keys[1:], 0
+		}
+		n, err := c.cur.Read(p)
+		if err == io.EOF {
+			c.cur.Close()
+			c.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.cur != nil {
+		return c.cur.Close()
+	}
+	return nil
+}
@@ -1,82 +1,225 @@
 package services
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"os"
+	"io"
+	"log"
+	"net/http"
 	"strings"
+	"time"
 
+	"backend/internal/cdc"
 	"backend/internal/db"
 	"backend/internal/storage"
 
 	"github.com/google/uuid"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // FileService orchestrates dedup logic, DB updates and calls to storage.
 type FileService struct {
-	db      *gorm.DB
-	storage *storage.MinioClient
+	db       *gorm.DB
+	storage  storage.Backend
+	chunking *cdc.Options // set: new content is stored as chunks
 }
 
 // NewFileService
-func NewFileService(dbConn *gorm.DB, st *storage.MinioClient) *FileService {
+func NewFileService(dbConn *gorm.DB, st storage.Backend) *FileService {
 	return &FileService{db: dbConn, storage: st}
 }
 
-// ProcessUpload:
+// StagingPrefix holds streamed uploads until their hash is known. Leftovers of
+// interrupted uploads are unreferenced objects the GC removes after the grace period.
+const StagingPrefix = "staging/"
+
+var (
+	// ErrHashMismatch is returned when the received bytes don't hash to the declared SHA-256
+	ErrHashMismatch = errors.New("content doesn't match the declared sha256")
+	// ErrContentNotStored means no stored content has the declared hash and size, the bytes must be sent
+	ErrContentNotStored = errors.New("content not stored yet")
+	// ErrInvalidHash is returned for a declared hash that isn't 64 hex digits
+	ErrInvalidHash = errors.New("invalid sha256")
+)
+
+// StoredUpload describes content stored by ProcessStream
+type StoredUpload struct {
+	FileID   string
+	Size     int64
+	MimeType string
+	Hash     string
+}
+
+// SetChunking switches new content to chunk storage split with opts, nil
+// switches back to whole objects. Content stored before keeps its layout,
+// both are read the same way.
+func (s *FileService) SetChunking(opts *cdc.Options) {
+	s.chunking = opts
+}
+
+// ProcessStream:
 //   - userID: uploader's ID
-//   - filename: original filename (for metadata); storage uses hash objectKey
-//   - tmpFilePath: path to temporary file on disk (handler should remove when finished)
-//   - size: file size in bytes
-//   - mimeType: detected mime
-//   - hash: sha256 hex string
+//   - filename: original filename, kept per user on the UserFile; storage uses hash objectKey
+//   - folderID: optional folder (owned by the user) to place the file in, nil = root
+//   - r: the content, read once
+//   - declaredHash: optional sha256 hex the client announced, the upload fails
+//     with ErrHashMismatch and nothing is recorded if the content hashes differently
 //
-// Returns created/existing file ID (db.File.ID) on success.
-func (s *FileService) ProcessUpload(ctx context.Context, userID uuid.UUID, filename, tmpFilePath string, size int64, mimeType, hash string) (string, error) {
-	// open temp file for upload
-	f, err := os.Open(tmpFilePath)
+// The content is hashed while it is written to a staging object, nothing is
+// buffered on local disk. Once the hash is known the staging object is either
+// promoted to the content-hash key or, if that content is already stored,
+// dropped in favour of a new reference.
+func (s *FileService) ProcessStream(ctx context.Context, userID uuid.UUID, filename string, folderID *uuid.UUID, r io.Reader, declaredHash string) (*StoredUpload, error) {
+	// fail before receiving the bytes rather than after
+	if declaredHash != "" && !validHash(declaredHash) {
+		return nil, ErrInvalidHash
+	}
+	if err := checkFolder(s.db, userID, folderID); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("read upload: %w", err)
+	}
+	mimeType := http.DetectContentType(header[:n])
+
+	hasher := sha256.New()
+	counted := &countingReader{r: io.TeeReader(io.MultiReader(bytes.NewReader(header[:n]), r), hasher)}
+	stagingKey := StagingPrefix + uuid.NewString()
+	if err := s.storage.Put(ctx, stagingKey, mimeType, counted, -1); err != nil {
+		s.storage.Delete(ctx, stagingKey)
+		return nil, fmt.Errorf("storage upload: %w", err)
+	}
+	defer func() {
+		if err := s.storage.Delete(context.Background(), stagingKey); err != nil {
+			log.Printf("delete staging object %s: %v", stagingKey, err)
+		}
+	}()
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if declaredHash != "" && !strings.EqualFold(declaredHash, hash) {
+		return nil, ErrHashMismatch
+	}
+	src := contentSource{
+		open: func() (io.ReadCloser, error) { return s.storage.Get(ctx, stagingKey) },
+		copyTo: func(objectKey string) error {
+			return s.storage.Copy(ctx, stagingKey, objectKey)
+		},
+	}
+	fileID, err := s.processContent(ctx, userID, filename, folderID, src, counted.n, mimeType, hash)
+	if err != nil {
+		return nil, err
+	}
+	return &StoredUpload{FileID: fileID, Size: counted.n, MimeType: mimeType, Hash: hash}, nil
+}
+
+// LinkByHash gives the user one more entry for content they already hold,
+// identified by its sha256 and size, through the ref count path and without
+// the bytes being sent again (say an artifact republished under a new name).
+// Returns ErrContentNotStored when the user holds no such content, also when
+// another user stored it: a hash and size prove nothing about having the
+// bytes, and a different answer would tell whether someone else has the file.
+func (s *FileService) LinkByHash(userID uuid.UUID, filename string, folderID *uuid.UUID, hash string, size int64) (*db.UserFile, error) {
+	if !validHash(hash) {
+		return nil, ErrInvalidHash
+	}
+	hash = strings.ToLower(hash)
+
+	tx := s.db.Begin()
+	defer tx.Rollback()
+	if err := useFolder(tx, userID, folderID); err != nil {
+		return nil, err
+	}
+	if err := lockObject(tx, hash); err != nil {
+		return nil, fmt.Errorf("lock content: %w", err)
+	}
+	var held db.UserFile
+	err := tx.Joins("JOIN files f ON f.id = user_files.file_id").
+		Where("user_files.user_id = ? AND f.hash = ? AND f.size = ?", userID, hash, size).
+		Order("user_files.is_owner DESC").
+		First(&held).Error
 	if err != nil {
-		return "", fmt.Errorf("open tmp: %w", err)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrContentNotStored
+		}
+		return nil, fmt.Errorf("db find file: %w", err)
+	}
+	var file db.File
+	if err := tx.First(&file, "id = ?", held.FileID).Error; err != nil {
+		return nil, fmt.Errorf("db find file: %w", err)
+	}
+	var user db.User
+	if err := tx.Select("used_storage", "quota").First(&user, "id = ?", userID).Error; err != nil {
+		return nil, err
+	}
+	if user.UsedStorage+file.Size > user.Quota {
+		return nil, ErrQuotaExceeded
+	}
+	link := db.UserFile{UserID: userID, FileName: cleanFileName(filename), FolderID: folderID, IsOwner: held.IsOwner}
+	if err := addLink(tx, &link, &file); err != nil {
+		return nil, err
 	}
-	defer f.Close()
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// validHash accepts a sha256 in hex
+func validHash(h string) bool {
+	if len(h) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(h)
+	return err == nil
+}
+
+// contentSource is where processContent gets content that isn't stored yet
+type contentSource struct {
+	// open may be called more than once, chunk storage reads the content twice
+	open func() (io.ReadCloser, error)
+	// copyTo optionally stores the content under an object key without it
+	// passing through us, used instead of open when storing whole objects
+	copyTo func(objectKey string) error
+}
+
+// processContent records content of a known hash for the user, src is only
+// read when the content isn't stored yet.
+// Returns created/existing file ID (db.File.ID) on success.
+func (s *FileService) processContent(ctx context.Context, userID uuid.UUID, filename string, folderID *uuid.UUID, src contentSource, size int64, mimeType, hash string) (string, error) {
+	link := db.UserFile{UserID: userID, FileName: cleanFileName(filename), FolderID: folderID}
 
 	// object key strategy: use hash so uploads are idempotent
 	objectKey := hash
 
+	// Everything touching this content (uploads, deletes, GC) is serialised on the
+	// object key for the lifetime of the transaction, so a concurrent delete can't
+	// remove the object between our storage upload and the file row commit.
+	tx := s.db.Begin()
+	if err := useFolder(tx, userID, folderID); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if err := lockObject(tx, objectKey); err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("lock content: %w", err)
+	}
+
 	// 1) Try to find existing file by hash
 	var existing db.File
-	err = s.db.Where("hash = ?", hash).First(&existing).Error
+	err := tx.Where("hash = ?", hash).First(&existing).Error
 	if err == nil {
-		// file exists, check if user already linked to it
-		var userFile db.UserFile
-		errUF := s.db.Where("user_id = ? AND file_id = ?", userID, existing.ID).First(&userFile).Error
-		if errUF == nil {
-			// user already has this file linked — nothing to do
-			return existing.ID.String(), nil
-		}
-
-		// Create a link and increment ref_count and user's used_storage in a transaction
-		tx := s.db.Begin()
-		if err := tx.Model(&existing).Update("ref_count", gorm.Expr("ref_count + ?", 1)).Error; err != nil {
-			tx.Rollback()
-			return "", fmt.Errorf("update ref_count: %w", err)
-		}
-		uf := db.UserFile{
-			UserID:  userID,
-			FileID:  existing.ID,
-			IsOwner: false,
-		}
-		if err := tx.Create(&uf).Error; err != nil {
-			tx.Rollback()
-			return "", fmt.Errorf("create user_file: %w", err)
-		}
-		// increase user's used storage
-		if err := tx.Model(&db.User{}).Where("id = ?", userID).Update("used_storage", gorm.Expr("used_storage + ?", existing.Size)).Error; err != nil {
+		if err := linkExisting(tx, link, &existing); err != nil {
 			tx.Rollback()
-			return "", fmt.Errorf("update user storage: %w", err)
+			return "", err
 		}
 		if err := tx.Commit().Error; err != nil {
 			return "", err
@@ -84,74 +227,34 @@ func (s *FileService) ProcessUpload(ctx context.Context, userID uuid.UUID, filen
 		return existing.ID.String(), nil
 	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
 		// some other DB error
+		tx.Rollback()
 		return "", fmt.Errorf("db find file: %w", err)
 	}
 
-	// 2) File not found in DB -> upload to MinIO
-	// Use the temp file reader (seek to beginning)
-	if _, err := f.Seek(0, 0); err != nil {
-		return "", fmt.Errorf("seek tmp: %w", err)
-	}
-
-	_, err = s.storage.Upload(ctx, objectKey, mimeType, f, size)
-	if err != nil {
-		// upload failed
-		return "", fmt.Errorf("minio upload: %w", err)
-	}
-
-	// 3) Create DB records in transaction. Handle potential race (unique hash) gracefully.
-	tx := s.db.Begin()
-
+	// 2) File not found in DB -> create the row and store the content, under
+	// its hash or as chunks. If anything below fails the stored objects stay
+	// unreferenced and the garbage collector reclaims them after the grace period.
 	newFile := db.File{
 		Hash:       hash,
 		ObjectName: objectKey,
 		Size:       size,
 		MimeType:   mimeType,
 		RefCount:   1,
+		Chunked:    s.chunking != nil,
 	}
-
-	// Attempt to create new file row
 	if err := tx.Create(&newFile).Error; err != nil {
-		// If unique constraint violation happened (race), then another process created the file concurrently.
-		// Fall back: find existing and create user_file + increment ref_count.
-		// To detect unique constraint we try to look for existing file by hash.
-		if isUniqueConstraintErr(err) {
-			tx.Rollback()
-			var existing2 db.File
-			if err2 := s.db.Where("hash = ?", hash).First(&existing2).Error; err2 != nil {
-				return "", fmt.Errorf("concurrent create: find existing failed: %w", err2)
-			}
-			// same flow as earlier for existing file
-			tx2 := s.db.Begin()
-			if err := tx2.Model(&existing2).Update("ref_count", gorm.Expr("ref_count + ?", 1)).Error; err != nil {
-				tx2.Rollback()
-				return "", fmt.Errorf("update ref_count (concurrent): %w", err)
-			}
-			uf := db.UserFile{UserID: userID, FileID: existing2.ID, IsOwner: false}
-			if err := tx2.Create(&uf).Error; err != nil {
-				tx2.Rollback()
-				return "", fmt.Errorf("create user_file (concurrent): %w", err)
-			}
-			if err := tx2.Model(&db.User{}).Where("id = ?", userID).Update("used_storage", gorm.Expr("used_storage + ?", existing2.Size)).Error; err != nil {
-				tx2.Rollback()
-				return "", fmt.Errorf("update user storage (concurrent): %w", err)
-			}
-			if err := tx2.Commit().Error; err != nil {
-				return "", err
-			}
-			return existing2.ID.String(), nil
-		}
 		tx.Rollback()
 		return "", fmt.Errorf("create file record: %w", err)
 	}
+	if err := s.storeContent(ctx, tx, &newFile, src); err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("storage upload: %w", err)
+	}
 
 	// create user_file (owner=true)
-	uf := db.UserFile{
-		UserID:  userID,
-		FileID:  newFile.ID,
-		IsOwner: true,
-	}
-	if err := tx.Create(&uf).Error; err != nil {
+	link.FileID = newFile.ID
+	link.IsOwner = true
+	if err := tx.Create(&link).Error; err != nil {
 		tx.Rollback()
 		return "", fmt.Errorf("create user_file: %w", err)
 	}
@@ -169,6 +272,60 @@ func (s *FileService) ProcessUpload(ctx context.Context, userID uuid.UUID, filen
 	return newFile.ID.String(), nil
 }
 
+// storeContent writes the content of a new file row, as one object or as chunks
+func (s *FileService) storeContent(ctx context.Context, tx *gorm.DB, file *db.File, src contentSource) error {
+	if !file.Chunked && src.copyTo != nil {
+		return src.copyTo(file.ObjectName)
+	}
+	if file.Chunked {
+		return s.storeChunks(ctx, tx, file, src)
+	}
+	r, err := src.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return s.storage.Put(ctx, file.ObjectName, file.MimeType, r, file.Size)
+}
+
+// linkExisting gives the user a reference to already stored content:
+// user_file row (from the link template) + ref_count and used_storage bumps.
+// No-op if already linked. Caller must hold the object lock in tx.
+func linkExisting(tx *gorm.DB, link db.UserFile, file *db.File) error {
+	var userFile db.UserFile
+	err := tx.Where("user_id = ? AND file_id = ?", link.UserID, file.ID).First(&userFile).Error
+	if err == nil {
+		// user already has this file linked — nothing to do
+		return nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("find user_file: %w", err)
+	}
+	link.IsOwner = false
+	return addLink(tx, &link, file)
+}
+
+// addLink creates the user_file row and bumps ref_count and used_storage,
+// whether or not the user holds the file already. Caller must hold the object lock in tx.
+func addLink(tx *gorm.DB, link *db.UserFile, file *db.File) error {
+	if err := tx.Model(file).Update("ref_count", gorm.Expr("ref_count + ?", 1)).Error; err != nil {
+		return fmt.Errorf("update ref_count: %w", err)
+	}
+	link.FileID = file.ID
+	if err := tx.Create(link).Error; err != nil {
+		return fmt.Errorf("create user_file: %w", err)
+	}
+	// increase user's used storage
+	if err := tx.Model(&db.User{}).Where("id = ?", link.UserID).Update("used_storage", gorm.Expr("used_storage + ?", file.Size)).Error; err != nil {
+		return fmt.Errorf("update user storage: %w", err)
+	}
+	return nil
+}
+
+// lockObject takes a transaction scoped advisory lock on an object key
+func lockObject(tx *gorm.DB, objectKey string) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", objectKey).Error
+}
+
 // isUniqueConstraintErr tries to detect a unique-violation during insertion.
 // Implemented conservatively: checks common Postgres error signatures.
 func isUniqueConstraintErr(err error) bool {
@@ -183,17 +340,163 @@ func isUniqueConstraintErr(err error) bool {
 	return false
 }
 
-// List all files for user
-func ListUserFiles(userID uuid.UUID) ([]db.UserFile, error) {
+// ErrNoFileAccess is returned when the caller neither holds the file nor has a share for it
+var ErrNoFileAccess = errors.New("file not found or access denied")
+
+// DownloadGrant is what entitles a user to read a file's content
+type DownloadGrant struct {
+	File     db.File
+	UserFile *db.UserFile // set when the user holds the file themselves
+	Share    *db.Share    // set when access comes from someone else's share
+}
+
+// AuthorizeDownload checks the user holds a UserFile for fileID or was shared it as downloader/editor
+func (s *FileService) AuthorizeDownload(user *db.User, fileID uuid.UUID) (*DownloadGrant, error) {
+	var file db.File
+	if err := s.db.First(&file, "id = ?", fileID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoFileAccess
+		}
+		return nil, err
+	}
+
+	var uf db.UserFile
+	err := s.db.Where("user_id = ? AND file_id = ?", user.ID, fileID).First(&uf).Error
+	if err == nil {
+		return &DownloadGrant{File: file, UserFile: &uf}, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	// no own copy -> a usable share to this user that allows downloading.
+	// Public links only work through /s/{token}, and so do password protected shares.
+	var share db.Share
+	err = s.db.Where("file_id = ? AND shared_with_id = ? AND role IN ?", fileID, user.ID, downloaderRoles).
+		Where("password_hash = '' AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", time.Now()).
+		Where("max_downloads IS NULL OR downloads < max_downloads").
+		First(&share).Error
+	if err == nil {
+		return &DownloadGrant{File: file, Share: &share}, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return nil, ErrNoFileAccess
+}
+
+// RecordDownload bumps the download counter of whatever granted access
+func (s *FileService) RecordDownload(g *DownloadGrant) error {
+	if g.UserFile != nil {
+		return s.db.Model(&db.UserFile{}).Where("id = ?", g.UserFile.ID).
+			Update("downloads", gorm.Expr("downloads + 1")).Error
+	}
+	if g.Share != nil {
+		return consumeShareDownload(s.db, g.Share.ID)
+	}
+	return nil
+}
+
+// OpenRange streams length bytes of the file content starting at offset (length -1 = till the end)
+func (s *FileService) OpenRange(ctx context.Context, file *db.File, offset, length int64) (io.ReadCloser, error) {
+	if file.Chunked {
+		return s.openChunks(ctx, file, offset, length)
+	}
+	return s.storage.GetRange(ctx, file.ObjectName, offset, length)
+}
+
+// List all files for user, optionally with the entries others shared with them
+// (those keep the owner's user_id)
+func ListUserFiles(userID uuid.UUID, includeShared bool) ([]db.UserFile, error) {
 	var userFiles []db.UserFile
-	err := db.DB.Preload("File").Where("user_id = ?", userID).Find(&userFiles).Error
+	q := db.DB.Preload("File")
+	if includeShared {
+		q = q.Where("user_id = ? OR "+shareGrant, userID, userID, time.Now(), viewerRoles)
+	} else {
+		q = q.Where("user_id = ?", userID)
+	}
+	err := q.Find(&userFiles).Error
 	return userFiles, err
 }
 
+// ErrInvalidFileName is returned for empty names or names containing a path separator
+var ErrInvalidFileName = errors.New("invalid file name")
+
+// cleanFileName keeps only the last path element of a client supplied name
+func cleanFileName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return "untitled"
+	}
+	return name
+}
+
+// UpdateUserFile renames a user's file and/or changes its description (nil = leave as is)
+// Editors of a share edit the owner's entry.
+func (s *FileService) UpdateUserFile(userID, fileID uuid.UUID, name, description *string) (*db.UserFile, error) {
+	var uf db.UserFile
+	err := s.db.Where("user_id = ? AND file_id = ?", userID, fileID).First(&uf).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = s.db.Where("file_id = ?", fileID).Where(shareGrant, userID, time.Now(), editorRoles).First(&uf).Error
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoFileAccess
+		}
+		return nil, err
+	}
+
+	updates := map[string]interface{}{}
+	if name != nil {
+		n := strings.TrimSpace(*name)
+		if n == "" || len(n) > 255 || strings.ContainsAny(n, "/\\") {
+			return nil, ErrInvalidFileName
+		}
+		updates["file_name"] = n
+	}
+	if description != nil {
+		updates["description"] = *description
+	}
+	if len(updates) > 0 {
+		if err := s.db.Model(&uf).Updates(updates).Error; err != nil {
+			return nil, err
+		}
+	}
+	if err := s.db.Preload("File").First(&uf, "id = ?", uf.ID).Error; err != nil {
+		return nil, err
+	}
+	return &uf, nil
+}
+
+// MoveUserFile places the user's file into folderID (nil = root)
+func (s *FileService) MoveUserFile(userID, fileID uuid.UUID, folderID *uuid.UUID) (*db.UserFile, error) {
+	var uf db.UserFile
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := useFolder(tx, userID, folderID); err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND file_id = ?", userID, fileID).First(&uf).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNoFileAccess
+			}
+			return err
+		}
+		return tx.Model(&uf).Update("folder_id", folderID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	uf.FolderID = folderID
+	return &uf, nil
+}
+
 // Delete a user's file reference
-func DeleteUserFile(userID uuid.UUID, fileID uuid.UUID) error {
+func (s *FileService) DeleteUserFile(ctx context.Context, userID uuid.UUID, fileID uuid.UUID) error {
+	// a user may hold the same content under several names, the newest entry goes first
 	var userFile db.UserFile
-	err := db.DB.Where("user_id = ? AND file_id = ?", userID, fileID).First(&userFile).Error
+	err := s.db.Where("user_id = ? AND file_id = ?", userID, fileID).Order("created_at DESC").First(&userFile).Error
 	if err != nil {
 		return errors.New("file not found or not owned")
 	}
@@ -203,27 +506,177 @@ func DeleteUserFile(userID uuid.UUID, fileID uuid.UUID) error {
 		return errors.New("not allowed only owner can delete")
 	}
 
+	return s.releaseUserFile(ctx, &userFile)
+}
+
+// releaseUserFile drops one user's reference to a file through the ref count path.
+// When the last reference goes the file row is deleted and the object removed from storage.
+func (s *FileService) releaseUserFile(ctx context.Context, userFile *db.UserFile) error {
+	var file db.File
+	if err := s.db.First(&file, "id = ?", userFile.FileID).Error; err != nil {
+		return err
+	}
+
+	tx := s.db.Begin()
+	if err := lockObject(tx, file.ObjectName); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("lock content: %w", err)
+	}
+
 	//Delete the reference
-	err = db.DB.Delete(&userFile).Error
-	if err != nil {
+	res := tx.Delete(userFile)
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		// released concurrently, nothing left to do
+		tx.Rollback()
+		return nil
+	}
+
+	// shares the user made for this file go with their last entry of it
+	var others int64
+	if err := tx.Model(&db.UserFile{}).Where("user_id = ? AND file_id = ?", userFile.UserID, file.ID).Count(&others).Error; err != nil {
+		tx.Rollback()
 		return err
 	}
+	if others == 0 {
+		if err := tx.Where("user_id = ? AND file_id = ?", userFile.UserID, file.ID).Delete(&db.Share{}).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("delete shares: %w", err)
+		}
+	}
+	if err := tx.Model(&db.User{}).Where("id = ?", userFile.UserID).
+		Update("used_storage", gorm.Expr("GREATEST(used_storage - ?, 0)", file.Size)).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("update user storage: %w", err)
+	}
 
-	//Decrement the ref count
-	var file db.File
-	if err := db.DB.First(&file, "id = ?", fileID).Error; err != nil {
+	//Decrement the ref count (safe to read back, we hold the object lock)
+	if err := tx.Model(&file).Update("ref_count", gorm.Expr("ref_count - 1")).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("update ref_count: %w", err)
+	}
+	if err := tx.Select("ref_count").First(&file, "id = ?", file.ID).Error; err != nil {
+		tx.Rollback()
 		return err
 	}
 
-	file.RefCount -= 1
+	purge := false
 	if file.RefCount <= 0 {
-		//Delete the file record and miniIO object
-		if err := db.DB.Delete(&file).Error; err != nil {
+		if err := tx.Where("file_id = ?", file.ID).Delete(&db.Share{}).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("delete shares: %w", err)
+		}
+		if err := releaseChunks(tx, &file); err != nil {
+			tx.Rollback()
 			return err
 		}
-		// Later --- todo --- minioDeletion storage.DeleteObject on  file.ObjectName
-	} else {
-		db.DB.Save(&file)
+		if err := tx.Delete(&file).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		purge = true
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	if purge && !file.Chunked {
+		// a failure here only leaves an orphan object behind, the GC retries it
+		if _, err := s.purgeObject(ctx, file.ObjectName); err != nil {
+			log.Printf("delete object %s: %v", file.ObjectName, err)
+		}
 	}
 	return nil
 }
+
+// transferUserFile hands one user's reference to a file over to another user,
+// placing it in folderID when it sits in the root. If the recipient already has
+// the content the reference is released instead, so the ref count stays right.
+func (s *FileService) transferUserFile(ctx context.Context, userFile *db.UserFile, toUserID uuid.UUID, folderID *uuid.UUID) error {
+	var file db.File
+	if err := s.db.First(&file, "id = ?", userFile.FileID).Error; err != nil {
+		return err
+	}
+
+	tx := s.db.Begin()
+	if err := lockObject(tx, file.ObjectName); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("lock content: %w", err)
+	}
+	var linked int64
+	if err := tx.Model(&db.UserFile{}).Where("user_id = ? AND file_id = ?", toUserID, file.ID).Count(&linked).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if linked > 0 {
+		tx.Rollback()
+		return s.releaseUserFile(ctx, userFile)
+	}
+
+	// the recipient's quota applies as to anything else they store: a transfer
+	// that doesn't fit fails, and goes on once the quota was raised
+	var recipient db.User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "used_storage", "quota").
+		First(&recipient, "id = ?", toUserID).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if recipient.UsedStorage+file.Size > recipient.Quota {
+		tx.Rollback()
+		return fmt.Errorf("%w: recipient uses %d of %d bytes, the file needs %d more",
+			ErrQuotaExceeded, recipient.UsedStorage, recipient.Quota, file.Size)
+	}
+
+	if userFile.FolderID != nil {
+		folderID = userFile.FolderID
+	}
+	res := tx.Model(&db.UserFile{}).Where("id = ? AND user_id = ?", userFile.ID, userFile.UserID).
+		Updates(map[string]interface{}{"user_id": toUserID, "folder_id": folderID})
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		// moved or released concurrently
+		tx.Rollback()
+		return nil
+	}
+	if err := tx.Model(&db.User{}).Where("id = ?", userFile.UserID).
+		Update("used_storage", gorm.Expr("GREATEST(used_storage - ?, 0)", file.Size)).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("update user storage: %w", err)
+	}
+	if err := tx.Model(&db.User{}).Where("id = ?", toUserID).
+		Update("used_storage", gorm.Expr("used_storage + ?", file.Size)).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("update user storage: %w", err)
+	}
+	return tx.Commit().Error
+}
+
+// purgeObject removes an object from storage unless a file row references it again.
+// The check runs under the object lock so it can't race an upload re-creating the content.
+func (s *FileService) purgeObject(ctx context.Context, objectKey string) (bool, error) {
+	tx := s.db.Begin()
+	if err := lockObject(tx, objectKey); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	var refs int64
+	if err := tx.Model(&db.File{}).Where("object_name = ? AND NOT chunked", objectKey).Count(&refs).Error; err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if refs > 0 {
+		tx.Rollback()
+		return false, nil
+	}
+	if err := s.storage.Delete(ctx, objectKey); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit().Error
+}
@@ -1,27 +1,89 @@
 package services
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
 	"backend/internal/db"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
+// ErrFolderNotFound covers both missing folders and folders owned by someone else
+var ErrFolderNotFound = errors.New("folder not found")
+
+// ErrInvalidFolderName is returned for empty names or names containing a path separator
+var ErrInvalidFolderName = errors.New("invalid folder name")
+
+// ErrFolderCycle is returned when moving a folder below itself
+var ErrFolderCycle = errors.New("cannot move a folder into itself or one of its subfolders")
+
+// ErrPathNotFound is returned when a path doesn't resolve to a folder or file
+var ErrPathNotFound = errors.New("path not found")
+
 type FolderService struct {
-	db *gorm.DB
+	db    *gorm.DB
+	files *FileService // releases contained files on recursive delete
+}
+
+func NewFolderService(dbConn *gorm.DB, fs *FileService) *FolderService {
+	return &FolderService{db: dbConn, files: fs}
+}
+
+// checkFolder verifies folderID (when set) exists and belongs to ownerID
+func checkFolder(dbConn *gorm.DB, ownerID uuid.UUID, folderID *uuid.UUID) error {
+	if folderID == nil {
+		return nil
+	}
+	var count int64
+	if err := dbConn.Model(&db.Folder{}).Where("id = ? AND owner_id = ?", *folderID, ownerID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrFolderNotFound
+	}
+	return nil
 }
 
-func NewFolderService(dbConn *gorm.DB) *FolderService {
-	return &FolderService{db: dbConn}
+// folderLock names the advisory lock over one owner's folder tree
+func folderLock(ownerID uuid.UUID) string {
+	return "folders:" + ownerID.String()
+}
+
+// useFolder makes sure folderID (when set) still exists and stays until tx ends:
+// it takes the owner's folder lock shared, DeleteFolder and MoveFolder take it
+// exclusively. Take it before any object lock, DeleteFolder takes object locks
+// while holding it.
+func useFolder(tx *gorm.DB, ownerID uuid.UUID, folderID *uuid.UUID) error {
+	if folderID == nil {
+		return nil
+	}
+	if err := tx.Exec("SELECT pg_advisory_xact_lock_shared(hashtext(?))", folderLock(ownerID)).Error; err != nil {
+		return fmt.Errorf("lock folders: %w", err)
+	}
+	return checkFolder(tx, ownerID, folderID)
 }
 
 func (s *FolderService) CreateFolder(ownerID uuid.UUID, name string, parentID *uuid.UUID) (*db.Folder, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 255 || strings.ContainsAny(name, "/\\") {
+		return nil, ErrInvalidFolderName
+	}
 	f := &db.Folder{
 		Name:     name,
 		ParentID: parentID,
 		OwnerID:  ownerID,
 	}
-	if err := s.db.Create(f).Error; err != nil {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := useFolder(tx, ownerID, parentID); err != nil {
+			return err
+		}
+		return tx.Create(f).Error
+	})
+	if err != nil {
 		return nil, err
 	}
 	return f, nil
@@ -35,15 +97,277 @@ func (s *FolderService) ListUserFolders(ownerID uuid.UUID, parentID *uuid.UUID)
 	} else {
 		q = q.Where("parent_id IS NULL")
 	}
-	err := q.Find(&folders).Error
+	err := q.Order("name").Find(&folders).Error
 	return folders, err
 }
 
-func (s *FolderService) DeleteFolder(ownerID, folderID uuid.UUID) error {
-	// Only owner can delete
+// FolderContents is one level of a folder: its subfolders and the user's files in it
+type FolderContents struct {
+	Folder  *db.Folder    `json:"folder"` // nil for the root
+	Folders []db.Folder   `json:"folders"`
+	Files   []db.UserFile `json:"files"`
+}
+
+// ListContents lists subfolders and files directly inside folderID (nil = root)
+func (s *FolderService) ListContents(ownerID uuid.UUID, folderID *uuid.UUID) (*FolderContents, error) {
+	out := &FolderContents{}
+	if folderID != nil {
+		var folder db.Folder
+		if err := s.db.First(&folder, "id = ? AND owner_id = ?", *folderID, ownerID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrFolderNotFound
+			}
+			return nil, err
+		}
+		out.Folder = &folder
+	}
+
+	folders, err := s.ListUserFolders(ownerID, folderID)
+	if err != nil {
+		return nil, err
+	}
+	out.Folders = folders
+
+	q := s.db.Preload("File").Where("user_id = ?", ownerID)
+	if folderID != nil {
+		q = q.Where("folder_id = ?", *folderID)
+	} else {
+		q = q.Where("folder_id IS NULL")
+	}
+	if err := q.Order("file_name").Find(&out.Files).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteFolder removes a folder with all its subfolders. Every file inside is
+// released through the ref count path so shared content survives and the rest is freed.
+// The owner's folder lock is held throughout, so nothing can be uploaded or
+// moved into the subtree while it goes.
+func (s *FolderService) DeleteFolder(ctx context.Context, ownerID, folderID uuid.UUID) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockObject(tx, folderLock(ownerID)); err != nil {
+			return fmt.Errorf("lock folders: %w", err)
+		}
+		// Only owner can delete
+		var folder db.Folder
+		if err := tx.First(&folder, "id = ? AND owner_id = ?", folderID, ownerID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrFolderNotFound
+			}
+			return err
+		}
+
+		var ids []uuid.UUID
+		err := tx.Raw(`WITH RECURSIVE tree AS (
+				SELECT id FROM folders WHERE id = ?
+				UNION ALL
+				SELECT f.id FROM folders f JOIN tree t ON f.parent_id = t.id
+			) SELECT id FROM tree`, folderID).Scan(&ids).Error
+		if err != nil {
+			return fmt.Errorf("collect subfolders: %w", err)
+		}
+
+		var userFiles []db.UserFile
+		if err := tx.Where("folder_id IN ?", ids).Find(&userFiles).Error; err != nil {
+			return err
+		}
+		for i := range userFiles {
+			// each release commits on its own; on failure the folders stay, so
+			// retrying the delete picks up where we stopped
+			if err := s.files.releaseUserFile(ctx, &userFiles[i]); err != nil {
+				return fmt.Errorf("release file %s: %w", userFiles[i].FileID, err)
+			}
+		}
+
+		// single statement, the parent_id references are checked once at the end
+		return tx.Where("id IN ? AND owner_id = ?", ids, ownerID).Delete(&db.Folder{}).Error
+	})
+}
+
+// MoveFolder re-parents a folder (newParentID nil = root), refusing to create cycles
+func (s *FolderService) MoveFolder(ownerID, folderID uuid.UUID, newParentID *uuid.UUID) (*db.Folder, error) {
 	var folder db.Folder
-	if err := s.db.First(&folder, "id = ? AND owner_id = ?", folderID, ownerID).Error; err != nil {
-		return err
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// serialise tree changes per owner so two concurrent moves can't build a loop
+		if err := lockObject(tx, folderLock(ownerID)); err != nil {
+			return err
+		}
+		if err := tx.First(&folder, "id = ? AND owner_id = ?", folderID, ownerID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrFolderNotFound
+			}
+			return err
+		}
+		if newParentID != nil {
+			if err := checkFolder(tx, ownerID, newParentID); err != nil {
+				return err
+			}
+			// walk up from the new parent, finding ourselves means a cycle
+			var ancestors []uuid.UUID
+			err := tx.Raw(`WITH RECURSIVE up AS (
+					SELECT id, parent_id FROM folders WHERE id = ?
+					UNION ALL
+					SELECT f.id, f.parent_id FROM folders f JOIN up ON f.id = up.parent_id
+				) SELECT id FROM up`, *newParentID).Scan(&ancestors).Error
+			if err != nil {
+				return err
+			}
+			for _, id := range ancestors {
+				if id == folderID {
+					return ErrFolderCycle
+				}
+			}
+		}
+		folder.ParentID = newParentID
+		return tx.Model(&folder).Update("parent_id", newParentID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &folder, nil
+}
+
+// TreeFile is a file entry inside a FolderNode
+type TreeFile struct {
+	FileID   uuid.UUID `json:"file_id"`
+	FileName string    `json:"file_name"`
+	Size     int64     `json:"size"`
+	MimeType string    `json:"mime_type"`
+}
+
+// FolderNode is a folder with its nested subfolders, sizes are in bytes
+type FolderNode struct {
+	ID        uuid.UUID     `json:"id"`
+	Name      string        `json:"name"`
+	Files     []TreeFile    `json:"files"`
+	Folders   []*FolderNode `json:"folders"`
+	Size      int64         `json:"size"`       // files directly in this folder
+	TotalSize int64         `json:"total_size"` // including every subfolder
+}
+
+// FolderTree is the whole hierarchy of a user, starting at the root
+type FolderTree struct {
+	Files     []TreeFile    `json:"files"`
+	Folders   []*FolderNode `json:"folders"`
+	TotalSize int64         `json:"total_size"`
+}
+
+// GetTree loads all of the user's folders and files and nests them
+func (s *FolderService) GetTree(ownerID uuid.UUID) (*FolderTree, error) {
+	var folders []db.Folder
+	if err := s.db.Where("owner_id = ?", ownerID).Order("name").Find(&folders).Error; err != nil {
+		return nil, err
+	}
+	var userFiles []db.UserFile
+	if err := s.db.Preload("File").Where("user_id = ?", ownerID).Order("file_name").Find(&userFiles).Error; err != nil {
+		return nil, err
+	}
+
+	tree := &FolderTree{Files: []TreeFile{}, Folders: []*FolderNode{}}
+	nodes := make(map[uuid.UUID]*FolderNode, len(folders))
+	for _, f := range folders {
+		nodes[f.ID] = &FolderNode{ID: f.ID, Name: f.Name, Files: []TreeFile{}, Folders: []*FolderNode{}}
+	}
+	for _, f := range folders {
+		node := nodes[f.ID]
+		if parent, ok := nodes[derefUUID(f.ParentID)]; ok {
+			parent.Folders = append(parent.Folders, node)
+		} else {
+			tree.Folders = append(tree.Folders, node)
+		}
+	}
+	for _, uf := range userFiles {
+		tf := TreeFile{FileID: uf.FileID, FileName: uf.FileName, Size: uf.File.Size, MimeType: uf.File.MimeType}
+		if node, ok := nodes[derefUUID(uf.FolderID)]; ok {
+			node.Files = append(node.Files, tf)
+			node.Size += tf.Size
+		} else {
+			tree.Files = append(tree.Files, tf)
+			tree.TotalSize += tf.Size
+		}
+	}
+	for _, node := range tree.Folders {
+		tree.TotalSize += sumTree(node)
+	}
+	return tree, nil
+}
+
+// sumTree fills TotalSize bottom-up and returns it
+func sumTree(node *FolderNode) int64 {
+	node.TotalSize = node.Size
+	for _, child := range node.Folders {
+		node.TotalSize += sumTree(child)
+	}
+	return node.TotalSize
+}
+
+func derefUUID(id *uuid.UUID) uuid.UUID {
+	if id == nil {
+		return uuid.Nil
+	}
+	return *id
+}
+
+// PathEntry is what a path like /docs/2026/report.pdf points at
+type PathEntry struct {
+	Type string     `json:"type"`         // folder | file
+	ID   *uuid.UUID `json:"id,omitempty"` // folder ID or file ID, nil for the root folder
+	Name string     `json:"name"`
+}
+
+// ResolvePath walks the user's folders by name. The last element may be a
+// folder or a file, folders win if both exist with the same name.
+func (s *FolderService) ResolvePath(ownerID uuid.UUID, path string) (*PathEntry, error) {
+	var parts []string
+	for _, p := range strings.Split(path, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		return &PathEntry{Type: "folder", Name: "/"}, nil
+	}
+
+	var parentID *uuid.UUID
+	for i, name := range parts {
+		var folder db.Folder
+		q := s.db.Where("owner_id = ? AND name = ?", ownerID, name)
+		if parentID != nil {
+			q = q.Where("parent_id = ?", *parentID)
+		} else {
+			q = q.Where("parent_id IS NULL")
+		}
+		err := q.Order("created_at").First(&folder).Error
+		if err == nil {
+			parentID = &folder.ID
+			if i == len(parts)-1 {
+				return &PathEntry{Type: "folder", ID: &folder.ID, Name: folder.Name}, nil
+			}
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if i < len(parts)-1 {
+			return nil, ErrPathNotFound
+		}
+
+		// last element: maybe a file
+		var uf db.UserFile
+		q = s.db.Where("user_id = ? AND file_name = ?", ownerID, name)
+		if parentID != nil {
+			q = q.Where("folder_id = ?", *parentID)
+		} else {
+			q = q.Where("folder_id IS NULL")
+		}
+		if err := q.Order("created_at").First(&uf).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrPathNotFound
+			}
+			return nil, err
+		}
+		return &PathEntry{Type: "file", ID: &uf.FileID, Name: uf.FileName}, nil
 	}
-	return s.db.Delete(&folder).Error
+	return nil, ErrPathNotFound
 }
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/internal/db"
+)
+
+// GCReport summarises one garbage collection pass
+type GCReport struct {
+	StartedAt      time.Time `json:"started_at"`
+	Duration       string    `json:"duration"`
+	ObjectsScanned int       `json:"objects_scanned"`
+	OrphansFound   int       `json:"orphans_found"`   // objects no file row references
+	ObjectsDeleted int       `json:"objects_deleted"` // orphans past the grace period that were removed
+	BytesReclaimed int64     `json:"bytes_reclaimed"`
+	RowsDeleted    int       `json:"rows_deleted"`    // file rows nobody references anymore
+	ChunksDeleted  int       `json:"chunks_deleted"`  // chunks no chunked file uses anymore
+	MissingObjects []string  `json:"missing_objects"` // file rows whose object is gone from storage
+	Errors         []string  `json:"errors,omitempty"`
+}
+
+// GarbageCollector reconciles the files table against the storage bucket
+type GarbageCollector struct {
+	fs    *FileService
+	grace time.Duration
+
+	mu   sync.Mutex // one pass at a time
+	last *GCReport
+}
+
+// NewGarbageCollector: objects younger than grace are never touched, that
+// covers uploads that stored their object but haven't committed the file row yet.
+func NewGarbageCollector(fs *FileService, grace time.Duration) *GarbageCollector {
+	return &GarbageCollector{fs: fs, grace: grace}
+}
+
+// Start runs a pass every interval until ctx is cancelled
+func (gc *GarbageCollector) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report, err := gc.Run(ctx)
+				if err != nil {
+					log.Printf("gc: %v", err)
+					continue
+				}
+				log.Printf("gc: scanned %d objects, deleted %d objects and %d chunks (%d bytes), removed %d file rows, %d missing objects",
+					report.ObjectsScanned, report.ObjectsDeleted, report.ChunksDeleted, report.BytesReclaimed, report.RowsDeleted, len(report.MissingObjects))
+			}
+		}
+	}()
+}
+
+// LastReport returns the result of the most recent pass (nil before the first one)
+func (gc *GarbageCollector) LastReport() *GCReport {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.last
+}
+
+// Run does one reconciliation pass
+func (gc *GarbageCollector) Run(ctx context.Context) (*GCReport, error) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	report := &GCReport{StartedAt: time.Now(), MissingObjects: []string{}}
+	cutoff := report.StartedAt.Add(-gc.grace)
+
+	// 1) file rows without any user reference (left over by crashed deletes)
+	var dead []db.File
+	err := gc.fs.db.Where("created_at < ? AND NOT EXISTS (SELECT 1 FROM user_files uf WHERE uf.file_id = files.id)", cutoff).
+		Find(&dead).Error
+	if err != nil {
+		return nil, fmt.Errorf("find unreferenced files: %w", err)
+	}
+	for i := range dead {
+		removed, err := gc.deleteDeadFile(&dead[i])
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("file %s: %v", dead[i].ID, err))
+		} else if removed {
+			report.RowsDeleted++
+		}
+	}
+
+	// 2) chunks whose ref count dropped to 0
+	var unused []db.Chunk
+	if err := gc.fs.db.Where("ref_count <= 0").Find(&unused).Error; err != nil {
+		return nil, fmt.Errorf("find unused chunks: %w", err)
+	}
+	for i := range unused {
+		removed, err := gc.fs.deleteChunk(ctx, &unused[i])
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("chunk %s: %v", unused[i].Hash, err))
+		} else if removed {
+			report.ChunksDeleted++
+			report.BytesReclaimed += unused[i].Size
+		}
+	}
+
+	// 3) objects vs rows
+	objects, err := gc.fs.storage.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("list objects: %w", err)
+	}
+	var keys []string
+	if err := gc.fs.db.Model(&db.File{}).Where("NOT chunked").Pluck("object_name", &keys).Error; err != nil {
+		return nil, fmt.Errorf("list file rows: %w", err)
+	}
+	var chunkHashes []string
+	if err := gc.fs.db.Model(&db.Chunk{}).Pluck("hash", &chunkHashes).Error; err != nil {
+		return nil, fmt.Errorf("list chunk rows: %w", err)
+	}
+	for _, h := range chunkHashes {
+		keys = append(keys, ChunkPrefix+h)
+	}
+	referenced := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		referenced[k] = true
+	}
+
+	stored := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		if strings.HasPrefix(obj.Key, UploadPrefix) {
+			continue // chunks of unfinished uploads, the upload service cleans those
+		}
+		report.ObjectsScanned++
+		stored[obj.Key] = true
+		if referenced[obj.Key] {
+			continue
+		}
+		report.OrphansFound++
+		if obj.LastModified.After(cutoff) {
+			continue
+		}
+		var deleted bool
+		if hash, ok := strings.CutPrefix(obj.Key, ChunkPrefix); ok {
+			deleted, err = gc.fs.purgeChunkObject(ctx, hash)
+		} else {
+			deleted, err = gc.fs.purgeObject(ctx, obj.Key)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("object %s: %v", obj.Key, err))
+			continue
+		}
+		if deleted {
+			report.ObjectsDeleted++
+			report.BytesReclaimed += obj.Size
+		}
+	}
+	for _, k := range keys {
+		if !stored[k] {
+			report.MissingObjects = append(report.MissingObjects, k)
+		}
+	}
+
+	report.Duration = time.Since(report.StartedAt).String()
+	gc.last = report
+	return report, nil
+}
+
+// deleteDeadFile removes a file row that still has no user reference once we hold its lock.
+// The object itself is picked up as an orphan by the same or the next pass.
+func (gc *GarbageCollector) deleteDeadFile(file *db.File) (bool, error) {
+	tx := gc.fs.db.Begin()
+	if err := lockObject(tx, file.ObjectName); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	var refs int64
+	if err := tx.Model(&db.UserFile{}).Where("file_id = ?", file.ID).Count(&refs).Error; err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if refs > 0 {
+		// re-linked by an upload since we looked
+		tx.Rollback()
+		return false, nil
+	}
+	if err := tx.Where("file_id = ?", file.ID).Delete(&db.Share{}).Error; err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := releaseChunks(tx, file); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := tx.Delete(file).Error; err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit().Error
+}
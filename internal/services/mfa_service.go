@@ -0,0 +1,293 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"backend/internal/db"
+	"backend/internal/rbac"
+	"backend/internal/totp"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnrolled    = errors.New("no pending two-factor enrollment")
+	ErrMFANotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrMFAInvalidCode    = errors.New("invalid two-factor code")
+	ErrMFAAdminRequired  = errors.New("admin and staff accounts can't disable two-factor authentication")
+	ErrMFAChallenge      = errors.New("invalid or expired mfa token")
+)
+
+// accepted clock drift, in 30 second steps either way
+const totpSkew = 1
+
+const recoveryCodeCount = 10
+
+// prefix of secrets encrypted with the configured key
+const sealedSecretPrefix = "v1:"
+
+// MFAService manages TOTP enrollment and the second step of login
+type MFAService struct {
+	db     *gorm.DB
+	auth   *AuthService
+	issuer string      // shown in authenticator apps
+	aead   cipher.AEAD // encrypts TOTP secrets at rest, nil stores them as is
+}
+
+// NewMFAService: TOTP secrets are encrypted with AES-GCM under a key derived
+// from encryptionKey. With an empty key they are stored unencrypted.
+func NewMFAService(dbConn *gorm.DB, auth *AuthService, issuer, encryptionKey string) (*MFAService, error) {
+	s := &MFAService{db: dbConn, auth: auth, issuer: issuer}
+	if encryptionKey != "" {
+		key := sha256.Sum256([]byte(encryptionKey))
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		if s.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// TOTPEnrollment is shown once so the user can add the account to an authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"` // render as QR code
+}
+
+// Enroll starts (or restarts) TOTP enrollment. The factor is not required
+// until Activate confirms the user's app produces valid codes.
+func (s *MFAService) Enroll(user *db.User) (*TOTPEnrollment, error) {
+	if user.TOTPEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.seal(secret)
+	if err != nil {
+		return nil, err
+	}
+	res := s.db.Model(&db.User{}).Where("id = ? AND totp_enabled = false", user.ID).
+		Updates(map[string]interface{}{"totp_secret": sealed, "totp_last_step": 0})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	return &TOTPEnrollment{Secret: secret, URI: totp.URI(s.issuer, user.Username, secret)}, nil
+}
+
+// Activate confirms enrollment with a code from the app and returns the
+// recovery codes. The current session counts as verified with the second factor.
+func (s *MFAService) Activate(user *db.User, sessionID uuid.UUID, code string) ([]string, error) {
+	var fresh db.User
+	if err := s.db.First(&fresh, "id = ?", user.ID).Error; err != nil {
+		return nil, err
+	}
+	if fresh.TOTPEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if fresh.TOTPSecret == "" {
+		return nil, ErrMFANotEnrolled
+	}
+	if err := s.checkTOTP(&fresh, code); err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&db.User{}).Where("id = ?", user.ID).Update("totp_enabled", true).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&db.Session{}).Where("id = ? AND user_id = ?", sessionID, user.ID).Update("mfa_verified", true).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Disable removes the second factor after checking a current code. Staff must keep it.
+func (s *MFAService) Disable(user *db.User, code string) error {
+	if rbac.IsStaff(user) {
+		return ErrMFAAdminRequired
+	}
+	if err := s.verify(user, code); err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&db.User{}).Where("id = ?", user.ID).
+			Updates(map[string]interface{}{"totp_enabled": false, "totp_secret": "", "totp_last_step": 0}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&db.RecoveryCode{}).Error
+	})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a current code
+func (s *MFAService) RegenerateRecoveryCodes(user *db.User, code string) ([]string, error) {
+	if err := s.verify(user, code); err != nil {
+		return nil, err
+	}
+	var codes []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	return codes, err
+}
+
+// CompleteLogin finishes a login that returned an MFA token, with either a
+// TOTP code or a recovery code, and starts an MFA verified session
+func (s *MFAService) CompleteLogin(mfaToken, code string) (*AuthTokens, *db.User, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(mfaToken, claims, s.auth.keys.Keyfunc,
+		jwt.WithValidMethods(s.auth.keys.Methods()), jwt.WithAudience(mfaChallengeAudience), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, nil, ErrMFAChallenge
+	}
+	var user db.User
+	if err := s.db.First(&user, "id = ?", claims.Subject).Error; err != nil {
+		return nil, nil, ErrMFAChallenge
+	}
+	if user.SuspendedAt != nil {
+		return nil, nil, ErrAccountSuspended
+	}
+	if err := s.verify(&user, code); err != nil {
+		return nil, nil, err
+	}
+	tokens, err := s.auth.newSession(&user, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tokens, &user, nil
+}
+
+// verify accepts a TOTP code or, failing that, an unused recovery code
+func (s *MFAService) verify(user *db.User, code string) error {
+	var fresh db.User
+	if err := s.db.First(&fresh, "id = ?", user.ID).Error; err != nil {
+		return err
+	}
+	if !fresh.TOTPEnabled {
+		return ErrMFANotEnabled
+	}
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits {
+		return s.checkTOTP(&fresh, code)
+	}
+	res := s.db.Model(&db.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrMFAInvalidCode
+	}
+	return nil
+}
+
+// checkTOTP validates code against the user's secret and burns its time step
+func (s *MFAService) checkTOTP(user *db.User, code string) error {
+	secret, err := s.open(user.TOTPSecret)
+	if err != nil {
+		return err
+	}
+	step, ok := totp.Validate(secret, code, time.Now(), totpSkew)
+	if !ok {
+		return ErrMFAInvalidCode
+	}
+	// conditional update: a code (or an older one) that was already accepted is refused
+	res := s.db.Model(&db.User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).Update("totp_last_step", step)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrMFAInvalidCode
+	}
+	return nil
+}
+
+func (s *MFAService) seal(secret string) (string, error) {
+	if s.aead == nil {
+		return secret, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(secret), nil)
+	return sealedSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *MFAService) open(stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealedSecretPrefix) {
+		return stored, nil
+	}
+	if s.aead == nil {
+		return "", errors.New("totp secret is encrypted but no MFA_ENCRYPTION_KEY is configured")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedSecretPrefix))
+	if err != nil || len(raw) < s.aead.NonceSize() {
+		return "", errors.New("corrupt totp secret")
+	}
+	plain, err := s.aead.Open(nil, raw[:s.aead.NonceSize()], raw[s.aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("totp secret can't be decrypted, wrong MFA_ENCRYPTION_KEY?")
+	}
+	return string(plain), nil
+}
+
+// replaceRecoveryCodes drops the user's codes and stores fresh ones, returned in plain text once
+func replaceRecoveryCodes(tx *gorm.DB, userID uuid.UUID) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&db.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]db.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		c := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+		codes[i] = c[:5] + "-" + c[5:]
+		rows[i] = db.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(codes[i])}
+	}
+	if err := tx.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// recovery codes are random, a sha256 of the normalised code is enough
+func hashRecoveryCode(code string) string {
+	normalised := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalised))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"backend/internal/db"
+	"backend/internal/oidc"
+	"backend/internal/tokens"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrOIDCState         = errors.New("oidc login state missing, expired or mismatched")
+	ErrOIDCEmailRequired = errors.New("identity provider did not supply a verified email")
+)
+
+// how long the user has to finish logging in at the provider
+const oidcLoginTTL = 10 * time.Minute
+
+// audience of the login state token, so it can't pass for anything else
+const oidcStateAudience = "oidc-login-state"
+
+var usernameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// OIDCService logs users in through an external identity provider and
+// issues this server's own tokens for them
+type OIDCService struct {
+	db       *gorm.DB
+	provider *oidc.Provider
+	auth     *AuthService
+	keys     *tokens.KeySet
+}
+
+func NewOIDCService(dbConn *gorm.DB, provider *oidc.Provider, auth *AuthService, keys *tokens.KeySet) *OIDCService {
+	return &OIDCService{db: dbConn, provider: provider, auth: auth, keys: keys}
+}
+
+// oidcLoginState travels in a signed cookie between BeginLogin and CompleteLogin
+type oidcLoginState struct {
+	jwt.RegisteredClaims
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// BeginLogin returns the provider URL to redirect to and the signed state to
+// keep in a cookie until the callback
+func (s *OIDCService) BeginLogin(ctx context.Context) (redirectURL, state string, err error) {
+	st := oidcLoginState{}
+	for _, v := range []*string{&st.State, &st.Nonce, &st.Verifier} {
+		if *v, err = oidc.RandomString(32); err != nil {
+			return "", "", err
+		}
+	}
+	redirectURL, err = s.provider.AuthCodeURL(ctx, st.State, st.Nonce, st.Verifier)
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	st.RegisteredClaims = jwt.RegisteredClaims{
+		Audience:  jwt.ClaimStrings{oidcStateAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(oidcLoginTTL)),
+	}
+	signed, err := s.keys.Sign(st)
+	if err != nil {
+		return "", "", err
+	}
+	return redirectURL, signed, nil
+}
+
+// CompleteLogin handles the provider callback: checks state, exchanges the
+// code, validates the ID token and logs in the linked (or new) user.
+// Accounts with a second factor still have to complete it.
+func (s *OIDCService) CompleteLogin(ctx context.Context, code, state, signedState string) (*AuthTokens, *db.User, error) {
+	var st oidcLoginState
+	_, err := jwt.ParseWithClaims(signedState, &st, s.keys.Keyfunc,
+		jwt.WithValidMethods(s.keys.Methods()), jwt.WithAudience(oidcStateAudience), jwt.WithExpirationRequired())
+	if err != nil || state == "" || st.State != state {
+		return nil, nil, ErrOIDCState
+	}
+
+	rawIDToken, err := s.provider.Exchange(ctx, code, st.Verifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	claims, err := s.provider.VerifyIDToken(ctx, rawIDToken, st.Nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := s.linkUser(claims)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokens, err := s.auth.startLogin(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tokens, user, nil
+}
+
+// linkUser finds the user linked to the provider account. On first login it
+// links the local user with the same (verified) email, or provisions a new one.
+func (s *OIDCService) linkUser(claims *oidc.Claims) (*db.User, error) {
+	issuer := s.provider.Issuer()
+	var user db.User
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var identity db.UserIdentity
+		err := tx.Where("issuer = ? AND subject = ?", issuer, claims.Subject).First(&identity).Error
+		if err == nil {
+			return tx.First(&user, "id = ?", identity.UserID).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		email := strings.ToLower(strings.TrimSpace(claims.Email))
+		if email == "" || !claims.EmailVerified {
+			return ErrOIDCEmailRequired
+		}
+		err = tx.Where("LOWER(email) = ?", email).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			username, err := s.freeUsername(tx, claims.PreferredUsername, email)
+			if err != nil {
+				return err
+			}
+			// no password: this account logs in through the provider only
+			user = db.User{Username: username, Email: email}
+			err = tx.Create(&user).Error
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Create(&db.UserIdentity{UserID: user.ID, Issuer: issuer, Subject: claims.Subject}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// freeUsername derives an unused username from the provider's preferred
+// username or the email's local part
+func (s *OIDCService) freeUsername(tx *gorm.DB, preferred, email string) (string, error) {
+	base := preferred
+	if base == "" {
+		base, _, _ = strings.Cut(email, "@")
+	}
+	base = usernameInvalidChars.ReplaceAllString(base, "")
+	if len(base) > 24 {
+		base = base[:24]
+	}
+	for len(base) < 3 {
+		base += "_"
+	}
+
+	candidate := base
+	for i := 0; i < 5; i++ {
+		var count int64
+		if err := tx.Model(&db.User{}).Where("username = ?", candidate).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+		suffix, err := oidc.RandomString(3)
+		if err != nil {
+			return "", err
+		}
+		candidate = base + "-" + strings.ToLower(usernameInvalidChars.ReplaceAllString(suffix, ""))
+	}
+	return "", fmt.Errorf("no free username for %q", base)
+}
@@ -1,6 +1,9 @@
 package services
 
 import (
+	"strings"
+	"time"
+
 	"backend/internal/db"
 
 	"github.com/google/uuid"
@@ -15,15 +18,23 @@ func NewSearchService(dbConn *gorm.DB) *SearchService {
 	return &SearchService{db: dbConn}
 }
 
-// Search files by name substring (case-insensitive) for a specific user
-func (s *SearchService) SearchFiles(userID uuid.UUID, query string) ([]db.File, error) {
-	var files []db.File
-	err := s.db.Joins("JOIN user_files uf ON uf.file_id = files.id").
-		Where("uf.user_id = ? AND files.filename ILIKE ?", userID, "%"+query+"%").Find(&files).Error
+// Search files by name, substring match (case-insensitive), over the user's own
+// files and the ones shared with them (under the owner's name)
+func (s *SearchService) SearchFiles(userID uuid.UUID, query string) ([]db.UserFile, error) {
+	var files []db.UserFile
+	err := s.db.Preload("File").
+		Where("file_name ILIKE ?", "%"+escapeLike(query)+"%").
+		Where(s.db.Where("user_id = ?", userID).Or(shareGrant, userID, time.Now(), viewerRoles)).
+		Order("file_name").Find(&files).Error
 
 	return files, err
 }
 
+// escapeLike makes user input match literally inside a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
 // Filter files by mime-type or Size range
 func (s *SearchService) FilterFiles(userID uuid.UUID, mime *string, minSize, maxSize *int64) ([]db.File, error) {
 	q := s.db.Joins("JOIN user_files uf ON uf.file_id = files.id").Where("uf.user_id = ?", userID)
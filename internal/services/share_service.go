@@ -1,14 +1,54 @@
 package services
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"time"
 
 	"backend/internal/db"
 
 	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
+// Share states a caller can run into, each maps to its own API error code
+var (
+	ErrShareNotFound         = errors.New("share not found")
+	ErrShareRevoked          = errors.New("share has been revoked")
+	ErrShareExpired          = errors.New("share has expired")
+	ErrShareExhausted        = errors.New("share download limit reached")
+	ErrSharePasswordRequired = errors.New("share password required")
+	ErrShareBadPassword      = errors.New("invalid share password")
+	ErrInvalidShareOptions   = errors.New("invalid share options")
+	ErrShareTargetNotFound   = errors.New("no user with that username or email")
+)
+
+// Roles of a user-to-user share, each one includes the ones before it
+const (
+	ShareRoleViewer     = "viewer"     // sees the file in listings and search
+	ShareRoleDownloader = "downloader" // + downloads the content
+	ShareRoleEditor     = "editor"     // + renames / describes the file
+)
+
+// shareGrant matches user_files rows that their owner shared with a user through a
+// usable share with one of the given roles. Bind as (userID, time.Now(), roles).
+const shareGrant = `EXISTS (SELECT 1 FROM shares s WHERE s.file_id = user_files.file_id AND s.user_id = user_files.user_id
+	AND s.shared_with_id = ? AND s.revoked_at IS NULL AND (s.expires_at IS NULL OR s.expires_at > ?) AND s.role IN ?)`
+
+// role sets that are at least viewer / downloader / editor
+var (
+	viewerRoles     = []string{ShareRoleViewer, ShareRoleDownloader, ShareRoleEditor}
+	downloaderRoles = []string{ShareRoleDownloader, ShareRoleEditor}
+	editorRoles     = []string{ShareRoleEditor}
+)
+
+func validShareRole(role string) bool {
+	return role == ShareRoleViewer || role == ShareRoleDownloader || role == ShareRoleEditor
+}
+
 type ShareService struct {
 	db *gorm.DB
 }
@@ -17,19 +57,81 @@ func NewShareService(dbConn *gorm.DB) *ShareService {
 	return &ShareService{db: dbConn}
 }
 
-// Create a new Share (public or specified user)
-func (s *ShareService) CreateShare(userID, fileID uuid.UUID, isPublic bool, sharedWith *string) (*db.Share, error) {
+// ShareOptions are the optional limits of a share
+type ShareOptions struct {
+	Role         string // for user shares, defaults to viewer
+	ExpiresAt    *time.Time
+	Password     string // stored as bcrypt hash
+	MaxDownloads *int
+}
+
+// Create a new Share: a public link, or a grant to the user with the given username or email
+func (s *ShareService) CreateShare(userID, fileID uuid.UUID, isPublic bool, sharedWith *string, opts ShareOptions) (*db.Share, error) {
+	if isPublic == (sharedWith != nil) {
+		return nil, fmt.Errorf("%w: share either publicly or with a user", ErrInvalidShareOptions)
+	}
+	role := ShareRoleDownloader // what a public link does
+	if sharedWith != nil {
+		role = opts.Role
+		if role == "" {
+			role = ShareRoleViewer
+		}
+		if !validShareRole(role) {
+			return nil, fmt.Errorf("%w: unknown role %q", ErrInvalidShareOptions, role)
+		}
+		// the recipient downloads through their own session, there's nowhere to send a password
+		if opts.Password != "" {
+			return nil, fmt.Errorf("%w: passwords only apply to public links", ErrInvalidShareOptions)
+		}
+	}
+	if opts.ExpiresAt != nil && !opts.ExpiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("%w: expiry must be in the future", ErrInvalidShareOptions)
+	}
+	if opts.MaxDownloads != nil && *opts.MaxDownloads <= 0 {
+		return nil, fmt.Errorf("%w: max downloads must be positive", ErrInvalidShareOptions)
+	}
+
 	//Verify ownership
 	var uf db.UserFile
 	if err := s.db.Where("user_id = ? AND file_id = ? AND is_owner = true", userID, fileID).First(&uf).Error; err != nil {
 		return nil, errors.New("not allowed only owner have right to share")
 	}
 
+	var recipientID *uuid.UUID
+	if sharedWith != nil {
+		var recipient db.User
+		if err := s.db.Where("username = ? OR email = ?", *sharedWith, *sharedWith).First(&recipient).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrShareTargetNotFound
+			}
+			return nil, err
+		}
+		if recipient.ID == userID {
+			return nil, fmt.Errorf("%w: cannot share with yourself", ErrInvalidShareOptions)
+		}
+		recipientID = &recipient.ID
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		return nil, err
+	}
 	share := db.Share{
-		FileID:     fileID,
-		UserID:     userID,
-		IsPublic:   isPublic,
-		SharedWith: sharedWith,
+		Token:        token,
+		FileID:       fileID,
+		UserID:       userID,
+		IsPublic:     isPublic,
+		SharedWithID: recipientID,
+		Role:         role,
+		ExpiresAt:    opts.ExpiresAt,
+		MaxDownloads: opts.MaxDownloads,
+	}
+	if opts.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		share.PasswordHash = string(hash)
 	}
 	if err := s.db.Create(&share).Error; err != nil {
 		return nil, err
@@ -37,17 +139,225 @@ func (s *ShareService) CreateShare(userID, fileID uuid.UUID, isPublic bool, shar
 	return &share, nil
 }
 
-// Get a share by ID
-func (s *ShareService) GetShare(shareID uuid.UUID) (*db.Share, error) {
+// IncomingShare is a file someone else shared with the user
+type IncomingShare struct {
+	ShareID   uuid.UUID  `json:"share_id"`
+	FileID    uuid.UUID  `json:"file_id"`
+	FileName  string     `json:"file_name"`
+	Size      int64      `json:"size"`
+	MimeType  string     `json:"mime_type"`
+	Role      string     `json:"role"`
+	Owner     string     `json:"owner"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	SharedAt  time.Time  `json:"shared_at"`
+}
+
+// ListIncoming lists the usable shares other users made for userID
+func (s *ShareService) ListIncoming(userID uuid.UUID) ([]IncomingShare, error) {
+	out := []IncomingShare{}
+	err := s.db.Table("shares s").
+		Select(`s.id AS share_id, s.file_id, COALESCE(uf.file_name, '') AS file_name, f.size, f.mime_type,
+			s.role, u.username AS owner, s.expires_at, s.created_at AS shared_at`).
+		Joins("JOIN files f ON f.id = s.file_id").
+		Joins("JOIN users u ON u.id = s.user_id").
+		Joins("LEFT JOIN user_files uf ON uf.file_id = s.file_id AND uf.user_id = s.user_id").
+		Where("s.shared_with_id = ? AND s.revoked_at IS NULL AND (s.expires_at IS NULL OR s.expires_at > ?)", userID, time.Now()).
+		Order("s.created_at DESC").
+		Scan(&out).Error
+	return out, err
+}
+
+// OutgoingShare is a share the user made, as shown to its owner
+type OutgoingShare struct {
+	ID           uuid.UUID  `json:"id"`
+	Token        string     `json:"token"`
+	FileID       uuid.UUID  `json:"file_id"`
+	FileName     string     `json:"file_name"`
+	IsPublic     bool       `json:"is_public"`
+	SharedWith   *string    `json:"shared_with,omitempty"` // recipient username
+	Role         string     `json:"role"`
+	Downloads    int        `json:"downloads"`
+	MaxDownloads *int       `json:"max_downloads,omitempty"`
+	HasPassword  bool       `json:"has_password"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Status       string     `json:"status"` // active | revoked | expired | exhausted
+}
+
+func (s *ShareService) outgoing(userID uuid.UUID) *gorm.DB {
+	return s.db.Model(&db.Share{}).
+		Preload("SharedWithUser", func(tx *gorm.DB) *gorm.DB { return tx.Select("id", "username") }).
+		Where("user_id = ?", userID)
+}
+
+func toOutgoing(share *db.Share, fileName string) OutgoingShare {
+	out := OutgoingShare{
+		ID:           share.ID,
+		Token:        share.Token,
+		FileID:       share.FileID,
+		FileName:     fileName,
+		IsPublic:     share.IsPublic,
+		Role:         share.Role,
+		Downloads:    share.Downloads,
+		MaxDownloads: share.MaxDownloads,
+		HasPassword:  share.PasswordHash != "",
+		ExpiresAt:    share.ExpiresAt,
+		RevokedAt:    share.RevokedAt,
+		CreatedAt:    share.CreatedAt,
+		Status:       "active",
+	}
+	if share.SharedWithUser != nil {
+		out.SharedWith = &share.SharedWithUser.Username
+	}
+	switch shareState(share) {
+	case ErrShareRevoked:
+		out.Status = "revoked"
+	case ErrShareExpired:
+		out.Status = "expired"
+	case ErrShareExhausted:
+		out.Status = "exhausted"
+	}
+	return out
+}
+
+// ListShares lists every share the user created, newest first, with download counts
+func (s *ShareService) ListShares(userID uuid.UUID) ([]OutgoingShare, error) {
+	var shares []db.Share
+	if err := s.outgoing(userID).Order("created_at DESC").Find(&shares).Error; err != nil {
+		return nil, err
+	}
+
+	// the owner's file names, one query for all shares
+	names := map[uuid.UUID]string{}
+	var ufs []db.UserFile
+	if err := s.db.Select("file_id", "file_name").
+		Where("user_id = ? AND file_id IN (SELECT file_id FROM shares WHERE user_id = ?)", userID, userID).
+		Find(&ufs).Error; err != nil {
+		return nil, err
+	}
+	for _, uf := range ufs {
+		names[uf.FileID] = uf.FileName
+	}
+
+	out := make([]OutgoingShare, 0, len(shares))
+	for i := range shares {
+		out = append(out, toOutgoing(&shares[i], names[shares[i].FileID]))
+	}
+	return out, nil
+}
+
+// GetOwnShare fetches one of the user's own shares
+func (s *ShareService) GetOwnShare(userID, shareID uuid.UUID) (*OutgoingShare, error) {
 	var share db.Share
-	if err := s.db.Preload("File").First(&share, "id = ?", shareID).Error; err != nil {
+	if err := s.outgoing(userID).First(&share, "id = ?", shareID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrShareNotFound
+		}
+		return nil, err
+	}
+	out := toOutgoing(&share, s.SharedFileName(&share))
+	return &out, nil
+}
+
+// GetShareByToken loads a share (with its file) from a link token
+func (s *ShareService) GetShareByToken(token string) (*db.Share, error) {
+	var share db.Share
+	if err := s.db.Preload("File").First(&share, "token = ?", token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrShareNotFound
+		}
 		return nil, err
 	}
 	return &share, nil
 }
 
-// Increment download counter
-func (s *ShareService) IncrementDownloads(shareID uuid.UUID) error {
-	return s.db.Model(&db.Share{}).Where("id = ?", shareID).
-		Update("downloads", gorm.Expr("downloads + 1")).Error
+// SharedFileName is the sharer's own name for the shared file
+func (s *ShareService) SharedFileName(share *db.Share) string {
+	var uf db.UserFile
+	if err := s.db.Select("file_name").Where("user_id = ? AND file_id = ?", share.UserID, share.FileID).First(&uf).Error; err != nil {
+		return ""
+	}
+	return uf.FileName
+}
+
+// newShareToken returns 192 random bits, URL safe
+func newShareToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// shareState reports why a share can't be used anymore (nil if it still can)
+func shareState(share *db.Share) error {
+	switch {
+	case share.RevokedAt != nil:
+		return ErrShareRevoked
+	case share.ExpiresAt != nil && !share.ExpiresAt.After(time.Now()):
+		return ErrShareExpired
+	case share.MaxDownloads != nil && share.Downloads >= *share.MaxDownloads:
+		return ErrShareExhausted
+	}
+	return nil
+}
+
+// CheckShare validates the share is usable and the password (if it has one) matches
+func (s *ShareService) CheckShare(share *db.Share, password string) error {
+	if err := shareState(share); err != nil {
+		return err
+	}
+	if share.PasswordHash != "" {
+		if password == "" {
+			return ErrSharePasswordRequired
+		}
+		if bcrypt.CompareHashAndPassword([]byte(share.PasswordHash), []byte(password)) != nil {
+			return ErrShareBadPassword
+		}
+	}
+	return nil
+}
+
+// ConsumeDownload counts one download, atomically refusing it once the share
+// is revoked, expired or out of downloads
+func (s *ShareService) ConsumeDownload(shareID uuid.UUID) error {
+	return consumeShareDownload(s.db, shareID)
+}
+
+func consumeShareDownload(dbConn *gorm.DB, shareID uuid.UUID) error {
+	res := dbConn.Model(&db.Share{}).
+		Where("id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?) AND (max_downloads IS NULL OR downloads < max_downloads)", shareID, time.Now()).
+		Update("downloads", gorm.Expr("downloads + 1"))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 1 {
+		return nil
+	}
+	// refused, load it again to tell why
+	var share db.Share
+	if err := dbConn.First(&share, "id = ?", shareID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrShareNotFound
+		}
+		return err
+	}
+	if err := shareState(&share); err != nil {
+		return err
+	}
+	return ErrShareExhausted
+}
+
+// RevokeShare disables a share of the user's for good
+func (s *ShareService) RevokeShare(userID, shareID uuid.UUID) error {
+	res := s.db.Model(&db.Share{}).Where("id = ? AND user_id = ? AND revoked_at IS NULL", shareID, userID).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrShareNotFound
+	}
+	return nil
 }
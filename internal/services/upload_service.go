@@ -0,0 +1,383 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/internal/db"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UploadPrefix is where chunks of unfinished uploads are stored, the GC leaves it alone
+const UploadPrefix = "uploads/"
+
+var (
+	ErrUploadNotFound   = errors.New("upload not found")
+	ErrUploadExpired    = errors.New("upload expired")
+	ErrUploadOffset     = errors.New("offset doesn't match the bytes received so far")
+	ErrUploadTooLarge   = errors.New("chunk goes past the declared upload length")
+	ErrUploadIncomplete = errors.New("upload is not complete")
+	ErrInvalidUpload    = errors.New("invalid upload")
+	ErrQuotaExceeded    = errors.New("quota exceeded")
+)
+
+// UploadService runs resumable uploads: a session is created with the total
+// length, chunks are appended at the current offset (each stored as its own
+// object) while the SHA-256 state is carried along, and finalizing hands the
+// content to the regular dedup path.
+type UploadService struct {
+	db    *gorm.DB
+	files *FileService
+	ttl   time.Duration
+}
+
+// NewUploadService: sessions not finalized within ttl of their creation are removed
+func NewUploadService(dbConn *gorm.DB, fs *FileService, ttl time.Duration) *UploadService {
+	return &UploadService{db: dbConn, files: fs, ttl: ttl}
+}
+
+// chunkKey names a new object for the chunk starting at offset. Every attempt
+// gets its own key, so two PATCHes racing at one offset never write the same object.
+func chunkKey(uploadID uuid.UUID, offset int64) string {
+	return fmt.Sprintf("%s%s/%020d-%s", UploadPrefix, uploadID, offset, uuid.NewString())
+}
+
+// CreateUpload starts a resumable upload of size bytes
+func (s *UploadService) CreateUpload(user *db.User, fileName string, folderID *uuid.UUID, size int64) (*db.UploadSession, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("%w: negative length", ErrInvalidUpload)
+	}
+	if err := checkFolder(s.db, user.ID, folderID); err != nil {
+		return nil, err
+	}
+	if user.UsedStorage+size > user.Quota {
+		return nil, ErrQuotaExceeded
+	}
+	up := &db.UploadSession{
+		UserID:    user.ID,
+		FileName:  cleanFileName(fileName),
+		FolderID:  folderID,
+		Size:      size,
+		ExpiresAt: time.Now().Add(s.ttl),
+	}
+	if err := s.db.Create(up).Error; err != nil {
+		return nil, err
+	}
+	return up, nil
+}
+
+// GetUpload returns one of the user's live uploads
+func (s *UploadService) GetUpload(userID, uploadID uuid.UUID) (*db.UploadSession, error) {
+	return findUpload(s.db, userID, uploadID)
+}
+
+func findUpload(tx *gorm.DB, userID, uploadID uuid.UUID) (*db.UploadSession, error) {
+	var up db.UploadSession
+	if err := tx.Where("id = ? AND user_id = ?", uploadID, userID).First(&up).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+	if !up.ExpiresAt.After(time.Now()) {
+		return nil, ErrUploadExpired
+	}
+	return &up, nil
+}
+
+// WriteChunk appends the bytes read from r at offset, which must be the
+// current offset. The chunk is stored first, without holding any lock, and
+// only counted if the offset is still the same once it is: of two PATCHes
+// racing at one offset the first to commit wins and the other's object is
+// removed again. An interrupted chunk is simply sent again. Returns the new offset.
+func (s *UploadService) WriteChunk(ctx context.Context, userID, uploadID uuid.UUID, offset int64, r io.Reader) (int64, error) {
+	up, err := findUpload(s.db, userID, uploadID)
+	if err != nil {
+		return 0, err
+	}
+	if offset != up.Offset {
+		return up.Offset, ErrUploadOffset
+	}
+	hasher, err := restoreHash(up.HashState)
+	if err != nil {
+		return up.Offset, err
+	}
+
+	body := bufio.NewReader(r)
+	if _, err := body.Peek(1); err == io.EOF {
+		return up.Offset, nil // empty chunk, nothing to store
+	}
+	remaining := up.Size - up.Offset
+	counted := &countingReader{r: io.TeeReader(io.LimitReader(body, remaining), hasher)}
+	key := chunkKey(up.ID, up.Offset)
+	if err := s.files.storage.Put(ctx, key, "application/octet-stream", counted, -1); err != nil {
+		return up.Offset, fmt.Errorf("store chunk: %w", err)
+	}
+	if _, err := body.Peek(1); err != io.EOF {
+		s.files.storage.Delete(ctx, key)
+		return up.Offset, ErrUploadTooLarge
+	}
+
+	state, err := hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		s.files.storage.Delete(ctx, key)
+		return up.Offset, err
+	}
+	next := up.Offset + counted.n
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&db.UploadSession{}).
+			Where("id = ? AND upload_offset = ? AND expires_at > ?", up.ID, up.Offset, time.Now()).
+			Updates(map[string]interface{}{"upload_offset": next, "hash_state": state})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrUploadOffset
+		}
+		return tx.Create(&db.UploadChunk{UploadID: up.ID, Offset: up.Offset, ObjectKey: key, Size: counted.n}).Error
+	})
+	if err != nil {
+		s.files.storage.Delete(ctx, key)
+		if errors.Is(err, ErrUploadOffset) {
+			// someone else moved the upload on (or it expired / was finalized meanwhile)
+			current, ferr := findUpload(s.db, userID, uploadID)
+			if ferr != nil {
+				return 0, ferr
+			}
+			return current.Offset, ErrUploadOffset
+		}
+		return up.Offset, err
+	}
+	return next, nil
+}
+
+// FinalizedUpload is what a finalized upload produced
+type FinalizedUpload struct {
+	FileID   string
+	FileName string
+	Size     int64
+	Hash     string
+}
+
+// Finalize turns a complete upload into a file through the dedup path and drops the session
+func (s *UploadService) Finalize(ctx context.Context, userID, uploadID uuid.UUID) (*FinalizedUpload, error) {
+	tx := s.db.Begin()
+	defer tx.Rollback()
+
+	up, err := findUpload(tx.Clauses(clause.Locking{Strength: "UPDATE"}), userID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if up.Offset != up.Size {
+		return nil, ErrUploadIncomplete
+	}
+	hasher, err := restoreHash(up.HashState)
+	if err != nil {
+		return nil, err
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+
+	// the quota was checked when the session was created, other sessions may
+	// have been finalized since. Finalizing is serialised per user so two of
+	// them can't both pass against the same used storage.
+	if err := lockObject(tx, "quota:"+userID.String()); err != nil {
+		return nil, fmt.Errorf("lock quota: %w", err)
+	}
+	var user db.User
+	if err := tx.Select("used_storage", "quota").First(&user, "id = ?", userID).Error; err != nil {
+		return nil, err
+	}
+	if user.UsedStorage+up.Size > user.Quota {
+		return nil, ErrQuotaExceeded
+	}
+
+	keys, err := s.chunkKeys(tx, up)
+	if err != nil {
+		return nil, err
+	}
+	mimeType, err := s.detectMimeType(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	src := contentSource{open: func() (io.ReadCloser, error) {
+		return &chunkReader{ctx: ctx, store: s.files.storage, keys: keys}, nil
+	}}
+	fileID, err := s.files.processContent(ctx, userID, up.FileName, up.FolderID, src, up.Size, mimeType, sum)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Delete(up).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	s.deleteChunks(ctx, up.ID)
+	return &FinalizedUpload{FileID: fileID, FileName: up.FileName, Size: up.Size, Hash: sum}, nil
+}
+
+// Abort drops an upload and its chunks
+func (s *UploadService) Abort(ctx context.Context, userID, uploadID uuid.UUID) error {
+	res := s.db.Where("id = ? AND user_id = ?", uploadID, userID).Delete(&db.UploadSession{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrUploadNotFound
+	}
+	s.deleteChunks(ctx, uploadID)
+	return nil
+}
+
+// chunkKeys lists the objects of the upload's committed chunks in order
+func (s *UploadService) chunkKeys(tx *gorm.DB, up *db.UploadSession) ([]string, error) {
+	var chunks []db.UploadChunk
+	if err := tx.Where("upload_id = ?", up.ID).Order("chunk_offset").Find(&chunks).Error; err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(chunks))
+	var next int64
+	for _, c := range chunks {
+		if c.Offset != next {
+			return nil, fmt.Errorf("upload %s is missing bytes at %d", up.ID, next)
+		}
+		keys = append(keys, c.ObjectKey)
+		next += c.Size
+	}
+	return keys, nil
+}
+
+// detectMimeType sniffs the first bytes of the upload, like the multipart upload does
+func (s *UploadService) detectMimeType(ctx context.Context, keys []string) (string, error) {
+	r := &chunkReader{ctx: ctx, store: s.files.storage, keys: keys}
+	defer r.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(header[:n]), nil
+}
+
+// deleteChunks removes every chunk of an upload, failures are only logged
+func (s *UploadService) deleteChunks(ctx context.Context, uploadID uuid.UUID) {
+	objects, err := s.files.storage.List(ctx, UploadPrefix+uploadID.String()+"/")
+	if err != nil {
+		log.Printf("list chunks of upload %s: %v", uploadID, err)
+		return
+	}
+	for _, obj := range objects {
+		if err := s.files.storage.Delete(ctx, obj.Key); err != nil {
+			log.Printf("delete chunk %s: %v", obj.Key, err)
+		}
+	}
+}
+
+// Start removes expired uploads every interval until ctx is cancelled
+func (s *UploadService) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				removed, err := s.CleanupExpired(ctx)
+				if err != nil {
+					log.Printf("upload cleanup: %v", err)
+					continue
+				}
+				if removed > 0 {
+					log.Printf("upload cleanup: removed %d expired uploads", removed)
+				}
+			}
+		}
+	}()
+}
+
+// CleanupExpired deletes expired upload sessions together with their chunks,
+// and chunks whose session is already gone. Returns the number of sessions removed.
+func (s *UploadService) CleanupExpired(ctx context.Context) (int, error) {
+	var expired []db.UploadSession
+	if err := s.db.Select("id").Where("expires_at <= ?", time.Now()).Find(&expired).Error; err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, up := range expired {
+		res := s.db.Where("id = ? AND expires_at <= ?", up.ID, time.Now()).Delete(&db.UploadSession{})
+		if res.Error != nil {
+			return removed, res.Error
+		}
+		removed += int(res.RowsAffected)
+		s.deleteChunks(ctx, up.ID)
+	}
+
+	// chunks left behind by a crash between dropping a session and its objects
+	objects, err := s.files.storage.List(ctx, UploadPrefix)
+	if err != nil {
+		return removed, err
+	}
+	live := map[uuid.UUID]bool{}
+	for _, obj := range objects {
+		id, err := uuid.Parse(strings.SplitN(strings.TrimPrefix(obj.Key, UploadPrefix), "/", 2)[0])
+		if err != nil {
+			// not ours, leave it and go on with the rest
+			log.Printf("upload cleanup: skipping %s, not an upload chunk", obj.Key)
+			continue
+		}
+		known, checked := live[id]
+		if !checked {
+			var count int64
+			if err := s.db.Model(&db.UploadSession{}).Where("id = ?", id).Count(&count).Error; err != nil {
+				return removed, err
+			}
+			known = count > 0
+			live[id] = known
+		}
+		if !known {
+			if err := s.files.storage.Delete(ctx, obj.Key); err != nil {
+				log.Printf("delete chunk %s: %v", obj.Key, err)
+			}
+		}
+	}
+	return removed, nil
+}
+
+// restoreHash resumes the SHA-256 of the bytes received so far
+func restoreHash(state []byte) (hash.Hash, error) {
+	h := sha256.New()
+	if len(state) == 0 {
+		return h, nil
+	}
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, fmt.Errorf("restore hash state: %w", err)
+	}
+	return h, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
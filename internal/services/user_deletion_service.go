@@ -0,0 +1,269 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"backend/internal/db"
+	"backend/internal/rbac"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// User deletion job states
+const (
+	DeletionPending = "pending"
+	DeletionRunning = "running"
+	DeletionDone    = "done"
+	DeletionFailed  = "failed"
+)
+
+var (
+	ErrInvalidTransfer  = errors.New("files can't be transferred to that user")
+	ErrDeletionNotFound = errors.New("deletion job not found")
+)
+
+// files handled per batch, progress is saved after each one
+const deletionBatchSize = 100
+
+// UserDeletionService removes users in the background. Their files go through
+// the ref count path (or to another user), so shared content survives, storage
+// is freed and no share points at a missing owner.
+type UserDeletionService struct {
+	db    *gorm.DB
+	files *FileService
+
+	wake chan struct{}
+	mu   sync.Mutex // one worker pass at a time
+}
+
+func NewUserDeletionService(dbConn *gorm.DB, fs *FileService) *UserDeletionService {
+	return &UserDeletionService{db: dbConn, files: fs, wake: make(chan struct{}, 1)}
+}
+
+// Request queues the deletion of a user. The account is suspended and its share
+// links revoked right away; files and the user row go when the job runs.
+// Asking again for a user already queued returns the existing job, a failed one is retried.
+func (s *UserDeletionService) Request(userID uuid.UUID, transferTo, requestedBy *uuid.UUID) (*db.UserDeletion, error) {
+	if transferTo != nil && *transferTo == userID {
+		return nil, ErrInvalidTransfer
+	}
+	var job db.UserDeletion
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// shares the role lock with SetRole, so the last admin can't be demoted and deleted at once
+		if err := lockRoles(tx); err != nil {
+			return err
+		}
+		var user db.User
+		if err := tx.First(&user, "id = ?", userID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUserNotFound
+			}
+			return err
+		}
+		if rbac.RoleOf(&user) == rbac.RoleAdmin {
+			if err := checkOtherAdmin(tx, userID); err != nil {
+				return err
+			}
+		}
+		if transferTo != nil {
+			var target db.User
+			if err := tx.First(&target, "id = ? AND suspended_at IS NULL", *transferTo).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return ErrInvalidTransfer
+				}
+				return err
+			}
+		}
+
+		err := tx.Where("user_id = ? AND status <> ?", userID, DeletionDone).First(&job).Error
+		switch {
+		case err == nil && job.Status != DeletionFailed:
+			return nil
+		case err == nil:
+			// retry, keeping the progress made so far
+			job.Status, job.Error = DeletionPending, ""
+			if job.TransferFolderID == nil {
+				job.TransferTo = transferTo
+			}
+			if err := tx.Save(&job).Error; err != nil {
+				return err
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			job = db.UserDeletion{UserID: userID, Username: user.Username, RequestedBy: requestedBy, TransferTo: transferTo, Status: DeletionPending}
+			if err := tx.Model(&db.UserFile{}).Where("user_id = ?", userID).Count(&job.FilesTotal).Error; err != nil {
+				return err
+			}
+			if err := tx.Create(&job).Error; err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+
+		now := time.Now()
+		if err := tx.Model(&db.User{}).Where("id = ? AND suspended_at IS NULL", userID).Update("suspended_at", now).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&db.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&db.Share{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return &job, nil
+}
+
+// Get returns one job
+func (s *UserDeletionService) Get(jobID uuid.UUID) (*db.UserDeletion, error) {
+	var job db.UserDeletion
+	if err := s.db.First(&job, "id = ?", jobID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDeletionNotFound
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// List returns the most recent jobs, newest first
+func (s *UserDeletionService) List(limit int) ([]db.UserDeletion, error) {
+	var jobs []db.UserDeletion
+	err := s.db.Order("created_at DESC").Limit(limit).Find(&jobs).Error
+	return jobs, err
+}
+
+// Start works through queued jobs right away (picking up the ones a restart
+// interrupted), whenever one is requested, and every interval until ctx is cancelled
+func (s *UserDeletionService) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := s.RunPending(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("user deletion: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-s.wake:
+			}
+		}
+	}()
+}
+
+// RunPending runs every pending or interrupted job. A failing job is marked
+// failed and skipped; requesting the deletion again resumes it.
+func (s *UserDeletionService) RunPending(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jobs []db.UserDeletion
+	if err := s.db.Where("status IN ?", []string{DeletionPending, DeletionRunning}).Order("created_at").Find(&jobs).Error; err != nil {
+		return err
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		err := s.run(ctx, job)
+		if ctx.Err() != nil {
+			// interrupted, stays running and is resumed next time
+			return ctx.Err()
+		}
+		if err != nil {
+			log.Printf("user deletion %s (user %s): %v", job.ID, job.UserID, err)
+			s.db.Model(job).Updates(map[string]interface{}{"status": DeletionFailed, "error": err.Error()})
+			continue
+		}
+		now := time.Now()
+		if err := s.db.Model(job).Updates(map[string]interface{}{"status": DeletionDone, "error": "", "finished_at": now}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run does the work of one job. Every step can be repeated, which is what makes a job resumable.
+func (s *UserDeletionService) run(ctx context.Context, job *db.UserDeletion) error {
+	if err := s.db.Model(job).Update("status", DeletionRunning).Error; err != nil {
+		return err
+	}
+
+	if job.TransferTo != nil {
+		if err := s.transferFolders(job); err != nil {
+			return fmt.Errorf("transfer folders: %w", err)
+		}
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var batch []db.UserFile
+		if err := s.db.Where("user_id = ?", job.UserID).Order("id").Limit(deletionBatchSize).Find(&batch).Error; err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for i := range batch {
+			var err error
+			if job.TransferTo != nil {
+				err = s.files.transferUserFile(ctx, &batch[i], *job.TransferTo, job.TransferFolderID)
+			} else {
+				err = s.files.releaseUserFile(ctx, &batch[i])
+			}
+			if err != nil {
+				return fmt.Errorf("file %s: %w", batch[i].FileID, err)
+			}
+		}
+		if err := s.db.Model(job).Update("files_done", gorm.Expr("files_done + ?", len(batch))).Error; err != nil {
+			return err
+		}
+	}
+
+	// what's left hangs off the user row: shares made by or for them, their folders, the row itself.
+	// Sessions, API keys, identities and recovery codes go with the row.
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? OR shared_with_id = ?", job.UserID, job.UserID).Delete(&db.Share{}).Error; err != nil {
+			return fmt.Errorf("delete shares: %w", err)
+		}
+		if err := tx.Where("owner_id = ?", job.UserID).Delete(&db.Folder{}).Error; err != nil {
+			return fmt.Errorf("delete folders: %w", err)
+		}
+		return tx.Delete(&db.User{}, "id = ?", job.UserID).Error
+	})
+}
+
+// transferFolders moves the user's folder tree under a new folder in the
+// recipient's root, named after the deleted user
+func (s *UserDeletionService) transferFolders(job *db.UserDeletion) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if job.TransferFolderID == nil {
+			folder := db.Folder{Name: "from " + job.Username, OwnerID: *job.TransferTo}
+			if err := tx.Create(&folder).Error; err != nil {
+				return err
+			}
+			job.TransferFolderID = &folder.ID
+			if err := tx.Model(job).Update("transfer_folder_id", folder.ID).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&db.Folder{}).Where("owner_id = ?", job.UserID).Updates(map[string]interface{}{
+			"owner_id":  *job.TransferTo,
+			"parent_id": gorm.Expr("COALESCE(parent_id, ?)", *job.TransferFolderID),
+		}).Error
+	})
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"backend/internal/config"
+)
+
+// ErrNotFound is returned by every backend when the object key doesn't exist
+var ErrNotFound = errors.New("storage: object not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// Backend is the object store used by the service layer.
+// Keys are opaque strings; "/" may be used to group objects under a prefix.
+type Backend interface {
+	// Put stores the reader under key. size may be -1 when unknown.
+	Put(ctx context.Context, key, contentType string, r io.Reader, size int64) error
+	// Get opens the whole object for reading
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// GetRange opens length bytes starting at offset (length -1 means until the end)
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Delete removes the object; deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// List returns every object whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Copy duplicates the object at src under dst, replacing whatever dst held
+	Copy(ctx context.Context, src, dst string) error
+}
+
+// Supported values for config.Config.StorageBackend
+const (
+	BackendMinio  = "minio"
+	BackendLocal  = "local"
+	BackendMemory = "memory"
+)
+
+// NewBackend builds the storage driver selected in config
+func NewBackend(cfg *config.Config) (Backend, error) {
+	switch cfg.StorageBackend {
+	case BackendMinio, "":
+		return NewMinioClient(cfg.MinioEndpoint, cfg.MinioAccessKey, cfg.MinioSecretKey, cfg.MinioBucket, cfg.MinioUseSSL)
+	case BackendLocal:
+		return NewLocalStorage(cfg.LocalStorageDir)
+	case BackendMemory:
+		return NewMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+}
@@ -1,14 +1,18 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"io"
-	"log"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
+// streamPartSize is the multipart part size for uploads of unknown length,
+// 16 MiB x 10000 parts caps those at ~160 GB
+const streamPartSize = 16 << 20
+
 // Wrapper for minio client used by service layer
 type MinioClient struct {
 	Client *minio.Client
@@ -46,7 +50,12 @@ func NewMinioClient(endpoint, accessKey, secretKey, bucket string, useSSL bool)
 // Uploading the data in the minIo in the form of reader
 // Return the upload info or error
 func (m *MinioClient) Upload(ctx context.Context, objectKey, contentType string, reader io.Reader, size int64) (minio.UploadInfo, error) {
-	info, err := m.Client.PutObject(ctx, m.Bucket, objectKey, reader, size, minio.PutObjectOptions{ContentType: contentType})
+	opts := minio.PutObjectOptions{ContentType: contentType}
+	if size < 0 {
+		// the client buffers one part in memory, its default for unknown sizes is ~500 MiB
+		opts.PartSize = streamPartSize
+	}
+	info, err := m.Client.PutObject(ctx, m.Bucket, objectKey, reader, size, opts)
 
 	if err != nil {
 		return minio.UploadInfo{}, err
@@ -59,7 +68,88 @@ func (m *MinioClient) GetObject(ctx context.Context, objectKey string) (*minio.O
 	return m.Client.GetObject(ctx, m.Bucket, objectKey, minio.GetObjectOptions{})
 }
 
-// for debugging only for test puroses not for production
-func (m *MinioClient) ListObjects(ctx context.Context) {
-	log.Printf("Listing objects in bucket %s:\n", m.Bucket)
+// Put implements Backend
+func (m *MinioClient) Put(ctx context.Context, key, contentType string, r io.Reader, size int64) error {
+	_, err := m.Upload(ctx, key, contentType, r, size)
+	return err
+}
+
+// Get implements Backend
+func (m *MinioClient) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return m.GetRange(ctx, key, 0, -1)
+}
+
+// GetRange implements Backend
+func (m *MinioClient) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if offset > 0 || length >= 0 {
+		end := int64(0) // 0 means "till the end" for SetRange
+		if length >= 0 {
+			if length == 0 {
+				return io.NopCloser(bytes.NewReader(nil)), nil
+			}
+			end = offset + length - 1
+		}
+		if err := opts.SetRange(offset, end); err != nil {
+			return nil, err
+		}
+	}
+	obj, err := m.Client.GetObject(ctx, m.Bucket, key, opts)
+	if err != nil {
+		return nil, mapMinioErr(err)
+	}
+	// GetObject is lazy, stat it so missing keys fail here and not on first Read
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, mapMinioErr(err)
+	}
+	return obj, nil
+}
+
+// Stat implements Backend
+func (m *MinioClient) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := m.Client.StatObject(ctx, m.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, mapMinioErr(err)
+	}
+	return ObjectInfo{Key: info.Key, Size: info.Size, ContentType: info.ContentType, LastModified: info.LastModified}, nil
+}
+
+// Delete implements Backend
+func (m *MinioClient) Delete(ctx context.Context, key string) error {
+	err := m.Client.RemoveObject(ctx, m.Bucket, key, minio.RemoveObjectOptions{})
+	if err != nil && mapMinioErr(err) == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// List implements Backend
+func (m *MinioClient) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var out []ObjectInfo
+	for obj := range m.Client.ListObjects(ctx, m.Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		out = append(out, ObjectInfo{Key: obj.Key, Size: obj.Size, ContentType: obj.ContentType, LastModified: obj.LastModified})
+	}
+	return out, nil
+}
+
+// Copy implements Backend. ComposeObject copies server side and, unlike
+// CopyObject, also handles sources above 5 GiB.
+func (m *MinioClient) Copy(ctx context.Context, src, dst string) error {
+	_, err := m.Client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: m.Bucket, Object: dst},
+		minio.CopySrcOptions{Bucket: m.Bucket, Object: src},
+	)
+	return mapMinioErr(err)
+}
+
+// translate minio "no such key" responses to ErrNotFound
+func mapMinioErr(err error) error {
+	if code := minio.ToErrorResponse(err).Code; code == minio.NoSuchKey || code == "NotFound" {
+		return ErrNotFound
+	}
+	return err
 }
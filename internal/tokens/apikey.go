@@ -0,0 +1,45 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// APIKeyPrefix marks API keys so AuthMiddleware can tell them from JWTs
+const APIKeyPrefix = "bk_"
+
+// API key scopes, each route requires one of them
+const (
+	ScopeRead   = "read"   // list, search and download
+	ScopeUpload = "upload" // POST /upload
+	ScopeWrite  = "write"  // rename, move, delete, folders and shares
+)
+
+// ValidScope reports whether s is a known scope
+func ValidScope(s string) bool {
+	return s == ScopeRead || s == ScopeUpload || s == ScopeWrite
+}
+
+// NewAPIKey returns a random key and the hash to store for it
+func NewAPIKey() (key, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, HashAPIKey(key), nil
+}
+
+// HashAPIKey: keys are random, sha256 is enough to look them up without storing them
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsAPIKey tells an API key from a JWT in the Authorization header
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
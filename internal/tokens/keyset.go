@@ -0,0 +1,362 @@
+package tokens
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported signing algorithms
+const (
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256"
+)
+
+var (
+	ErrUnknownKey          = errors.New("tokens: unknown or retired signing key")
+	ErrRotationUnsupported = errors.New("tokens: HMAC keys come from JWT_SECRET and can't be rotated at runtime")
+)
+
+// Key is one signing key. Keys other than the active one only verify.
+type Key struct {
+	ID        string
+	Alg       string
+	CreatedAt time.Time
+	RetiredAt *time.Time // when another key took over signing, nil for the active and pending keys
+
+	private crypto.PrivateKey // *rsa.PrivateKey, ed25519.PrivateKey or []byte for HS256
+}
+
+func (k *Key) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Alg)
+}
+
+func (k *Key) verifyKey() interface{} {
+	switch priv := k.private.(type) {
+	case *rsa.PrivateKey:
+		return &priv.PublicKey
+	case ed25519.PrivateKey:
+		return priv.Public()
+	default:
+		return priv
+	}
+}
+
+// KeySet signs with the active key and verifies with any key it knows by kid.
+// A key replaced by rotation keeps verifying for the grace window, which should
+// be at least the access token lifetime so no valid token is cut short.
+type KeySet struct {
+	mu     sync.RWMutex
+	keys   map[string]*Key
+	active *Key
+	legacy *Key // verifies tokens that carry no kid (issued before keys had IDs)
+
+	grace time.Duration
+	dir   string // rotated keys are written here, "" when the set isn't file backed
+	alg   string // algorithm of keys generated by Rotate
+}
+
+// Options for Load
+type Options struct {
+	Dir        string        // directory of <kid>.pem private keys, empty = HMAC with HMACSecret
+	ActiveKID  string        // key that signs, empty = the newest key in Dir
+	Alg        string        // algorithm for generated keys (RS256 or EdDSA)
+	Grace      time.Duration // how long a replaced key keeps verifying
+	HMACSecret string
+}
+
+// NewHMACKeySet is a single HS256 key, the setup used before asymmetric keys.
+// Its tokens carry no kid.
+func NewHMACKeySet(secret string) *KeySet {
+	key := &Key{ID: "", Alg: AlgHS256, CreatedAt: time.Now(), private: []byte(secret)}
+	return &KeySet{keys: map[string]*Key{}, active: key, legacy: key}
+}
+
+// Load builds the key set from config. With a key directory every *.pem file is
+// loaded; the newest one (by modification time) signs unless ActiveKID says otherwise.
+// An older key counts as retired from the moment the next key was created.
+// An empty directory gets a freshly generated key.
+//
+// Rotation procedure: call Rotate (POST /admin/keys/rotate) or drop a new
+// <kid>.pem into the directory and restart. Delete old files once their grace
+// window has passed; expired keys are skipped on load anyway.
+func Load(opts Options) (*KeySet, error) {
+	if opts.Dir == "" {
+		if opts.HMACSecret == "" {
+			return nil, errors.New("tokens: either a key directory or an HMAC secret is required")
+		}
+		return NewHMACKeySet(opts.HMACSecret), nil
+	}
+	if opts.Alg == "" {
+		opts.Alg = AlgEdDSA
+	}
+	if opts.Alg != AlgRS256 && opts.Alg != AlgEdDSA {
+		return nil, fmt.Errorf("tokens: unsupported key algorithm %q", opts.Alg)
+	}
+	if err := os.MkdirAll(opts.Dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{keys: map[string]*Key{}, grace: opts.Grace, dir: opts.Dir, alg: opts.Alg}
+	loaded, err := readKeyDir(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(loaded) == 0 {
+		key, err := GenerateKey(opts.Alg)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeKey(opts.Dir, key); err != nil {
+			return nil, err
+		}
+		loaded = []*Key{key}
+	}
+
+	sort.Slice(loaded, func(i, j int) bool {
+		if loaded[i].CreatedAt.Equal(loaded[j].CreatedAt) {
+			return loaded[i].ID < loaded[j].ID
+		}
+		return loaded[i].CreatedAt.Before(loaded[j].CreatedAt)
+	})
+	active := len(loaded) - 1
+	if opts.ActiveKID != "" {
+		active = -1
+		for i, k := range loaded {
+			if k.ID == opts.ActiveKID {
+				active = i
+			}
+		}
+		if active < 0 {
+			return nil, fmt.Errorf("tokens: active key %q not found in %s", opts.ActiveKID, opts.Dir)
+		}
+	}
+
+	now := time.Now()
+	for i, k := range loaded {
+		if i < active {
+			retired := loaded[i+1].CreatedAt
+			if now.After(retired.Add(ks.grace)) {
+				continue // past its grace window
+			}
+			k.RetiredAt = &retired
+		}
+		ks.keys[k.ID] = k
+	}
+	ks.active = loaded[active]
+	return ks, nil
+}
+
+// Sign signs claims with the active key and puts its ID in the kid header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	ks.mu.RLock()
+	key := ks.active
+	ks.mu.RUnlock()
+
+	tok := jwt.NewWithClaims(key.method(), claims)
+	if key.ID != "" {
+		tok.Header["kid"] = key.ID
+	}
+	return tok.SignedString(key.private)
+}
+
+// Keyfunc resolves the verification key for jwt.Parse by kid
+func (ks *KeySet) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+
+	ks.mu.RLock()
+	key := ks.legacy
+	if kid != "" {
+		key = ks.keys[kid]
+	}
+	ks.mu.RUnlock()
+
+	if key == nil || !ks.usable(key, time.Now()) {
+		return nil, ErrUnknownKey
+	}
+	// the header can't pick a different algorithm than the key was made for
+	if t.Method.Alg() != key.Alg {
+		return nil, jwt.ErrTokenUnverifiable
+	}
+	return key.verifyKey(), nil
+}
+
+// Methods lists the algorithms of the keys in the set, for jwt.WithValidMethods
+func (ks *KeySet) Methods() []string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	seen := map[string]bool{ks.active.Alg: true}
+	for _, k := range ks.keys {
+		seen[k.Alg] = true
+	}
+	if ks.legacy != nil {
+		seen[ks.legacy.Alg] = true
+	}
+	methods := make([]string, 0, len(seen))
+	for alg := range seen {
+		methods = append(methods, alg)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// Rotate generates a new key, makes it the signing key and starts the grace
+// window of the previous one. The key is written to the key directory so it
+// survives restarts; other instances pick it up when they restart.
+func (ks *KeySet) Rotate() (*Key, error) {
+	if ks.dir == "" {
+		return nil, ErrRotationUnsupported
+	}
+	key, err := GenerateKey(ks.alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKey(ks.dir, key); err != nil {
+		return nil, err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	now := time.Now()
+	ks.active.RetiredAt = &now
+	ks.keys[key.ID] = key
+	ks.active = key
+	for id, k := range ks.keys {
+		if !ks.usable(k, now) {
+			delete(ks.keys, id)
+		}
+	}
+	return key, nil
+}
+
+// Keys returns the keys that currently verify, oldest first
+func (ks *KeySet) Keys() []*Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	now := time.Now()
+	keys := make([]*Key, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		if ks.usable(k, now) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+// ActiveKID is the kid new tokens are signed with
+func (ks *KeySet) ActiveKID() string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.active.ID
+}
+
+func (ks *KeySet) usable(k *Key, now time.Time) bool {
+	return k.RetiredAt == nil || now.Before(k.RetiredAt.Add(ks.grace))
+}
+
+// GenerateKey creates a new RS256 (2048 bit) or EdDSA (Ed25519) key
+func GenerateKey(alg string) (*Key, error) {
+	var priv crypto.PrivateKey
+	var err error
+	switch alg {
+	case AlgRS256:
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgEdDSA:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("tokens: unsupported key algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	id := now.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+	return &Key{ID: id, Alg: alg, CreatedAt: now, private: priv}, nil
+}
+
+// readKeyDir loads every <kid>.pem (PKCS#8) in dir
+func readKeyDir(dir string) ([]*Key, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*Key
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".pem") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("tokens: %s is not PEM encoded", path)
+		}
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("tokens: %s: %w", path, err)
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		key := &Key{ID: strings.TrimSuffix(e.Name(), ".pem"), CreatedAt: info.ModTime(), private: priv}
+		switch priv.(type) {
+		case *rsa.PrivateKey:
+			key.Alg = AlgRS256
+		case ed25519.PrivateKey:
+			key.Alg = AlgEdDSA
+		default:
+			return nil, fmt.Errorf("tokens: %s: unsupported key type %T", path, priv)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// writeKey stores key as <kid>.pem, written to a temp file first so a reader never sees half a key
+func writeKey(dir string, key *Key) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.private)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := pem.Encode(tmp, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// the modification time is the key's creation time when loading, keep it exact
+	if err := os.Chtimes(tmp.Name(), key.CreatedAt, key.CreatedAt); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, key.ID+".pem"))
+}
@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"backend/internal/api"
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/rbac"
+	"backend/internal/services"
+	"backend/internal/tokens"
+
+	"github.com/google/uuid"
+)
+
+// TestAdminUserManagement creates, lists, limits, suspends and resets a user through the admin API.
+func TestAdminUserManagement(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	keys := tokens.NewHMACKeySet(testJWTSecret)
+	admins := services.NewAdminService(conn)
+	auth := services.NewAuthService(conn, keys, time.Minute, time.Hour)
+	handler := api.NewAdminHandler(admins, services.NewUserDeletionService(conn, fs), services.NewAuditService(conn), services.NewGarbageCollector(fs, time.Hour), keys)
+
+	admin := newTestUser(t, conn)
+	if _, err := admins.SetRole(admin.ID, rbac.RoleAdmin); err != nil {
+		t.Fatalf("make admin: %v", err)
+	}
+	conn.First(admin, "id = ?", admin.ID)
+
+	call := func(method, path string, body interface{}, out interface{}) int {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &buf)
+		req = req.WithContext(middleware.WithUser(req.Context(), admin))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if bytes.Contains(rr.Body.Bytes(), []byte("PasswordHash")) {
+			t.Fatalf("%s %s leaked a password hash", method, path)
+		}
+		if out != nil && rr.Code < 300 {
+			json.NewDecoder(rr.Body).Decode(out)
+		}
+		return rr.Code
+	}
+
+	name := "managed-" + uuid.NewString()[:8]
+	quota := int64(1 << 20)
+	var user db.User
+	create := api.CreateUserRequest{Username: name, Email: name + "@example.com", Password: "first password", Quota: &quota}
+	if code := call("POST", "/users", create, &user); code != http.StatusCreated || user.Quota != quota {
+		t.Fatalf("create user: %d %+v", code, user)
+	}
+	if code := call("POST", "/users", create, nil); code != http.StatusConflict {
+		t.Fatalf("duplicate user: expected 409, got %d", code)
+	}
+
+	var page services.UserPage
+	if code := call("GET", "/users?q="+name+"&per_page=1", nil, &page); code != http.StatusOK || page.Total != 1 || len(page.Users) != 1 || page.Users[0].ID != user.ID {
+		t.Fatalf("filtered list: %d %+v", code, page)
+	}
+	if code := call("GET", "/users?per_page=abc", nil, nil); code != http.StatusBadRequest {
+		t.Fatalf("bad per_page: expected 400, got %d", code)
+	}
+
+	newQuota := int64(5 << 20)
+	if code := call("PUT", "/users/"+user.ID.String()+"/quota", api.SetQuotaRequest{Quota: &newQuota}, &user); code != http.StatusOK || user.Quota != newQuota {
+		t.Fatalf("set quota: %d %+v", code, user)
+	}
+	uploadFile(t, fs, &user, "report.txt", "usage "+uuid.NewString())
+	var usage services.UserUsage
+	if code := call("GET", "/users/"+user.ID.String(), nil, &usage); code != http.StatusOK || usage.Files != 1 || usage.Quota != newQuota {
+		t.Fatalf("user usage: %d %+v", code, usage)
+	}
+	var files services.UserFilePage
+	if code := call("GET", "/users/"+user.ID.String()+"/files", nil, &files); code != http.StatusOK || files.Total != 1 || files.Files[0].FileName != "report.txt" {
+		t.Fatalf("user files: %d %+v", code, files)
+	}
+
+	// suspension ends the session and blocks both logging in and API keys
+	pair, _, err := auth.Login(name, "first password")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	_, rawKey, err := services.NewAPIKeyService(conn).CreateAPIKey(user.ID, "ci", []string{tokens.ScopeRead}, nil)
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	authMw := middleware.AuthMiddleware(middleware.AuthOptions{Keys: keys, DB: conn})
+	status := func(bearer string) int {
+		req := httptest.NewRequest("GET", "/files", nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		rr := httptest.NewRecorder()
+		authMw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := call("POST", "/users/"+admin.ID.String()+"/suspend", nil, nil); code != http.StatusConflict {
+		t.Fatalf("suspending yourself: expected 409, got %d", code)
+	}
+	if code := call("POST", "/users/"+user.ID.String()+"/suspend", nil, &user); code != http.StatusOK || user.SuspendedAt == nil {
+		t.Fatalf("suspend: %d %+v", code, user)
+	}
+	if code := status(pair.AccessToken); code != http.StatusForbidden {
+		t.Fatalf("suspended user's token accepted: %d", code)
+	}
+	if code := status(rawKey); code != http.StatusForbidden {
+		t.Fatalf("suspended user's api key: expected 403, got %d", code)
+	}
+	if _, _, err := auth.Login(name, "first password"); !errors.Is(err, services.ErrAccountSuspended) {
+		t.Fatalf("expected ErrAccountSuspended, got %v", err)
+	}
+	suspended := true
+	if page, err := admins.ListUsers(services.UserFilter{Query: name, Suspended: &suspended}); err != nil || page.Total != 1 {
+		t.Fatalf("suspended filter: %v %+v", err, page)
+	}
+	if code := call("POST", "/users/"+user.ID.String()+"/unsuspend", nil, &user); code != http.StatusOK || user.SuspendedAt != nil {
+		t.Fatalf("unsuspend: %d %+v", code, user)
+	}
+
+	// a reset replaces the password and returns the generated one
+	var reset map[string]string
+	if code := call("POST", "/users/"+user.ID.String()+"/reset-password", nil, &reset); code != http.StatusOK || reset["password"] == "" {
+		t.Fatalf("reset password: %d %+v", code, reset)
+	}
+	if _, _, err := auth.Login(name, "first password"); !errors.Is(err, services.ErrInvalidCredentials) {
+		t.Fatalf("old password still works: %v", err)
+	}
+	if _, _, err := auth.Login(name, reset["password"]); err != nil {
+		t.Fatalf("login with reset password: %v", err)
+	}
+
+	promote := true
+	if code := call("PUT", "/users/"+user.ID.String()+"/admin", api.SetAdminRequest{IsAdmin: &promote}, &user); code != http.StatusOK || !user.IsAdmin {
+		t.Fatalf("promote: %d %+v", code, user)
+	}
+}
@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/services"
+	"backend/internal/tokens"
+)
+
+// TestAPIKeyScopes authenticates with an upload-only key and checks scopes, revocation and expiry.
+func TestAPIKeyScopes(t *testing.T) {
+	_, _, conn := SetupTest(t)
+	user := newTestUser(t, conn)
+	keys := services.NewAPIKeyService(conn)
+
+	if _, _, err := keys.CreateAPIKey(user.ID, "ci", []string{"everything"}, nil); err == nil {
+		t.Fatalf("unknown scope accepted")
+	}
+	key, plain, err := keys.CreateAPIKey(user.ID, "ci", []string{tokens.ScopeUpload}, nil)
+	if err != nil {
+		t.Fatalf("create key: %v", err)
+	}
+
+	authMw := middleware.AuthMiddleware(middleware.AuthOptions{JWTSecret: testJWTSecret, DB: conn})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if middleware.GetUser(r.Context()).ID != user.ID {
+			t.Errorf("api key resolved to the wrong user")
+		}
+	})
+	status := func(h http.Handler) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+plain)
+		rr := httptest.NewRecorder()
+		authMw(h).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := status(middleware.RequireScope(tokens.ScopeUpload)(ok)); code != http.StatusOK {
+		t.Fatalf("upload scope: expected 200, got %d", code)
+	}
+	if code := status(middleware.RequireScope(tokens.ScopeRead)(ok)); code != http.StatusForbidden {
+		t.Fatalf("read scope: expected 403, got %d", code)
+	}
+	if code := status(middleware.SessionOnly(ok)); code != http.StatusForbidden {
+		t.Fatalf("session only route: expected 403, got %d", code)
+	}
+
+	var stored db.APIKey
+	conn.First(&stored, "id = ?", key.ID)
+	if stored.LastUsedAt == nil || stored.KeyHash == plain {
+		t.Fatalf("key not tracked or stored in plain text")
+	}
+
+	past := time.Now().Add(-time.Minute)
+	conn.Model(&db.APIKey{}).Where("id = ?", key.ID).Update("expires_at", past)
+	if code := status(middleware.RequireScope(tokens.ScopeUpload)(ok)); code != http.StatusUnauthorized {
+		t.Fatalf("expired key: expected 401, got %d", code)
+	}
+	conn.Model(&db.APIKey{}).Where("id = ?", key.ID).Update("expires_at", nil)
+
+	if err := keys.RevokeAPIKey(user.ID, key.ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if code := status(middleware.RequireScope(tokens.ScopeUpload)(ok)); code != http.StatusUnauthorized {
+		t.Fatalf("revoked key: expected 401, got %d", code)
+	}
+}
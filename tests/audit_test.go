@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/internal/api"
+	"backend/internal/middleware"
+	"backend/internal/rbac"
+	"backend/internal/services"
+	"backend/internal/tokens"
+
+	"github.com/google/uuid"
+)
+
+// TestAuditLog records logins and a share through the middleware, then reads them back from /admin/audit.
+func TestAuditLog(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	audits := services.NewAuditService(conn)
+	auth := services.NewAuthService(conn, tokens.NewHMACKeySet(testJWTSecret), time.Minute, time.Hour)
+	withAudit := func(h http.Handler) http.Handler {
+		return middleware.RequestID(middleware.Audit(audits)(h))
+	}
+
+	name := "audited-" + uuid.NewString()[:8]
+	user, err := auth.Register(services.RegisterInput{Username: name, Email: name + "@example.com", Password: "audit password"})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	login := func(password, requestID string) int {
+		body, _ := json.Marshal(api.LoginRequest{Username: name, Password: password})
+		req := httptest.NewRequest("POST", "/auth/login", bytes.NewReader(body))
+		req.Header.Set(middleware.RequestIDHeader, requestID)
+		rr := httptest.NewRecorder()
+		withAudit(api.NewLoginHandler(auth)).ServeHTTP(rr, req)
+		if rr.Header().Get(middleware.RequestIDHeader) != requestID {
+			t.Fatalf("request id not echoed: %q", rr.Header().Get(middleware.RequestIDHeader))
+		}
+		return rr.Code
+	}
+	if code := login("wrong password", "req-failed-"+name); code != http.StatusUnauthorized {
+		t.Fatalf("bad login: %d", code)
+	}
+	if code := login("audit password", "req-ok-"+name); code != http.StatusOK {
+		t.Fatalf("login: %d", code)
+	}
+
+	fileID := uploadFile(t, fs, user, "audited.txt", "audit "+uuid.NewString())
+	body, _ := json.Marshal(api.CreateShareRequest{FileID: fileID.String(), IsPublic: true})
+	req := httptest.NewRequest("POST", "/shares", bytes.NewReader(body))
+	req.Header.Set(middleware.RequestIDHeader, "-1-"+name) // reads as a formula in a spreadsheet
+	req = req.WithContext(middleware.WithUser(req.Context(), user))
+	rr := httptest.NewRecorder()
+	withAudit(api.NewShareHandler(services.NewShareService(conn))).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("create share: %d %s", rr.Code, rr.Body.String())
+	}
+
+	admin := newTestUser(t, conn)
+	if _, err := services.NewAdminService(conn).SetRole(admin.ID, rbac.RoleSupport); err != nil {
+		t.Fatalf("make support: %v", err)
+	}
+	conn.First(admin, "id = ?", admin.ID)
+	handler := withAudit(api.NewAdminHandler(services.NewAdminService(conn), services.NewUserDeletionService(conn, fs), audits,
+		services.NewGarbageCollector(fs, time.Hour), tokens.NewHMACKeySet(testJWTSecret)))
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/audit?"+query, nil)
+		req = req.WithContext(middleware.WithUser(req.Context(), admin))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	var page services.AuditPage
+	rr = get("actor=" + user.ID.String() + "&action=auth.")
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil || page.Total != 1 || page.Entries[0].Action != middleware.ActionLogin {
+		t.Fatalf("login entries for the user: %d %v %+v", rr.Code, err, page)
+	}
+	if page.Entries[0].RequestID != "req-ok-"+name {
+		t.Fatalf("request id not recorded: %+v", page.Entries[0])
+	}
+	rr = get("action=" + middleware.ActionLoginFailed + "&from=" + time.Now().Add(-time.Minute).UTC().Format(time.RFC3339))
+	page = services.AuditPage{}
+	json.NewDecoder(rr.Body).Decode(&page)
+	found := false
+	for _, e := range page.Entries {
+		found = found || (e.RequestID == "req-failed-"+name && e.ActorID == nil && strings.Contains(e.Details, name))
+	}
+	if !found {
+		t.Fatalf("failed login not recorded: %+v", page.Entries)
+	}
+	if rr := get("from=yesterday"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad time: expected 400, got %d", rr.Code)
+	}
+
+	rr = get("format=csv&actor=" + user.ID.String())
+	rows, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("csv export: %v %d rows", err, len(rows))
+	}
+	if rows[1][3] != middleware.ActionLogin || rows[2][3] != middleware.ActionShareCreate {
+		t.Fatalf("expected login then share, got %v", rows[1:])
+	}
+	if rows[2][8] != "'-1-"+name {
+		t.Fatalf("request id should be escaped in the csv, got %q", rows[2][8])
+	}
+	rr = get("format=ndjson&actor=" + admin.ID.String() + "&action=" + middleware.ActionAuditExport)
+	if lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n"); len(lines) != 2 {
+		t.Fatalf("both exports should be logged, got %d lines", len(lines))
+	}
+}
@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"backend/internal/api"
+	"backend/internal/middleware"
+	"backend/internal/services"
+	"backend/internal/tokens"
+
+	"github.com/google/uuid"
+)
+
+const testJWTSecret = "test-secret"
+
+// TestRegisterAndLogin registers over HTTP, logs in and uses the token against AuthMiddleware.
+func TestRegisterAndLogin(t *testing.T) {
+	_, _, conn := SetupTest(t)
+	auth := services.NewAuthService(conn, tokens.NewHMACKeySet(testJWTSecret), time.Minute, time.Hour)
+
+	name := "auth-" + uuid.NewString()[:8]
+	register := func(username, email string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(api.RegisterRequest{Username: username, Email: email, Password: "correct horse"})
+		rr := httptest.NewRecorder()
+		api.NewRegisterHandler(auth)(rr, httptest.NewRequest("POST", "/auth/register", bytes.NewReader(body)))
+		return rr
+	}
+
+	rr := register(name, name+"@example.com")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("register: %d %s", rr.Code, rr.Body.String())
+	}
+	if bytes.Contains(rr.Body.Bytes(), []byte("PasswordHash")) {
+		t.Fatalf("password hash leaked: %s", rr.Body.String())
+	}
+	if rr := register(name, "other-"+name+"@example.com"); rr.Code != http.StatusConflict {
+		t.Fatalf("duplicate username: expected 409, got %d", rr.Code)
+	}
+	if rr := register("other-"+name, name+"@example.com"); rr.Code != http.StatusConflict {
+		t.Fatalf("duplicate email: expected 409, got %d", rr.Code)
+	}
+
+	if _, _, err := auth.Login(name, "wrong password"); !errors.Is(err, services.ErrInvalidCredentials) {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+	if _, _, err := auth.Login("nobody-"+name, "correct horse"); !errors.Is(err, services.ErrInvalidCredentials) {
+		t.Fatalf("expected invalid credentials for unknown user, got %v", err)
+	}
+	pair, user, err := auth.Login(name+"@example.com", "correct horse")
+	if err != nil {
+		t.Fatalf("login by email: %v", err)
+	}
+
+	// the issued token must be accepted by AuthMiddleware and resolve to the same user
+	var seen string
+	authMw := middleware.AuthMiddleware(middleware.AuthOptions{JWTSecret: testJWTSecret, DB: conn})
+	h := authMw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = middleware.GetUser(r.Context()).ID.String()
+	}))
+	req := httptest.NewRequest("GET", "/files", nil)
+	req.Header.Set("Authorization", "Bearer "+pair.AccessToken)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || seen != user.ID.String() {
+		t.Fatalf("token rejected: %d, user %q", rr.Code, seen)
+	}
+}
+
+// TestSessionRevocation covers refresh rotation, reuse detection and logout.
+func TestSessionRevocation(t *testing.T) {
+	_, _, conn := SetupTest(t)
+	auth := services.NewAuthService(conn, tokens.NewHMACKeySet(testJWTSecret), time.Minute, time.Hour)
+	user := newTestUser(t, conn)
+
+	authMw := middleware.AuthMiddleware(middleware.AuthOptions{JWTSecret: testJWTSecret, DB: conn})
+	ok := authMw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	status := func(accessToken string) int {
+		req := httptest.NewRequest("GET", "/files", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		rr := httptest.NewRecorder()
+		ok.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	first, err := auth.IssueTokens(user)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	second, err := auth.Refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if status(second.AccessToken) != http.StatusOK {
+		t.Fatalf("refreshed access token rejected")
+	}
+
+	// replaying the rotated-out token kills the session, including the fresh tokens
+	if _, err := auth.Refresh(first.RefreshToken); !errors.Is(err, services.ErrRefreshTokenReused) {
+		t.Fatalf("expected reuse detection, got %v", err)
+	}
+	if _, err := auth.Refresh(second.RefreshToken); !errors.Is(err, services.ErrInvalidRefreshToken) {
+		t.Fatalf("expected revoked session, got %v", err)
+	}
+	if code := status(second.AccessToken); code != http.StatusUnauthorized {
+		t.Fatalf("revoked session still accepted: %d", code)
+	}
+
+	// logout revokes just that session, logout-all the rest
+	a, _ := auth.IssueTokens(user)
+	b, _ := auth.IssueTokens(user)
+	logout := func(accessToken string, all bool) {
+		req := httptest.NewRequest("POST", "/auth/logout", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		rr := httptest.NewRecorder()
+		authMw(api.NewLogoutHandler(auth, all)).ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("logout: %d", rr.Code)
+		}
+	}
+	logout(a.AccessToken, false)
+	if status(a.AccessToken) != http.StatusUnauthorized || status(b.AccessToken) != http.StatusOK {
+		t.Fatalf("logout should only revoke its own session")
+	}
+	c, _ := auth.IssueTokens(user)
+	logout(c.AccessToken, true)
+	if status(b.AccessToken) != http.StatusUnauthorized {
+		t.Fatalf("logout-all left a session alive")
+	}
+}
@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"backend/internal/cdc"
+)
+
+// chunkAll splits data and returns the chunks (copied, the chunker reuses its buffer)
+func chunkAll(t *testing.T, data []byte, opts cdc.Options) [][]byte {
+	t.Helper()
+	var chunks [][]byte
+	c := cdc.NewChunker(bytes.NewReader(data), opts)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+// TestContentDefinedChunking checks chunk bounds and that an insertion only changes nearby chunks.
+func TestContentDefinedChunking(t *testing.T) {
+	opts := cdc.WithAverage(4096)
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("options: %v", err)
+	}
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := chunkAll(t, data, opts)
+	if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, data) {
+		t.Fatalf("chunks don't add up to the input")
+	}
+	for i, c := range chunks {
+		if len(c) > opts.MaxSize || (len(c) < opts.MinSize && i != len(chunks)-1) {
+			t.Fatalf("chunk %d has %d bytes, outside %d..%d", i, len(c), opts.MinSize, opts.MaxSize)
+		}
+	}
+	if avg := len(data) / len(chunks); avg < opts.AvgSize/2 || avg > opts.AvgSize*2 {
+		t.Fatalf("average chunk size %d, expected around %d", avg, opts.AvgSize)
+	}
+
+	// one byte inserted in the middle: everything but the chunks around it is unchanged
+	edited := append(append(append([]byte(nil), data[:len(data)/2]...), 'x'), data[len(data)/2:]...)
+	seen := map[string]bool{}
+	for _, c := range chunks {
+		seen[string(c)] = true
+	}
+	editedChunks := chunkAll(t, edited, opts)
+	changed := 0
+	for _, c := range editedChunks {
+		if !seen[string(c)] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 3 {
+		t.Fatalf("%d of %d chunks changed after a one byte insertion", changed, len(editedChunks))
+	}
+
+	if err := (cdc.Options{MinSize: 10, AvgSize: 20, MaxSize: 40}).Validate(); err == nil {
+		t.Fatalf("tiny chunk sizes should be rejected")
+	}
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"backend/internal/cdc"
+	"backend/internal/db"
+	"backend/internal/services"
+	"backend/internal/storage"
+)
+
+// TestChunkDedup stores two versions of a file in chunk mode, reads them back
+// and checks chunks are shared, released and collected.
+func TestChunkDedup(t *testing.T) {
+	_, _, conn := SetupTest(t)
+	ctx := context.Background()
+	store := storage.NewMemoryStorage()
+	fs := services.NewFileService(conn, store)
+	opts := cdc.WithAverage(1024)
+	fs.SetChunking(&opts)
+	user := newTestUser(t, conn)
+
+	original := make([]byte, 64<<10)
+	rand.Read(original)
+	edited := append([]byte(nil), original...)
+	edited[len(edited)/2] ^= 0xff
+
+	firstID := uploadFile(t, fs, user, "v1.bin", string(original))
+	secondID := uploadFile(t, fs, user, "v2.bin", string(edited))
+	var first, second db.File
+	conn.First(&first, "id = ?", firstID)
+	conn.First(&second, "id = ?", secondID)
+	if !first.Chunked || !second.Chunked {
+		t.Fatalf("files should be chunked: %+v %+v", first, second)
+	}
+
+	read := func(file *db.File, offset, length int64) []byte {
+		rc, err := fs.OpenRange(ctx, file, offset, length)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		defer rc.Close()
+		body, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return body
+	}
+	if !bytes.Equal(read(&first, 0, -1), original) || !bytes.Equal(read(&second, 0, -1), edited) {
+		t.Fatalf("reassembled content differs")
+	}
+	if got := read(&second, 30000, 5000); !bytes.Equal(got, edited[30000:35000]) {
+		t.Fatalf("range across chunks differs")
+	}
+
+	// the second version only stored the chunks around the change
+	chunkObjects, _ := store.List(ctx, services.ChunkPrefix)
+	var storedBytes int64
+	for _, obj := range chunkObjects {
+		storedBytes += obj.Size
+	}
+	if storedBytes >= int64(len(original))*3/2 {
+		t.Fatalf("stored %d bytes of chunks for two versions of %d bytes", storedBytes, len(original))
+	}
+	stats, err := services.NewAdminService(conn).GetSystemStats()
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	if dedup := stats["dedup"].(*services.DedupStats); dedup.ChunkLevelSavings <= 0 {
+		t.Fatalf("expected chunk level savings: %+v", dedup)
+	}
+
+	// the same chunks in opposite order, stored at the same time, must not deadlock
+	a, b := make([]byte, 32<<10), make([]byte, 32<<10)
+	rand.Read(a)
+	rand.Read(b)
+	errs := make(chan error, 2)
+	for _, content := range [][]byte{append(append([]byte(nil), a...), b...), append(append([]byte(nil), b...), a...)} {
+		go func(content []byte) {
+			_, err := fs.ProcessStream(ctx, user.ID, "swapped.bin", nil, bytes.NewReader(content), "")
+			errs <- err
+		}(content)
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatalf("concurrent chunked uploads: %v", err)
+		}
+	}
+
+	// dropping the first version frees only its own chunks
+	if err := fs.DeleteUserFile(ctx, user.ID, firstID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	report, err := services.NewGarbageCollector(fs, time.Hour).Run(ctx)
+	if err != nil || report.ChunksDeleted == 0 {
+		t.Fatalf("gc should remove the unused chunks: %v %+v", err, report)
+	}
+	if !bytes.Equal(read(&second, 0, -1), edited) {
+		t.Fatalf("second version damaged by deleting the first")
+	}
+}
@@ -2,6 +2,9 @@ package tests
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http/httptest"
@@ -11,6 +14,10 @@ import (
 	"backend/internal/api"
 	"backend/internal/db"
 	"backend/internal/middleware"
+	"backend/internal/services"
+	"backend/internal/storage"
+
+	"github.com/google/uuid"
 )
 
 // TestDedup verifies uploading the same content twice produces a single File but two UserFile links (ref count increased).
@@ -60,3 +67,30 @@ func TestDedup(t *testing.T) {
 		t.Fatalf("expected at least 2 user-file references, got %d", len(refs))
 	}
 }
+
+// TestStreamedUploadStaging checks streamed uploads end up under the content
+// hash and leave no staging objects behind, whether or not the content was new.
+func TestStreamedUploadStaging(t *testing.T) {
+	_, _, conn := SetupTest(t)
+	ctx := context.Background()
+	store := storage.NewMemoryStorage()
+	fs := services.NewFileService(conn, store)
+	user := newTestUser(t, conn)
+
+	content := "streamed " + uuid.NewString()
+	first := uploadFile(t, fs, user, "a.txt", content)
+	second := uploadFile(t, fs, newTestUser(t, conn), "b.txt", content)
+	if first != second {
+		t.Fatalf("expected the second upload to dedup: %s vs %s", first, second)
+	}
+
+	objects, _ := store.List(ctx, "")
+	if len(objects) != 1 || objects[0].Key != fmt.Sprintf("%x", sha256.Sum256([]byte(content))) {
+		t.Fatalf("expected only the content object, got %+v", objects)
+	}
+	var file db.File
+	conn.First(&file, "id = ?", first)
+	if file.Size != int64(len(content)) || file.RefCount != 2 {
+		t.Fatalf("unexpected file row: %+v", file)
+	}
+}
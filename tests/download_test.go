@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"backend/internal/api"
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// uploadFile pushes content through the upload handler and returns the resulting file ID
+func uploadFile(t *testing.T, fs *services.FileService, user *db.User, name, content string) uuid.UUID {
+	t.Helper()
+	return uploadFileTo(t, fs, user, nil, name, content)
+}
+
+// uploadFileTo is uploadFile into a folder
+func uploadFileTo(t *testing.T, fs *services.FileService, user *db.User, folderID *uuid.UUID, name, content string) uuid.UUID {
+	t.Helper()
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	if folderID != nil {
+		w.WriteField("folder_id", folderID.String())
+	}
+	part, _ := w.CreateFormFile("myFile", name)
+	io.Copy(part, strings.NewReader(content))
+	w.Close()
+
+	req := httptest.NewRequest("POST", "/upload", &b)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req = req.WithContext(middleware.WithUser(req.Context(), user))
+	rr := httptest.NewRecorder()
+	api.NewUploadHandler(fs).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", rr.Code, rr.Body.String())
+	}
+
+	var results []api.UploadResult
+	if err := json.NewDecoder(rr.Body).Decode(&results); err != nil || len(results) != 1 || results[0].Error != "" {
+		t.Fatalf("unexpected upload result: %v %+v", err, results)
+	}
+	return uuid.MustParse(results[0].FileID)
+}
+
+// TestDownloadContent covers full, ranged and conditional downloads.
+func TestDownloadContent(t *testing.T) {
+	fs, user, conn := SetupTest(t)
+	content := "download me " + uuid.NewString()
+	fileID := uploadFile(t, fs, user, "dl.txt", content)
+
+	router := mux.NewRouter()
+	router.Handle("/files/{id}/content", api.NewDownloadHandler(fs))
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/files/"+fileID.String()+"/content", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		req = req.WithContext(middleware.WithUser(req.Context(), user))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get(nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != content {
+		t.Fatalf("full download: %d %q", rr.Code, rr.Body.String())
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" || rr.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("missing ETag/Accept-Ranges headers: %v", rr.Header())
+	}
+
+	rr = get(map[string]string{"Range": "bytes=0-7"})
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != content[:8] {
+		t.Fatalf("range download: %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = get(map[string]string{"If-None-Match": etag})
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching ETag, got %d", rr.Code)
+	}
+
+	// 200 + 206 count as downloads, the 304 doesn't
+	var uf db.UserFile
+	if err := conn.Where("user_id = ? AND file_id = ?", user.ID, fileID).First(&uf).Error; err != nil {
+		t.Fatalf("load user file: %v", err)
+	}
+	if uf.Downloads != 2 {
+		t.Fatalf("expected 2 downloads, got %d", uf.Downloads)
+	}
+
+	// someone without a copy or a share gets a 404
+	stranger := &db.User{ID: uuid.New(), Username: "stranger"}
+	req := httptest.NewRequest("GET", "/files/"+fileID.String()+"/content", nil)
+	req = req.WithContext(middleware.WithUser(req.Context(), stranger))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for stranger, got %d", rr.Code)
+	}
+}
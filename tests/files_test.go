@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"backend/internal/api"
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// TestPerUserFileNames checks deduplicated users keep their own names, renames and search by name.
+func TestPerUserFileNames(t *testing.T) {
+	fs, user, conn := SetupTest(t)
+	other := newTestUser(t, conn)
+
+	content := "named content " + uuid.NewString()
+	fileID := uploadFile(t, fs, user, "mine.txt", content)
+	if id := uploadFile(t, fs, other, `C:\docs\theirs.txt`, content); id != fileID {
+		t.Fatalf("expected dedup onto %s, got %s", fileID, id)
+	}
+
+	var names []string
+	conn.Model(&db.UserFile{}).Where("file_id = ?", fileID).Order("file_name").Pluck("file_name", &names)
+	if strings.Join(names, ",") != "mine.txt,theirs.txt" {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/files/{id}", api.NewUpdateFileHandler(fs))
+	newName := "renamed-" + uuid.NewString()[:8] + ".txt"
+	req := httptest.NewRequest("PATCH", "/files/"+fileID.String(), strings.NewReader(`{"file_name":"`+newName+`","description":"quarterly"}`))
+	req = req.WithContext(middleware.WithUser(req.Context(), user))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("rename failed: %d %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("PATCH", "/files/"+fileID.String(), strings.NewReader(`{"file_name":"../etc/passwd"}`))
+	req = req.WithContext(middleware.WithUser(req.Context(), user))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a name with separators, got %d", rr.Code)
+	}
+
+	search := services.NewSearchService(conn)
+	found, err := search.SearchFiles(user.ID, newName[:12])
+	if err != nil || len(found) != 1 || found[0].FileName != newName || found[0].Description != "quarterly" {
+		t.Fatalf("search by new name: %v %+v", err, found)
+	}
+	// the other user's copy keeps its name
+	found, _ = search.SearchFiles(other.ID, "theirs")
+	if len(found) != 1 {
+		t.Fatalf("expected other user's file under its own name, got %d", len(found))
+	}
+}
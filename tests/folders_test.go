@@ -0,0 +1,168 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"backend/internal/api"
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// TestFolderFiles uploads into a folder, lists it and moves the file back to the root.
+func TestFolderFiles(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	user := newTestUser(t, conn)
+	folders := services.NewFolderService(conn, fs)
+
+	docs, err := folders.CreateFolder(user.ID, "docs", nil)
+	if err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	sub, err := folders.CreateFolder(user.ID, "2026", &docs.ID)
+	if err != nil {
+		t.Fatalf("create subfolder: %v", err)
+	}
+	fileID := uploadFileTo(t, fs, user, &docs.ID, "report.pdf", "report "+uuid.NewString())
+
+	contents, err := folders.ListContents(user.ID, &docs.ID)
+	if err != nil {
+		t.Fatalf("list contents: %v", err)
+	}
+	if len(contents.Folders) != 1 || contents.Folders[0].ID != sub.ID {
+		t.Fatalf("expected subfolder in contents, got %+v", contents.Folders)
+	}
+	if len(contents.Files) != 1 || contents.Files[0].FileID != fileID {
+		t.Fatalf("expected uploaded file in contents, got %+v", contents.Files)
+	}
+
+	// someone else's folder is off limits
+	stranger := newTestUser(t, conn)
+	if _, err := folders.ListContents(stranger.ID, &docs.ID); err != services.ErrFolderNotFound {
+		t.Fatalf("expected ErrFolderNotFound for stranger, got %v", err)
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/files/{id}/move", api.NewMoveFileHandler(fs))
+	req := httptest.NewRequest("POST", "/files/"+fileID.String()+"/move", strings.NewReader(`{"folder_id":null}`))
+	req = req.WithContext(middleware.WithUser(req.Context(), user))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("move failed: %d %s", rr.Code, rr.Body.String())
+	}
+
+	root, err := folders.ListContents(user.ID, nil)
+	if err != nil {
+		t.Fatalf("list root: %v", err)
+	}
+	if len(root.Files) != 1 || len(root.Folders) != 1 {
+		t.Fatalf("expected 1 file and 1 folder at root, got %d/%d", len(root.Files), len(root.Folders))
+	}
+}
+
+// TestFolderTreeMoveAndRecursiveDelete covers path resolution, tree sizes, cycle detection and recursive delete.
+func TestFolderTreeMoveAndRecursiveDelete(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	user := newTestUser(t, conn)
+	other := newTestUser(t, conn)
+	folders := services.NewFolderService(conn, fs)
+	ctx := context.Background()
+
+	docs, _ := folders.CreateFolder(user.ID, "docs", nil)
+	year, _ := folders.CreateFolder(user.ID, "2026", &docs.ID)
+	shared := "shared " + uuid.NewString()
+	reportID := uploadFileTo(t, fs, user, &year.ID, "report.pdf", shared)
+	uploadFileTo(t, fs, user, &docs.ID, "notes.txt", "notes "+uuid.NewString())
+	// same content held by another user, must survive the recursive delete
+	uploadFile(t, fs, other, "copy.pdf", shared)
+
+	entry, err := folders.ResolvePath(user.ID, "/docs/2026/report.pdf")
+	if err != nil || entry.Type != "file" || *entry.ID != reportID {
+		t.Fatalf("resolve file: %v %+v", err, entry)
+	}
+	entry, err = folders.ResolvePath(user.ID, "/docs/2026/")
+	if err != nil || entry.Type != "folder" || *entry.ID != year.ID {
+		t.Fatalf("resolve folder: %v %+v", err, entry)
+	}
+	if _, err := folders.ResolvePath(user.ID, "/docs/nope"); err != services.ErrPathNotFound {
+		t.Fatalf("expected ErrPathNotFound, got %v", err)
+	}
+
+	tree, err := folders.GetTree(user.ID)
+	if err != nil || len(tree.Folders) != 1 {
+		t.Fatalf("tree: %v %+v", err, tree)
+	}
+	docsNode := tree.Folders[0]
+	if len(docsNode.Folders) != 1 || docsNode.TotalSize != docsNode.Size+docsNode.Folders[0].TotalSize || docsNode.Folders[0].TotalSize == 0 {
+		t.Fatalf("unexpected aggregated sizes: %+v", docsNode)
+	}
+
+	if _, err := folders.MoveFolder(user.ID, docs.ID, &year.ID); err != services.ErrFolderCycle {
+		t.Fatalf("expected ErrFolderCycle, got %v", err)
+	}
+	if _, err := folders.MoveFolder(user.ID, year.ID, nil); err != nil {
+		t.Fatalf("move to root: %v", err)
+	}
+	if _, err := folders.MoveFolder(user.ID, year.ID, &docs.ID); err != nil {
+		t.Fatalf("move back: %v", err)
+	}
+
+	if err := folders.DeleteFolder(ctx, user.ID, docs.ID); err != nil {
+		t.Fatalf("recursive delete: %v", err)
+	}
+	var left int64
+	conn.Model(&db.UserFile{}).Where("user_id = ?", user.ID).Count(&left)
+	if left != 0 {
+		t.Fatalf("expected all user files released, %d left", left)
+	}
+	var file db.File
+	if err := conn.First(&file, "id = ?", reportID).Error; err != nil || file.RefCount != 1 {
+		t.Fatalf("shared content should remain with ref_count 1: %v %+v", err, file)
+	}
+}
+
+// TestFolderDeleteWithConcurrentUploads uploads into a subtree while it is being
+// deleted: each upload either lands before and is released, or finds the folder gone.
+func TestFolderDeleteWithConcurrentUploads(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	user := newTestUser(t, conn)
+	folders := services.NewFolderService(conn, fs)
+	ctx := context.Background()
+
+	top, _ := folders.CreateFolder(user.ID, "top", nil)
+	sub, _ := folders.CreateFolder(user.ID, "sub", &top.ID)
+	for i := 0; i < 3; i++ {
+		uploadFileTo(t, fs, user, &sub.ID, "before.txt", "before "+uuid.NewString())
+	}
+
+	const uploads = 5
+	errs := make(chan error, uploads)
+	for i := 0; i < uploads; i++ {
+		go func() {
+			_, err := fs.ProcessStream(ctx, user.ID, "during.txt", &sub.ID, strings.NewReader("during "+uuid.NewString()), "")
+			errs <- err
+		}()
+	}
+	if err := folders.DeleteFolder(ctx, user.ID, top.ID); err != nil {
+		t.Fatalf("recursive delete: %v", err)
+	}
+	for i := 0; i < uploads; i++ {
+		if err := <-errs; err != nil && err != services.ErrFolderNotFound {
+			t.Fatalf("upload during delete: %v", err)
+		}
+	}
+
+	var stranded int64
+	conn.Model(&db.UserFile{}).Where("user_id = ? AND folder_id IN ?", user.ID, []uuid.UUID{top.ID, sub.ID}).Count(&stranded)
+	if stranded != 0 {
+		t.Fatalf("%d files left in deleted folders", stranded)
+	}
+}
@@ -0,0 +1,53 @@
+package tests
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"backend/internal/services"
+	"backend/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// TestDeleteAndGarbageCollect checks the last reference removes the object and the GC reclaims orphans only.
+func TestDeleteAndGarbageCollect(t *testing.T) {
+	_, user, conn := SetupTest(t)
+	ctx := context.Background()
+
+	store := storage.NewMemoryStorage()
+	fs := services.NewFileService(conn, store)
+
+	content := "gc me " + uuid.NewString()
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	fileID := uploadFile(t, fs, user, "gc.txt", content)
+
+	orphan := "orphan-" + uuid.NewString()
+	store.Put(ctx, orphan, "text/plain", strings.NewReader("nobody wants me"), -1)
+
+	report, err := services.NewGarbageCollector(fs, 0).Run(ctx)
+	if err != nil {
+		t.Fatalf("gc run: %v", err)
+	}
+	if report.ObjectsDeleted < 1 {
+		t.Fatalf("expected the orphan to be collected, report: %+v", report)
+	}
+	if _, err := store.Stat(ctx, orphan); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("orphan still stored: %v", err)
+	}
+	if _, err := store.Stat(ctx, key); err != nil {
+		t.Fatalf("referenced object was collected: %v", err)
+	}
+
+	// dropping the only reference deletes the content right away
+	if err := fs.DeleteUserFile(ctx, user.ID, fileID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.Stat(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("object not removed after last reference: %v", err)
+	}
+}
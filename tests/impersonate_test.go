@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"backend/internal/api"
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/services"
+	"backend/internal/tokens"
+)
+
+// TestImpersonation checks that identity only comes from the auth context and
+// that admin impersonation is restricted and audited.
+func TestImpersonation(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	keys := tokens.NewHMACKeySet(testJWTSecret)
+	auth := services.NewAuthService(conn, keys, time.Minute, time.Hour)
+	audit := services.NewAuditService(conn)
+
+	target := newTestUser(t, conn)
+	uploadFile(t, fs, target, "target.txt", "belongs to target "+target.ID.String())
+	admin := newTestUser(t, conn)
+	conn.Model(admin).Updates(map[string]interface{}{"is_admin": true, "totp_enabled": true})
+	other := newTestUser(t, conn)
+
+	authMw := middleware.AuthMiddleware(middleware.AuthOptions{Keys: keys, DB: conn})
+	chain := authMw(middleware.Impersonation(conn, audit)(middleware.QuotaMiddleware(conn)(http.HandlerFunc(api.ListUserFiles))))
+	list := func(accessToken, impersonate string, header map[string]string) (int, []db.UserFile) {
+		req := httptest.NewRequest("GET", "/files", nil)
+		if accessToken != "" {
+			req.Header.Set("Authorization", "Bearer "+accessToken)
+		}
+		if impersonate != "" {
+			req.Header.Set(middleware.ImpersonateHeader, impersonate)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		chain.ServeHTTP(rr, req)
+		var files []db.UserFile
+		json.NewDecoder(rr.Body).Decode(&files)
+		return rr.Code, files
+	}
+
+	// the old header means nothing anymore
+	if code, _ := list("", "", map[string]string{"X-user-Id": target.ID.String()}); code != http.StatusUnauthorized {
+		t.Fatalf("X-user-Id without token: expected 401, got %d", code)
+	}
+	otherTokens, _ := auth.IssueTokens(other)
+	if code, files := list(otherTokens.AccessToken, "", map[string]string{"X-user-Id": target.ID.String()}); code != 200 || len(files) != 0 {
+		t.Fatalf("X-user-Id switched identity: %d, %d files", code, len(files))
+	}
+	if code, _ := list(otherTokens.AccessToken, target.ID.String(), nil); code != http.StatusForbidden {
+		t.Fatalf("non-admin impersonation: expected 403, got %d", code)
+	}
+
+	adminTokens, _ := auth.IssueTokens(admin)
+	if code, _ := list(adminTokens.AccessToken, target.ID.String(), nil); code != http.StatusForbidden {
+		t.Fatalf("impersonation without mfa session: expected 403, got %d", code)
+	}
+	conn.Model(&db.Session{}).Where("id = ?", sessionOf(t, conn, adminTokens.AccessToken)).Update("mfa_verified", true)
+
+	code, files := list(adminTokens.AccessToken, target.ID.String(), nil)
+	if code != 200 || len(files) != 1 || files[0].UserID != target.ID {
+		t.Fatalf("impersonated listing: %d, %v", code, files)
+	}
+	var entries int64
+	conn.Model(&db.AuditLog{}).Where("actor_id = ? AND action = ? AND target_id = ?", admin.ID, middleware.ActionImpersonate, target.ID.String()).Count(&entries)
+	if entries != 1 {
+		t.Fatalf("expected 1 audit entry, got %d", entries)
+	}
+
+	otherAdmin := newTestUser(t, conn)
+	conn.Model(otherAdmin).Update("is_admin", true)
+	if code, _ := list(adminTokens.AccessToken, otherAdmin.ID.String(), nil); code != http.StatusForbidden {
+		t.Fatalf("impersonating an admin: expected 403, got %d", code)
+	}
+}
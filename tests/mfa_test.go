@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"backend/internal/middleware"
+	"backend/internal/services"
+	"backend/internal/tokens"
+	"backend/internal/totp"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// TestTOTPLogin enrolls an admin, logs in with the second factor and a recovery code.
+func TestTOTPLogin(t *testing.T) {
+	_, _, conn := SetupTest(t)
+	keys := tokens.NewHMACKeySet(testJWTSecret)
+	auth := services.NewAuthService(conn, keys, time.Minute, time.Hour)
+	mfa, err := services.NewMFAService(conn, auth, "Files", "test-encryption-key")
+	if err != nil {
+		t.Fatalf("mfa service: %v", err)
+	}
+
+	name := "admin-" + uuid.NewString()[:8]
+	user, err := auth.Register(services.RegisterInput{Username: name, Email: name + "@example.com", Password: "correct horse"})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	conn.Model(user).Update("is_admin", true)
+
+	authMw := middleware.AuthMiddleware(middleware.AuthOptions{Keys: keys, DB: conn})
+	admin := authMw(middleware.RequireMFA(conn)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	adminStatus := func(accessToken string) int {
+		req := httptest.NewRequest("GET", "/admin/users", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		rr := httptest.NewRecorder()
+		admin.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// admins without a second factor can log in but not use admin routes
+	first, loggedIn, err := auth.Login(name, "correct horse")
+	if err != nil || !first.MFAEnrollmentRequired {
+		t.Fatalf("login: %v, enrollment required %v", err, first != nil && first.MFAEnrollmentRequired)
+	}
+	if code := adminStatus(first.AccessToken); code != http.StatusForbidden {
+		t.Fatalf("admin without mfa: expected 403, got %d", code)
+	}
+
+	enrollment, err := mfa.Enroll(loggedIn)
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	code, _ := totp.Code(enrollment.Secret, totp.Step(time.Now()))
+	session := sessionOf(t, conn, first.AccessToken)
+	recovery, err := mfa.Activate(loggedIn, session, code)
+	if err != nil || len(recovery) == 0 {
+		t.Fatalf("activate: %v", err)
+	}
+	if status := adminStatus(first.AccessToken); status != http.StatusOK {
+		t.Fatalf("session that activated mfa: expected 200, got %d", status)
+	}
+	if err := mfa.Disable(loggedIn, code); !errors.Is(err, services.ErrMFAAdminRequired) {
+		t.Fatalf("admin disabled mfa: %v", err)
+	}
+
+	// password alone now only yields a challenge
+	challenge, _, err := auth.Login(name, "correct horse")
+	if err != nil || !challenge.MFARequired || challenge.AccessToken != "" {
+		t.Fatalf("expected mfa challenge, got %+v %v", challenge, err)
+	}
+	if _, _, err := mfa.CompleteLogin(challenge.MFAToken, code); !errors.Is(err, services.ErrMFAInvalidCode) {
+		t.Fatalf("replayed code accepted: %v", err)
+	}
+	if _, _, err := mfa.CompleteLogin(first.AccessToken, recovery[0]); !errors.Is(err, services.ErrMFAChallenge) {
+		t.Fatalf("access token accepted as mfa token: %v", err)
+	}
+	done, _, err := mfa.CompleteLogin(challenge.MFAToken, recovery[0])
+	if err != nil {
+		t.Fatalf("recovery code login: %v", err)
+	}
+	if status := adminStatus(done.AccessToken); status != http.StatusOK {
+		t.Fatalf("mfa session: expected 200, got %d", status)
+	}
+	if _, _, err := mfa.CompleteLogin(challenge.MFAToken, recovery[0]); !errors.Is(err, services.ErrMFAInvalidCode) {
+		t.Fatalf("recovery code used twice: %v", err)
+	}
+}
+
+// sessionOf returns the session ID AuthMiddleware resolves for an access token
+func sessionOf(t *testing.T, conn *gorm.DB, accessToken string) uuid.UUID {
+	t.Helper()
+	var id uuid.UUID
+	h := middleware.AuthMiddleware(middleware.AuthOptions{JWTSecret: testJWTSecret, DB: conn})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = middleware.GetSessionID(r.Context())
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if id == uuid.Nil {
+		t.Fatalf("access token has no live session")
+	}
+	return id
+}
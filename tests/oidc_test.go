@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"backend/internal/api"
+	"backend/internal/oidc"
+	"backend/internal/services"
+	"backend/internal/tokens"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// stubProvider is a tiny OpenID provider: the test plays the user at the
+// authorize step by calling approve, the token endpoint checks PKCE.
+type stubProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]stubGrant
+}
+
+type stubGrant struct {
+	nonce, challenge string
+	sub, email       string
+	emailVerified    bool
+}
+
+func newStubProvider(t *testing.T, clientID string) *stubProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &stubProvider{key: key, codes: map[string]stubGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "stub", "use": "sig", "alg": "RS256",
+			"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mu.Lock()
+		grant, ok := p.codes[r.Form.Get("code")]
+		delete(p.codes, r.Form.Get("code"))
+		p.mu.Unlock()
+		if id, _, _ := r.BasicAuth(); id != clientID || !ok || oidc.CodeChallenge(r.Form.Get("code_verifier")) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		now := time.Now()
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, oidc.Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    p.URL,
+				Subject:   grant.sub,
+				Audience:  jwt.ClaimStrings{clientID},
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			},
+			Nonce:         grant.nonce,
+			Email:         grant.email,
+			EmailVerified: grant.emailVerified,
+		})
+		tok.Header["kid"] = "stub"
+		signed, _ := tok.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// approve stands in for the user logging in at the provider
+func (p *stubProvider) approve(authURL *url.URL, sub, email string, verified bool) string {
+	code := uuid.NewString()
+	q := authURL.Query()
+	p.mu.Lock()
+	p.codes[code] = stubGrant{nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), sub: sub, email: email, emailVerified: verified}
+	p.mu.Unlock()
+	return code
+}
+
+// TestOIDCLogin runs the authorization code flow against the stub provider.
+func TestOIDCLogin(t *testing.T) {
+	_, _, conn := SetupTest(t)
+	keys := tokens.NewHMACKeySet(testJWTSecret)
+	auth := services.NewAuthService(conn, keys, time.Minute, time.Hour)
+	stub := newStubProvider(t, "files-app")
+	provider := oidc.NewProvider(oidc.Config{
+		Issuer:       stub.URL,
+		ClientID:     "files-app",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/auth/oidc/callback",
+		Scopes:       []string{"email"},
+	})
+	svc := services.NewOIDCService(conn, provider, auth, keys)
+
+	type result struct {
+		code int
+		user string
+		body api.AuthResponse
+	}
+	login := func(sub, email string, verified bool, tamperState bool) result {
+		rr := httptest.NewRecorder()
+		api.NewOIDCLoginHandler(svc)(rr, httptest.NewRequest("GET", "/auth/oidc/login", nil))
+		if rr.Code != http.StatusFound {
+			t.Fatalf("login redirect: %d %s", rr.Code, rr.Body.String())
+		}
+		authURL, _ := url.Parse(rr.Header().Get("Location"))
+		if authURL.Query().Get("code_challenge_method") != "S256" {
+			t.Fatalf("login without PKCE: %s", authURL)
+		}
+		code := stub.approve(authURL, sub, email, verified)
+		state := authURL.Query().Get("state")
+		if tamperState {
+			state = "forged"
+		}
+
+		req := httptest.NewRequest("GET", "/auth/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+		for _, c := range rr.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		cb := httptest.NewRecorder()
+		api.NewOIDCCallbackHandler(svc)(cb, req)
+		res := result{code: cb.Code}
+		if cb.Code == http.StatusOK {
+			json.NewDecoder(cb.Body).Decode(&res.body)
+			res.user = res.body.User.ID.String()
+		}
+		return res
+	}
+
+	sub := uuid.NewString()
+	email := "oidc-" + sub[:8] + "@example.com"
+	first := login(sub, email, true, false)
+	if first.code != http.StatusOK || first.body.AuthTokens == nil || first.body.AccessToken == "" {
+		t.Fatalf("first login: %d", first.code)
+	}
+	if first.body.User.Email != email {
+		t.Fatalf("provisioned user has email %q", first.body.User.Email)
+	}
+	// the provider account is linked now, even if the email changes there
+	if again := login(sub, "changed-"+email, true, false); again.user != first.user {
+		t.Fatalf("second login resolved to %s, want %s", again.user, first.user)
+	}
+
+	// an existing local account is linked by email
+	local := newTestUser(t, conn)
+	if linked := login(uuid.NewString(), local.Email, true, false); linked.user != local.ID.String() {
+		t.Fatalf("expected link to existing user %s, got %s", local.ID, linked.user)
+	}
+
+	if res := login(uuid.NewString(), "unverified-"+email, false, false); res.code != http.StatusUnauthorized {
+		t.Fatalf("unverified email: expected 401, got %d", res.code)
+	}
+	if res := login(uuid.NewString(), "forged-"+email, true, true); res.code != http.StatusBadRequest {
+		t.Fatalf("forged state: expected 400, got %d", res.code)
+	}
+}
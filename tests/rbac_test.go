@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"backend/internal/api"
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/rbac"
+	"backend/internal/services"
+	"backend/internal/tokens"
+
+	"github.com/google/uuid"
+)
+
+// TestRolePermissions checks admin routes against the support and admin roles.
+func TestRolePermissions(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	admins := services.NewAdminService(conn)
+	handler := api.NewAdminHandler(admins, services.NewUserDeletionService(conn, fs), services.NewAuditService(conn), services.NewGarbageCollector(fs, time.Hour), tokens.NewHMACKeySet(testJWTSecret))
+
+	admin := newTestUser(t, conn)
+	if _, err := admins.SetRole(admin.ID, rbac.RoleAdmin); err != nil {
+		t.Fatalf("make admin: %v", err)
+	}
+	conn.First(admin, "id = ?", admin.ID)
+	if !admin.IsAdmin || admin.Role != rbac.RoleAdmin {
+		t.Fatalf("admin role not applied: %+v", admin)
+	}
+	staff := newTestUser(t, conn)
+	if _, err := admins.SetRole(staff.ID, "superuser"); err == nil {
+		t.Fatalf("unknown role accepted")
+	}
+	if _, err := admins.SetRole(staff.ID, rbac.RoleSupport); err != nil {
+		t.Fatalf("make support: %v", err)
+	}
+	conn.First(staff, "id = ?", staff.ID)
+	victim := newTestUser(t, conn)
+
+	call := func(user *db.User, method, path string, body interface{}) int {
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(body)
+		req := httptest.NewRequest(method, path, &buf)
+		req = req.WithContext(middleware.WithUser(req.Context(), user))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := call(staff, "GET", "/users", nil); code != http.StatusOK {
+		t.Fatalf("support listing users: expected 200, got %d", code)
+	}
+	if code := call(staff, "GET", "/stats", nil); code != http.StatusOK {
+		t.Fatalf("support reading stats: expected 200, got %d", code)
+	}
+	if code := call(staff, "DELETE", "/users/delete?id="+victim.ID.String(), nil); code != http.StatusForbidden {
+		t.Fatalf("support deleting a user: expected 403, got %d", code)
+	}
+	if code := call(staff, "POST", "/users/role", api.SetRoleRequest{UserID: staff.ID.String(), Role: rbac.RoleAdmin}); code != http.StatusForbidden {
+		t.Fatalf("support promoting itself: expected 403, got %d", code)
+	}
+	if code := call(victim, "GET", "/users", nil); code != http.StatusForbidden {
+		t.Fatalf("regular user listing users: expected 403, got %d", code)
+	}
+	if code := call(admin, "POST", "/users/role", api.SetRoleRequest{UserID: victim.ID.String(), Role: rbac.RoleQuotaManager}); code != http.StatusOK {
+		t.Fatalf("admin assigning a role: expected 200, got %d", code)
+	}
+}
+
+// TestLastActingAdmin keeps the last admin who can still act: suspended admins
+// and admins queued for deletion don't count. Runs in a transaction that is
+// rolled back, so the other admins of the shared database can be set aside.
+func TestLastActingAdmin(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	first := newTestUser(t, conn)
+	second := newTestUser(t, conn)
+	queued := newTestUser(t, conn)
+
+	tx := conn.Begin()
+	defer tx.Rollback()
+	tx.Model(&db.User{}).Where("is_admin = true").Updates(map[string]interface{}{"is_admin": false, "role": rbac.RoleUser})
+	tx.Model(&db.User{}).Where("id IN ?", []uuid.UUID{first.ID, second.ID, queued.ID}).
+		Updates(map[string]interface{}{"is_admin": true, "role": rbac.RoleAdmin})
+	tx.Model(&db.User{}).Where("id = ?", second.ID).Update("suspended_at", time.Now())
+	tx.Create(&db.UserDeletion{UserID: queued.ID, Username: queued.Username, Status: services.DeletionPending})
+
+	admins := services.NewAdminService(tx)
+	deletions := services.NewUserDeletionService(tx, fs)
+	if _, err := admins.SetRole(first.ID, rbac.RoleUser); err != services.ErrLastAdmin {
+		t.Fatalf("demoting the only acting admin: expected ErrLastAdmin, got %v", err)
+	}
+	if _, err := admins.SetSuspended(first.ID, true); err != services.ErrLastAdmin {
+		t.Fatalf("suspending the only acting admin: expected ErrLastAdmin, got %v", err)
+	}
+	if _, err := deletions.Request(first.ID, nil, nil); err != services.ErrLastAdmin {
+		t.Fatalf("deleting the only acting admin: expected ErrLastAdmin, got %v", err)
+	}
+
+	if _, err := admins.SetSuspended(second.ID, false); err != nil {
+		t.Fatalf("reinstate: %v", err)
+	}
+	if _, err := admins.SetRole(first.ID, rbac.RoleUser); err != nil {
+		t.Fatalf("demote with another acting admin: %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/internal/api"
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/services"
+	"backend/internal/storage"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// TestResumableUpload sends a file in chunks, resumes after a wrong offset and
+// finalizes into the same content a regular upload would produce.
+func TestResumableUpload(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	uploads := services.NewUploadService(conn, fs, time.Hour)
+	user := newTestUser(t, conn)
+
+	r := mux.NewRouter()
+	r.Handle("/uploads", api.NewCreateUploadHandler(uploads)).Methods("POST")
+	r.Handle("/uploads/{id}", api.NewUploadChunkHandler(uploads)).Methods("HEAD", "PATCH", "DELETE")
+	r.Handle("/uploads/{id}/finalize", api.NewFinalizeUploadHandler(uploads)).Methods("POST")
+	do := func(method, path string, body []byte, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		req = req.WithContext(middleware.WithUser(req.Context(), user))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	patch := func(loc string, offset int, chunk string) *httptest.ResponseRecorder {
+		return do("PATCH", loc, []byte(chunk), map[string]string{
+			"Content-Type":         api.ChunkContentType,
+			api.UploadOffsetHeader: strconv.Itoa(offset),
+		})
+	}
+
+	content := strings.Repeat("resumable "+uuid.NewString()+"\n", 40)
+	body, _ := json.Marshal(api.CreateUploadRequest{FileName: "big.txt", Size: int64(len(content))})
+	rr := do("POST", "/uploads", body, nil)
+	if rr.Code != http.StatusCreated || rr.Header().Get(api.UploadOffsetHeader) != "0" {
+		t.Fatalf("create: %d %s", rr.Code, rr.Body.String())
+	}
+	loc := rr.Header().Get("Location")
+
+	if rr := do("PATCH", loc, []byte("x"), map[string]string{api.UploadOffsetHeader: "0"}); rr.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("wrong content type: expected 415, got %d", rr.Code)
+	}
+	if rr := patch(loc, 0, content[:500]); rr.Code != http.StatusNoContent || rr.Header().Get(api.UploadOffsetHeader) != "500" {
+		t.Fatalf("first chunk: %d %s", rr.Code, rr.Header().Get(api.UploadOffsetHeader))
+	}
+	// a client that lost track is told where to resume
+	if rr := patch(loc, 0, content[:500]); rr.Code != http.StatusConflict || rr.Header().Get(api.UploadOffsetHeader) != "500" {
+		t.Fatalf("stale offset: expected 409 at 500, got %d %s", rr.Code, rr.Header().Get(api.UploadOffsetHeader))
+	}
+	if rr := do("POST", loc+"/finalize", nil, nil); rr.Code != http.StatusConflict {
+		t.Fatalf("finalize of a partial upload: expected 409, got %d", rr.Code)
+	}
+	if rr := do("HEAD", loc, nil, nil); rr.Header().Get(api.UploadOffsetHeader) != "500" || rr.Header().Get(api.UploadLengthHeader) != strconv.Itoa(len(content)) {
+		t.Fatalf("head: %d %v", rr.Code, rr.Header())
+	}
+	if rr := patch(loc, 500, content[500:]+"overflow"); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("chunk past the end: expected 413, got %d", rr.Code)
+	}
+	if rr := patch(loc, 500, content[500:]); rr.Code != http.StatusNoContent {
+		t.Fatalf("last chunk: %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = do("POST", loc+"/finalize", nil, nil)
+	var res api.UploadResult
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("finalize: %d %v", rr.Code, err)
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256([]byte(content))); res.Hash != want || res.Size != int64(len(content)) {
+		t.Fatalf("finalized %+v, expected sha256 %s", res, want)
+	}
+	var file db.File
+	if err := conn.First(&file, "id = ?", res.FileID).Error; err != nil || !strings.HasPrefix(file.MimeType, "text/plain") {
+		t.Fatalf("file row: %v %+v", err, file)
+	}
+	if rr := do("HEAD", loc, nil, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("finalized upload should be gone, got %d", rr.Code)
+	}
+
+	// the same content through the multipart endpoint dedups onto the file
+	other := newTestUser(t, conn)
+	if id := uploadFile(t, fs, other, "copy.txt", content); id.String() != res.FileID {
+		t.Fatalf("expected dedup onto %s, got %s", res.FileID, id)
+	}
+}
+
+// TestResumableUploadExpiry drops expired sessions and their chunks.
+func TestResumableUploadExpiry(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	ctx := context.Background()
+	uploads := services.NewUploadService(conn, fs, time.Hour)
+	user := newTestUser(t, conn)
+
+	up, err := uploads.CreateUpload(user, "stale.bin", nil, 10)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := uploads.WriteChunk(ctx, user.ID, up.ID, 0, strings.NewReader("12345")); err != nil {
+		t.Fatalf("chunk: %v", err)
+	}
+	conn.Model(up).Update("expires_at", time.Now().Add(-time.Minute))
+	if _, err := uploads.WriteChunk(ctx, user.ID, up.ID, 5, strings.NewReader("67890")); err != services.ErrUploadExpired {
+		t.Fatalf("expected ErrUploadExpired, got %v", err)
+	}
+	if removed, err := uploads.CleanupExpired(ctx); err != nil || removed < 1 {
+		t.Fatalf("cleanup: %d %v", removed, err)
+	}
+	if _, err := uploads.GetUpload(user.ID, up.ID); err != services.ErrUploadNotFound {
+		t.Fatalf("expected ErrUploadNotFound after cleanup, got %v", err)
+	}
+	if _, err := uploads.CreateUpload(user, "huge.bin", nil, user.Quota+1); err != services.ErrQuotaExceeded {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+}
+
+// TestResumableUploadRace lets a second PATCH at the same offset finish while
+// the first one is still streaming: the first must lose and leave no object.
+func TestResumableUploadRace(t *testing.T) {
+	_, _, conn := SetupTest(t)
+	ctx := context.Background()
+	store := storage.NewMemoryStorage()
+	uploads := services.NewUploadService(conn, services.NewFileService(conn, store), time.Hour)
+	user := newTestUser(t, conn)
+
+	up, err := uploads.CreateUpload(user, "race.bin", nil, 10)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	pr, pw := io.Pipe()
+	type result struct {
+		offset int64
+		err    error
+	}
+	slow := make(chan result)
+	go func() {
+		offset, err := uploads.WriteChunk(ctx, user.ID, up.ID, 0, pr)
+		slow <- result{offset, err}
+	}()
+	pw.Write([]byte("aaaaa")) // returns once the slow PATCH is streaming
+
+	if offset, err := uploads.WriteChunk(ctx, user.ID, up.ID, 0, strings.NewReader("12345")); err != nil || offset != 5 {
+		t.Fatalf("fast chunk: %d %v", offset, err)
+	}
+	pw.Close()
+	if res := <-slow; res.err != services.ErrUploadOffset || res.offset != 5 {
+		t.Fatalf("slow chunk should lose at 5, got %d %v", res.offset, res.err)
+	}
+	if objects, _ := store.List(ctx, services.UploadPrefix+up.ID.String()+"/"); len(objects) != 1 {
+		t.Fatalf("expected only the winning chunk to be stored, found %d objects", len(objects))
+	}
+
+	if _, err := uploads.WriteChunk(ctx, user.ID, up.ID, 5, strings.NewReader("67890")); err != nil {
+		t.Fatalf("last chunk: %v", err)
+	}
+	res, err := uploads.Finalize(ctx, user.ID, up.ID)
+	if want := fmt.Sprintf("%x", sha256.Sum256([]byte("1234567890"))); err != nil || res.Hash != want {
+		t.Fatalf("finalize: %v %+v", err, res)
+	}
+}
+
+// TestResumableUploadCleanupOrphans removes chunks of sessions that are gone
+// even when objects that aren't upload chunks sit under the prefix.
+func TestResumableUploadCleanupOrphans(t *testing.T) {
+	_, _, conn := SetupTest(t)
+	ctx := context.Background()
+	store := storage.NewMemoryStorage()
+	uploads := services.NewUploadService(conn, services.NewFileService(conn, store), time.Hour)
+
+	stray := services.UploadPrefix + "not-a-uuid/0"
+	orphan := services.UploadPrefix + uuid.NewString() + "/0"
+	for _, key := range []string{stray, orphan} {
+		if err := store.Put(ctx, key, "application/octet-stream", strings.NewReader("x"), 1); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	if _, err := uploads.CleanupExpired(ctx); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	objects, _ := store.List(ctx, services.UploadPrefix)
+	if len(objects) != 1 || objects[0].Key != stray {
+		t.Fatalf("expected only %s to be left, got %+v", stray, objects)
+	}
+}
+
+// TestResumableUploadQuota finalizes two sessions at once that only fit the
+// quota one at a time: exactly one of them may go through.
+func TestResumableUploadQuota(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	ctx := context.Background()
+	uploads := services.NewUploadService(conn, fs, time.Hour)
+	user := newTestUser(t, conn)
+	user.Quota = 15
+	conn.Model(user).Update("quota", user.Quota)
+
+	var ids []uuid.UUID
+	for i := 0; i < 2; i++ {
+		up, err := uploads.CreateUpload(user, fmt.Sprintf("part%d.bin", i), nil, 10)
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		if _, err := uploads.WriteChunk(ctx, user.ID, up.ID, 0, strings.NewReader(uuid.NewString()[:10])); err != nil {
+			t.Fatalf("chunk: %v", err)
+		}
+		ids = append(ids, up.ID)
+	}
+
+	errs := make(chan error, len(ids))
+	for _, id := range ids {
+		go func(id uuid.UUID) {
+			_, err := uploads.Finalize(ctx, user.ID, id)
+			errs <- err
+		}(id)
+	}
+	var ok, refused int
+	for range ids {
+		switch err := <-errs; err {
+		case nil:
+			ok++
+		case services.ErrQuotaExceeded:
+			refused++
+		default:
+			t.Fatalf("finalize: %v", err)
+		}
+	}
+	if ok != 1 || refused != 1 {
+		t.Fatalf("expected one finalized and one refused, got %d and %d", ok, refused)
+	}
+	conn.First(user, "id = ?", user.ID)
+	if user.UsedStorage > user.Quota {
+		t.Fatalf("used storage %d went past the quota %d", user.UsedStorage, user.Quota)
+	}
+}
@@ -10,7 +10,7 @@ import (
 
 // TestStatsAndSearch ensures /stats and /search handlers respond
 func TestStatsAndSearch(t *testing.T) {
-	fs, user, _ := SetupTest(t)
+	_, user, _ := SetupTest(t)
 
 	// Stats
 	req := httptest.NewRequest("GET", "/stats", nil)
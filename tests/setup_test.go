@@ -43,28 +43,15 @@ func SetupTest(t *testing.T) (*services.FileService, *db.User, *gorm.DB) {
 	}
 
 	// AutoMigrate required models used in tests
-	if err := dbConn.AutoMigrate(&db.User{}, &db.File{}, &db.UserFile{}, &db.Share{}, &db.Folder{}); err != nil {
+	if err := dbConn.AutoMigrate(&db.User{}, &db.File{}, &db.UserFile{}, &db.Share{}, &db.Folder{}, &db.Session{}, &db.APIKey{}, &db.UserIdentity{}, &db.RecoveryCode{}, &db.AuditLog{}, &db.UserDeletion{}, &db.UploadSession{}, &db.UploadChunk{}, &db.Chunk{}, &db.FileChunk{}); err != nil {
 		t.Fatalf("migrate error: %v", err)
 	}
 
 	// Save global DB reference used elsewhere
 	db.DB = dbConn
 
-	// Ensure MinIO is available (retry)
-	st, err := storage.NewMinioClient(cfg.MinioEndpoint, cfg.MinioAccessKey, cfg.MinioSecretKey, "files", cfg.MinioUseSSL)
-	if err != nil {
-		// retry a few times
-		for i := 0; i < retries; i++ {
-			time.Sleep(2 * time.Second)
-			st, err = storage.NewMinioClient(cfg.MinioEndpoint, cfg.MinioAccessKey, cfg.MinioSecretKey, "files", cfg.MinioUseSSL)
-			if err == nil {
-				break
-			}
-		}
-		if err != nil {
-			t.Fatalf("failed init minio: %v", err)
-		}
-	}
+	// In-memory object storage, so tests only need the database
+	st := storage.NewMemoryStorage()
 
 	// Create test user (fixed UUID for predictability)
 	testUserID := uuid.MustParse("11111111-1111-1111-1111-111111111111")
@@ -87,3 +74,19 @@ func SetupTest(t *testing.T) (*services.FileService, *db.User, *gorm.DB) {
 	fs := services.NewFileService(dbConn, st)
 	return fs, user, dbConn
 }
+
+// newTestUser creates a throwaway user with a random name
+func newTestUser(t *testing.T, conn *gorm.DB) *db.User {
+	t.Helper()
+	name := "user-" + uuid.NewString()[:8]
+	user := &db.User{
+		Username:     name,
+		PasswordHash: "test-hash",
+		Email:        name + "@example.com",
+		Quota:        10485760,
+	}
+	if err := conn.Create(user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	return user
+}
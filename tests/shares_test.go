@@ -0,0 +1,237 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"backend/internal/api"
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// TestShareLimits covers password, download limit, expiry and revoke on share links.
+func TestShareLimits(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	user := newTestUser(t, conn)
+	shares := services.NewShareService(conn)
+	content := "limited " + uuid.NewString()
+	fileID := uploadFile(t, fs, user, "limited.txt", content)
+
+	router := mux.NewRouter()
+	router.Handle("/s/{token}", api.NewGetShareHandler(shares, fs))
+	getShare := func(share *db.Share, password string) (int, string) {
+		req := httptest.NewRequest("GET", "/s/"+share.Token, nil)
+		if password != "" {
+			req.Header.Set(api.SharePasswordHeader, password)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code == 200 {
+			if rr.Body.String() != content {
+				t.Fatalf("share served %q", rr.Body.String())
+			}
+			return rr.Code, ""
+		}
+		var body struct {
+			Code string `json:"code"`
+		}
+		json.NewDecoder(rr.Body).Decode(&body)
+		return rr.Code, body.Code
+	}
+
+	one := 1
+	share, err := shares.CreateShare(user.ID, fileID, true, nil, services.ShareOptions{Password: "s3cret", MaxDownloads: &one})
+	if err != nil {
+		t.Fatalf("create share: %v", err)
+	}
+	if code, errCode := getShare(share, ""); code != 401 || errCode != "share_password_required" {
+		t.Fatalf("expected password required, got %d %s", code, errCode)
+	}
+	if code, errCode := getShare(share, "wrong"); code != 403 || errCode != "share_password_invalid" {
+		t.Fatalf("expected invalid password, got %d %s", code, errCode)
+	}
+	if code, _ := getShare(share, "s3cret"); code != 200 {
+		t.Fatalf("expected share to open, got %d", code)
+	}
+	if code, errCode := getShare(share, "s3cret"); code != 410 || errCode != "share_exhausted" {
+		t.Fatalf("expected exhausted share, got %d %s", code, errCode)
+	}
+
+	// a ranged request uses up a download just the same
+	ranged, err := shares.CreateShare(user.ID, fileID, true, nil, services.ShareOptions{MaxDownloads: &one})
+	if err != nil {
+		t.Fatalf("create share: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/s/"+ranged.Token, nil)
+	req.Header.Set("Range", "bytes=1-")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != 206 || rr.Body.String() != content[1:] {
+		t.Fatalf("expected the rest of the content, got %d %q", rr.Code, rr.Body.String())
+	}
+	if code, errCode := getShare(ranged, ""); code != 410 || errCode != "share_exhausted" {
+		t.Fatalf("ranged request should count as a download, got %d %s", code, errCode)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	if _, err := shares.CreateShare(user.ID, fileID, true, nil, services.ShareOptions{ExpiresAt: &past}); err == nil {
+		t.Fatalf("expected an expiry in the past to be rejected")
+	}
+	future := time.Now().Add(time.Hour)
+	expiring, err := shares.CreateShare(user.ID, fileID, true, nil, services.ShareOptions{ExpiresAt: &future})
+	if err != nil {
+		t.Fatalf("create expiring share: %v", err)
+	}
+	conn.Model(&db.Share{}).Where("id = ?", expiring.ID).Update("expires_at", past)
+	if code, errCode := getShare(expiring, ""); code != 410 || errCode != "share_expired" {
+		t.Fatalf("expected expired share, got %d %s", code, errCode)
+	}
+
+	plain, _ := shares.CreateShare(user.ID, fileID, true, nil, services.ShareOptions{})
+	// the raw row ID is not a valid link
+	if code, _ := getShare(&db.Share{Token: plain.ID.String()}, ""); code != 404 {
+		t.Fatalf("expected 404 for a row ID used as token, got %d", code)
+	}
+	if err := shares.RevokeShare(user.ID, plain.ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if code, errCode := getShare(plain, ""); code != 410 || errCode != "share_revoked" {
+		t.Fatalf("expected revoked share, got %d %s", code, errCode)
+	}
+}
+
+// TestUserShareRoles checks viewer/downloader/editor grants in incoming, search, download and rename.
+func TestUserShareRoles(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	owner := newTestUser(t, conn)
+	recipient := newTestUser(t, conn)
+	shares := services.NewShareService(conn)
+	name := "plan-" + uuid.NewString()[:8] + ".txt"
+	fileID := uploadFile(t, fs, owner, name, "plan "+uuid.NewString())
+
+	if _, err := shares.CreateShare(owner.ID, fileID, false, &recipient.Email, services.ShareOptions{}); err != nil {
+		t.Fatalf("share as viewer: %v", err)
+	}
+	incoming, err := shares.ListIncoming(recipient.ID)
+	if err != nil || len(incoming) != 1 || incoming[0].FileName != name || incoming[0].Role != services.ShareRoleViewer {
+		t.Fatalf("incoming: %v %+v", err, incoming)
+	}
+	found, err := services.NewSearchService(conn).SearchFiles(recipient.ID, name)
+	if err != nil || len(found) != 1 {
+		t.Fatalf("viewer should find the file in search: %v %d", err, len(found))
+	}
+	if _, err := fs.AuthorizeDownload(recipient, fileID); err != services.ErrNoFileAccess {
+		t.Fatalf("viewer must not download, got %v", err)
+	}
+
+	if _, err := shares.CreateShare(owner.ID, fileID, false, &recipient.Username, services.ShareOptions{Role: services.ShareRoleDownloader}); err != nil {
+		t.Fatalf("share as downloader: %v", err)
+	}
+	if _, err := fs.AuthorizeDownload(recipient, fileID); err != nil {
+		t.Fatalf("downloader should download: %v", err)
+	}
+	newName := "renamed.txt"
+	if _, err := fs.UpdateUserFile(recipient.ID, fileID, &newName, nil); err != services.ErrNoFileAccess {
+		t.Fatalf("downloader must not rename, got %v", err)
+	}
+
+	if _, err := shares.CreateShare(owner.ID, fileID, false, &recipient.Username, services.ShareOptions{Role: services.ShareRoleEditor}); err != nil {
+		t.Fatalf("share as editor: %v", err)
+	}
+	uf, err := fs.UpdateUserFile(recipient.ID, fileID, &newName, nil)
+	if err != nil || uf.UserID != owner.ID || uf.FileName != newName {
+		t.Fatalf("editor rename: %v %+v", err, uf)
+	}
+
+	nobody := "nobody-" + uuid.NewString()
+	if _, err := shares.CreateShare(owner.ID, fileID, false, &nobody, services.ShareOptions{}); err != services.ErrShareTargetNotFound {
+		t.Fatalf("expected ErrShareTargetNotFound, got %v", err)
+	}
+	// a limited user share is used up on /files/{id}/content
+	limited := newTestUser(t, conn)
+	one := 1
+	if _, err := shares.CreateShare(owner.ID, fileID, false, &limited.Username, services.ShareOptions{Role: services.ShareRoleDownloader, MaxDownloads: &one}); err != nil {
+		t.Fatalf("share with limit: %v", err)
+	}
+	router := mux.NewRouter()
+	router.Handle("/files/{id}/content", api.NewDownloadHandler(fs))
+	download := func() int {
+		req := httptest.NewRequest("GET", "/files/"+fileID.String()+"/content", nil)
+		req = req.WithContext(middleware.WithUser(req.Context(), limited))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := download(); code != 200 {
+		t.Fatalf("limited share should download once, got %d", code)
+	}
+	if code := download(); code != 404 && code != 410 {
+		t.Fatalf("limited share should be used up, got %d", code)
+	}
+
+	if _, err := shares.CreateShare(owner.ID, fileID, false, &recipient.Username, services.ShareOptions{Password: "s3cret"}); !errors.Is(err, services.ErrInvalidShareOptions) {
+		t.Fatalf("a password on a user share should be rejected, got %v", err)
+	}
+}
+
+// TestShareEndpoint lists, fetches and revokes outgoing shares through /shares.
+func TestShareEndpoint(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	owner := newTestUser(t, conn)
+	shares := services.NewShareService(conn)
+	fileID := uploadFile(t, fs, owner, "out.txt", "outgoing "+uuid.NewString())
+	share, err := shares.CreateShare(owner.ID, fileID, true, nil, services.ShareOptions{})
+	if err != nil {
+		t.Fatalf("create share: %v", err)
+	}
+	shares.ConsumeDownload(share.ID)
+
+	call := func(method, query string, as *db.User) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/shares"+query, nil)
+		req = req.WithContext(middleware.WithUser(req.Context(), as))
+		rr := httptest.NewRecorder()
+		api.NewShareHandler(shares).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := call("GET", "", owner)
+	var list []services.OutgoingShare
+	if err := json.NewDecoder(rr.Body).Decode(&list); err != nil || len(list) != 1 {
+		t.Fatalf("list shares: %d %v %+v", rr.Code, err, list)
+	}
+	if list[0].Downloads != 1 || list[0].FileName != "out.txt" || list[0].Status != "active" {
+		t.Fatalf("unexpected share in list: %+v", list[0])
+	}
+
+	if rr := call("GET", "?id="+share.ID.String(), newTestUser(t, conn)); rr.Code != 404 {
+		t.Fatalf("someone else's share should be 404, got %d", rr.Code)
+	}
+	if rr := call("DELETE", "?id="+share.ID.String(), owner); rr.Code != 200 {
+		t.Fatalf("revoke: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = call("GET", "?id="+share.ID.String(), owner)
+	var one services.OutgoingShare
+	json.NewDecoder(rr.Body).Decode(&one)
+	if one.Status != "revoked" {
+		t.Fatalf("expected revoked status, got %+v", one)
+	}
+
+	// creating answers with the same shape as the list
+	body, _ := json.Marshal(api.CreateShareRequest{FileID: fileID.String(), IsPublic: true})
+	req := httptest.NewRequest("POST", "/shares", bytes.NewReader(body))
+	req = req.WithContext(middleware.WithUser(req.Context(), owner))
+	rr = httptest.NewRecorder()
+	api.NewShareHandler(shares).ServeHTTP(rr, req)
+	var created services.OutgoingShare
+	if err := json.NewDecoder(rr.Body).Decode(&created); err != nil || created.FileName != "out.txt" || created.Status != "active" || created.Token == "" {
+		t.Fatalf("create share: %d %v %+v", rr.Code, err, created)
+	}
+}
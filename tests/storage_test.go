@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"backend/internal/storage"
+)
+
+// TestStorageBackends runs the same put/get/range/stat/list/copy/delete flow against the local and in-memory drivers.
+func TestStorageBackends(t *testing.T) {
+	local, err := storage.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("local storage: %v", err)
+	}
+	backends := map[string]storage.Backend{
+		"memory": storage.NewMemoryStorage(),
+		"local":  local,
+	}
+
+	for name, st := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := st.Put(ctx, "ab/hello", "text/plain", strings.NewReader("hello world"), 11); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+
+			rc, err := st.Get(ctx, "ab/hello")
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			body, _ := io.ReadAll(rc)
+			rc.Close()
+			if string(body) != "hello world" {
+				t.Fatalf("get returned %q", body)
+			}
+
+			rc, err = st.GetRange(ctx, "ab/hello", 6, 3)
+			if err != nil {
+				t.Fatalf("range: %v", err)
+			}
+			body, _ = io.ReadAll(rc)
+			rc.Close()
+			if string(body) != "wor" {
+				t.Fatalf("range returned %q", body)
+			}
+
+			info, err := st.Stat(ctx, "ab/hello")
+			if err != nil || info.Size != 11 {
+				t.Fatalf("stat: %+v %v", info, err)
+			}
+
+			objs, err := st.List(ctx, "ab/")
+			if err != nil || len(objs) != 1 || objs[0].Key != "ab/hello" {
+				t.Fatalf("list: %+v %v", objs, err)
+			}
+
+			if err := st.Copy(ctx, "ab/hello", "cd/hello"); err != nil {
+				t.Fatalf("copy: %v", err)
+			}
+			if info, err := st.Stat(ctx, "cd/hello"); err != nil || info.Size != 11 {
+				t.Fatalf("stat copy: %+v %v", info, err)
+			}
+			if err := st.Copy(ctx, "ab/missing", "cd/missing"); !errors.Is(err, storage.ErrNotFound) {
+				t.Fatalf("copy of a missing key: expected ErrNotFound, got %v", err)
+			}
+
+			if err := st.Delete(ctx, "ab/hello"); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			if _, err := st.Stat(ctx, "ab/hello"); !errors.Is(err, storage.ErrNotFound) {
+				t.Fatalf("expected ErrNotFound after delete, got %v", err)
+			}
+			if err := st.Delete(ctx, "ab/hello"); err != nil {
+				t.Fatalf("deleting a missing key should not fail: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"backend/internal/tokens"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestKeyRotation signs with file backed keys, rotates and checks the grace window and JWKS.
+func TestKeyRotation(t *testing.T) {
+	for _, alg := range []string{tokens.AlgRS256, tokens.AlgEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			dir := t.TempDir()
+			ks, err := tokens.Load(tokens.Options{Dir: dir, Alg: alg, Grace: time.Hour})
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			verify := func(ks *tokens.KeySet, signed string) error {
+				_, err := jwt.ParseWithClaims(signed, &jwt.RegisteredClaims{}, ks.Keyfunc, jwt.WithValidMethods(ks.Methods()))
+				return err
+			}
+			sign := func() string {
+				signed, err := ks.Sign(jwt.RegisteredClaims{Subject: "someone", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))})
+				if err != nil {
+					t.Fatalf("sign: %v", err)
+				}
+				return signed
+			}
+
+			old := sign()
+			oldKID := ks.ActiveKID()
+			if _, err := ks.Rotate(); err != nil {
+				t.Fatalf("rotate: %v", err)
+			}
+			if ks.ActiveKID() == oldKID {
+				t.Fatalf("rotate kept the same signing key")
+			}
+			fresh := sign()
+			if err := verify(ks, old); err != nil {
+				t.Fatalf("token of rotated key rejected inside grace: %v", err)
+			}
+			if err := verify(ks, fresh); err != nil {
+				t.Fatalf("fresh token rejected: %v", err)
+			}
+			if n := len(ks.JWKS().Keys); n != 2 {
+				t.Fatalf("expected 2 published keys, got %d", n)
+			}
+
+			// a restart picks up both keys and signs with the newest
+			reloaded, err := tokens.Load(tokens.Options{Dir: dir, Alg: alg, Grace: time.Hour})
+			if err != nil {
+				t.Fatalf("reload: %v", err)
+			}
+			if reloaded.ActiveKID() != ks.ActiveKID() {
+				t.Fatalf("reload signs with %s, want %s", reloaded.ActiveKID(), ks.ActiveKID())
+			}
+			if err := verify(reloaded, old); err != nil {
+				t.Fatalf("old token rejected after reload: %v", err)
+			}
+
+			// without grace the old key is gone immediately
+			strict, err := tokens.Load(tokens.Options{Dir: dir, Alg: alg})
+			if err != nil {
+				t.Fatalf("reload: %v", err)
+			}
+			if err := verify(strict, old); err == nil {
+				t.Fatalf("old token accepted after grace window")
+			}
+			if n := len(strict.JWKS().Keys); n != 1 {
+				t.Fatalf("expected 1 published key, got %d", n)
+			}
+		})
+	}
+}
+
+// TestKeyAlgorithmConfusion makes sure a token can't pick an HMAC algorithm against a public key.
+func TestKeyAlgorithmConfusion(t *testing.T) {
+	ks, err := tokens.Load(tokens.Options{Dir: t.TempDir(), Alg: tokens.AlgRS256})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "admin"})
+	forged.Header["kid"] = ks.ActiveKID()
+	signed, _ := forged.SignedString([]byte("guess"))
+	if _, err := jwt.Parse(signed, ks.Keyfunc, jwt.WithValidMethods(ks.Methods())); err == nil {
+		t.Fatalf("HS256 token accepted by RS256 key set")
+	}
+	if len(tokens.NewHMACKeySet("secret").JWKS().Keys) != 0 {
+		t.Fatalf("HMAC secret published in JWKS")
+	}
+}
@@ -0,0 +1,36 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"backend/internal/totp"
+)
+
+// TestTOTPVectors checks codes against the RFC 6238 SHA1 test vectors (last 6 digits).
+func TestTOTPVectors(t *testing.T) {
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		got, err := totp.Code(secret, totp.Step(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatalf("code: %v", err)
+		}
+		if got != want {
+			t.Fatalf("T=%d: got %s, want %s", unix, got, want)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	if _, ok := totp.Validate(secret, "081804", now.Add(30*time.Second), 1); !ok {
+		t.Fatalf("code from the previous step rejected with skew 1")
+	}
+	if _, ok := totp.Validate(secret, "081804", now.Add(90*time.Second), 1); ok {
+		t.Fatalf("code two steps old accepted")
+	}
+}
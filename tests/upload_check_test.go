@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"backend/internal/api"
+	"backend/internal/db"
+	"backend/internal/middleware"
+	"backend/internal/services"
+
+	"github.com/google/uuid"
+)
+
+// TestUploadCheck links content the user already holds under a new name
+// without the bytes, never someone else's, and verifies declared hashes on upload.
+func TestUploadCheck(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	owner := newTestUser(t, conn)
+	user := newTestUser(t, conn)
+
+	content := "artifact " + uuid.NewString()
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	fileID := uploadFile(t, fs, owner, "artifact.bin", content)
+	folder, err := services.NewFolderService(conn, fs).CreateFolder(owner.ID, "releases", nil)
+	if err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+
+	check := func(as *db.User, req api.UploadCheckRequest) (*httptest.ResponseRecorder, api.UploadCheckResponse) {
+		body, _ := json.Marshal(req)
+		r := httptest.NewRequest("POST", "/upload/check", bytes.NewReader(body))
+		r = r.WithContext(middleware.WithUser(r.Context(), as))
+		rr := httptest.NewRecorder()
+		api.NewUploadCheckHandler(fs).ServeHTTP(rr, r)
+		var resp api.UploadCheckResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		return rr, resp
+	}
+
+	var before db.User
+	conn.First(&before, "id = ?", owner.ID)
+	rr, resp := check(owner, api.UploadCheckRequest{SHA256: sum, Size: int64(len(content)), FileName: "artifact-v2.bin", FolderID: folder.ID.String()})
+	if rr.Code != http.StatusOK || resp.UploadRequired || resp.FileID != fileID.String() || resp.FileName != "artifact-v2.bin" {
+		t.Fatalf("held content should be linked again: %d %+v", rr.Code, resp)
+	}
+	var entries []db.UserFile
+	conn.Where("user_id = ? AND file_id = ?", owner.ID, fileID).Order("created_at").Find(&entries)
+	if len(entries) != 2 || entries[1].FileName != "artifact-v2.bin" || entries[1].FolderID == nil || *entries[1].FolderID != folder.ID {
+		t.Fatalf("expected a second entry in the folder: %+v", entries)
+	}
+	var file db.File
+	conn.First(&file, "id = ?", fileID)
+	if file.RefCount != 2 {
+		t.Fatalf("expected ref count 2, got %d", file.RefCount)
+	}
+	var after db.User
+	conn.First(&after, "id = ?", owner.ID)
+	if after.UsedStorage != before.UsedStorage+int64(len(content)) {
+		t.Fatalf("used storage went from %d to %d", before.UsedStorage, after.UsedStorage)
+	}
+
+	// knowing hash and size is no proof of having the content
+	if rr, resp := check(user, api.UploadCheckRequest{SHA256: sum, Size: int64(len(content)), FileName: "mine.bin"}); rr.Code != http.StatusOK || !resp.UploadRequired || resp.FileID != "" {
+		t.Fatalf("another user's content must not be linked: %d %+v", rr.Code, resp)
+	}
+	conn.First(&file, "id = ?", fileID)
+	if file.RefCount != 2 {
+		t.Fatalf("expected ref count to stay 2, got %d", file.RefCount)
+	}
+	if _, resp := check(owner, api.UploadCheckRequest{SHA256: sum, Size: 1, FileName: "guess.bin"}); !resp.UploadRequired {
+		t.Fatalf("wrong size should require the bytes: %+v", resp)
+	}
+	if rr, _ := check(user, api.UploadCheckRequest{SHA256: "not-a-hash", FileName: "x"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("invalid hash: expected 400, got %d", rr.Code)
+	}
+
+	upload := func(declared, body string) api.UploadResult {
+		var b bytes.Buffer
+		w := multipart.NewWriter(&b)
+		w.WriteField("sha256", declared)
+		part, _ := w.CreateFormFile("myFile", "new.bin")
+		part.Write([]byte(body))
+		w.Close()
+		r := httptest.NewRequest("POST", "/upload", &b)
+		r.Header.Set("Content-Type", w.FormDataContentType())
+		r = r.WithContext(middleware.WithUser(r.Context(), user))
+		rr := httptest.NewRecorder()
+		api.NewUploadHandler(fs).ServeHTTP(rr, r)
+		var results []api.UploadResult
+		if err := json.NewDecoder(rr.Body).Decode(&results); err != nil || len(results) != 1 {
+			t.Fatalf("upload: %d %v", rr.Code, err)
+		}
+		return results[0]
+	}
+
+	fresh := "fresh " + uuid.NewString()
+	freshSum := fmt.Sprintf("%x", sha256.Sum256([]byte(fresh)))
+	if _, resp := check(user, api.UploadCheckRequest{SHA256: freshSum, Size: int64(len(fresh)), FileName: "new.bin"}); !resp.UploadRequired {
+		t.Fatalf("unknown content should require the bytes: %+v", resp)
+	}
+	if res := upload(freshSum, fresh+"tampered"); !strings.Contains(res.Error, "declared sha256") {
+		t.Fatalf("mismatching content should be rejected: %+v", res)
+	}
+	var count int64
+	conn.Model(&db.File{}).Where("hash = ?", freshSum).Count(&count)
+	if count != 0 {
+		t.Fatalf("rejected upload left a file row")
+	}
+	if res := upload(freshSum, fresh); res.Error != "" || res.Hash != freshSum {
+		t.Fatalf("matching content should be stored: %+v", res)
+	}
+}
@@ -0,0 +1,197 @@
+package tests
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"backend/internal/db"
+	"backend/internal/services"
+	"backend/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// TestUserDeletionReleasesFiles deletes a user through the job and checks ref counts, objects and shares.
+func TestUserDeletionReleasesFiles(t *testing.T) {
+	_, _, conn := SetupTest(t)
+	ctx := context.Background()
+	store := storage.NewMemoryStorage()
+	fs := services.NewFileService(conn, store)
+	deletions := services.NewUserDeletionService(conn, fs)
+
+	victim := newTestUser(t, conn)
+	other := newTestUser(t, conn)
+	own := "only mine " + uuid.NewString()
+	common := "both of us " + uuid.NewString()
+	ownID := uploadFile(t, fs, victim, "own.txt", own)
+	commonID := uploadFile(t, fs, other, "common.txt", common)
+	uploadFile(t, fs, victim, "common.txt", common)
+	folder, err := services.NewFolderService(conn, fs).CreateFolder(victim.ID, "docs", nil)
+	if err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	uploadFileTo(t, fs, victim, &folder.ID, "nested.txt", "nested "+uuid.NewString())
+	share, err := services.NewShareService(conn).CreateShare(victim.ID, ownID, true, nil, services.ShareOptions{})
+	if err != nil {
+		t.Fatalf("create share: %v", err)
+	}
+
+	job, err := deletions.Request(victim.ID, nil, nil)
+	if err != nil || job.FilesTotal != 3 {
+		t.Fatalf("request deletion: %v %+v", err, job)
+	}
+	// the account and its links stop working before the job runs
+	conn.First(victim, "id = ?", victim.ID)
+	conn.First(share, "id = ?", share.ID)
+	if victim.SuspendedAt == nil || share.RevokedAt == nil {
+		t.Fatalf("expected suspended user and revoked share: %v %v", victim.SuspendedAt, share.RevokedAt)
+	}
+	if again, err := deletions.Request(victim.ID, nil, nil); err != nil || again.ID != job.ID {
+		t.Fatalf("second request should return the queued job: %v %+v", err, again)
+	}
+
+	if err := deletions.RunPending(ctx); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	job, _ = deletions.Get(job.ID)
+	if job.Status != services.DeletionDone || job.FilesDone != 3 {
+		t.Fatalf("job not finished: %+v", job)
+	}
+	var count int64
+	conn.Model(&db.User{}).Where("id = ?", victim.ID).Count(&count)
+	if count != 0 {
+		t.Fatalf("user row still there")
+	}
+	conn.Model(&db.Share{}).Where("user_id = ?", victim.ID).Count(&count)
+	if count != 0 {
+		t.Fatalf("%d shares left pointing at the deleted user", count)
+	}
+	conn.Model(&db.Folder{}).Where("owner_id = ?", victim.ID).Count(&count)
+	if count != 0 {
+		t.Fatalf("%d folders left behind", count)
+	}
+	if _, err := store.Stat(ctx, fmt.Sprintf("%x", sha256.Sum256([]byte(own)))); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("unshared content not freed: %v", err)
+	}
+	var file db.File
+	if err := conn.First(&file, "id = ?", commonID).Error; err != nil || file.RefCount != 1 {
+		t.Fatalf("shared content should keep one reference: %v %+v", err, file)
+	}
+	if _, err := store.Stat(ctx, file.ObjectName); err != nil {
+		t.Fatalf("content still referenced was removed: %v", err)
+	}
+}
+
+// TestUserDeletionTransfer hands the deleted user's files and folders to another user.
+func TestUserDeletionTransfer(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	ctx := context.Background()
+	deletions := services.NewUserDeletionService(conn, fs)
+
+	victim := newTestUser(t, conn)
+	heir := newTestUser(t, conn)
+	folders := services.NewFolderService(conn, fs)
+	folder, err := folders.CreateFolder(victim.ID, "projects", nil)
+	if err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	rootID := uploadFile(t, fs, victim, "root.txt", "root "+uuid.NewString())
+	nestedID := uploadFileTo(t, fs, victim, &folder.ID, "plan.txt", "plan "+uuid.NewString())
+	conn.First(victim, "id = ?", victim.ID)
+
+	if _, err := deletions.Request(victim.ID, &victim.ID, nil); !errors.Is(err, services.ErrInvalidTransfer) {
+		t.Fatalf("transfer to self: expected ErrInvalidTransfer, got %v", err)
+	}
+	job, err := deletions.Request(victim.ID, &heir.ID, nil)
+	if err != nil {
+		t.Fatalf("request deletion: %v", err)
+	}
+	if err := deletions.RunPending(ctx); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if job, _ = deletions.Get(job.ID); job.Status != services.DeletionDone {
+		t.Fatalf("job not finished: %+v", job)
+	}
+
+	// everything now sits below "from <username>" in the heir's root
+	top, err := folders.ListUserFolders(heir.ID, nil)
+	if err != nil || len(top) != 1 || top[0].Name != "from "+victim.Username {
+		t.Fatalf("expected one transfer folder: %v %+v", err, top)
+	}
+	var moved []db.UserFile
+	conn.Where("user_id = ?", heir.ID).Find(&moved)
+	if len(moved) != 2 {
+		t.Fatalf("expected 2 transferred files, got %d", len(moved))
+	}
+	for _, uf := range moved {
+		switch uf.FileID {
+		case rootID:
+			if uf.FolderID == nil || *uf.FolderID != top[0].ID {
+				t.Fatalf("root file should land in the transfer folder: %+v", uf)
+			}
+		case nestedID:
+			if uf.FolderID == nil || *uf.FolderID != folder.ID {
+				t.Fatalf("nested file should keep its folder: %+v", uf)
+			}
+		}
+	}
+	conn.First(&folder, "id = ?", folder.ID)
+	if folder.OwnerID != heir.ID || folder.ParentID == nil || *folder.ParentID != top[0].ID {
+		t.Fatalf("folder not handed over: %+v", folder)
+	}
+	var heirNow db.User
+	conn.First(&heirNow, "id = ?", heir.ID)
+	if heirNow.UsedStorage != victim.UsedStorage {
+		t.Fatalf("heir storage %d, expected %d", heirNow.UsedStorage, victim.UsedStorage)
+	}
+}
+
+// TestUserDeletionTransferQuota fails a transfer that doesn't fit the
+// recipient's quota and finishes it once the quota was raised.
+func TestUserDeletionTransferQuota(t *testing.T) {
+	fs, _, conn := SetupTest(t)
+	ctx := context.Background()
+	deletions := services.NewUserDeletionService(conn, fs)
+
+	victim := newTestUser(t, conn)
+	heir := newTestUser(t, conn)
+	content := "too big for the heir " + uuid.NewString()
+	fileID := uploadFile(t, fs, victim, "big.txt", content)
+	conn.Model(heir).Update("quota", 5)
+
+	job, err := deletions.Request(victim.ID, &heir.ID, nil)
+	if err != nil {
+		t.Fatalf("request deletion: %v", err)
+	}
+	if err := deletions.RunPending(ctx); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if job, _ = deletions.Get(job.ID); job.Status != services.DeletionFailed || !strings.Contains(job.Error, services.ErrQuotaExceeded.Error()) {
+		t.Fatalf("expected the job to fail on the quota: %+v", job)
+	}
+	var heirNow db.User
+	conn.First(&heirNow, "id = ?", heir.ID)
+	if heirNow.UsedStorage != 0 {
+		t.Fatalf("heir was charged %d bytes for a failed transfer", heirNow.UsedStorage)
+	}
+	var left int64
+	conn.Model(&db.UserFile{}).Where("user_id = ? AND file_id = ?", victim.ID, fileID).Count(&left)
+	if left != 1 {
+		t.Fatalf("the file should stay with the user until it fits, %d entries", left)
+	}
+
+	conn.Model(heir).Update("quota", int64(len(content)))
+	if _, err := deletions.Request(victim.ID, &heir.ID, nil); err != nil {
+		t.Fatalf("request again: %v", err)
+	}
+	if err := deletions.RunPending(ctx); err != nil {
+		t.Fatalf("run again: %v", err)
+	}
+	if job, _ = deletions.Get(job.ID); job.Status != services.DeletionDone {
+		t.Fatalf("job should finish once the file fits: %+v", job)
+	}
+}